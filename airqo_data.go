@@ -5,6 +5,7 @@ import (
 	"airqo-integrator/db"
 	"airqo-integrator/models"
 	"airqo-integrator/utils"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/jmoiron/sqlx"
@@ -95,6 +96,12 @@ func saveRequest(dbConn *sqlx.DB, batchId string, dataValuesRequest models.DataV
 	payload, _ := json.Marshal(dataValuesRequest)
 	fmt.Printf("%v\n", string(payload))
 	year, week := time.Now().ISOWeek()
+	// backfills of older periods should not hold up the current day's data
+	priority := models.RequestPriorityNormal
+	if periodDate, err := time.Parse("2006-01-02", dataValuesRequest.Period); err == nil &&
+		time.Since(periodDate) > 48*time.Hour {
+		priority = models.RequestPriorityLow
+	}
 	reqF := models.RequestForm{
 		Source: "localhost", Destination: "dhis2", ContentType: "application/json",
 		Year: fmt.Sprintf("%d", year), Week: fmt.Sprintf("%d", week),
@@ -102,6 +109,7 @@ func saveRequest(dbConn *sqlx.DB, batchId string, dataValuesRequest models.DataV
 		District: districtName, Facility: subCountyUID, BatchID: batchId,
 		CCServers: strings.Split(config.AirQoIntegratorConf.API.AIRQOCCDHIS2Servers, ","),
 		Body:      string(payload), ObjectType: "AGGREGATE_DATA", ReportType: "airqo_data",
+		Priority: priority,
 	}
 
 	if _, err := reqF.Save(dbConn); err != nil {
@@ -196,7 +204,9 @@ func processDistrict(dbConn *sqlx.DB, batchId string,
 	}
 }
 
-func SendAirQoClimateData2(startDate, endDate time.Time) {
+// SendAirQoClimateData2 queues the measurements of the site districts between the dates
+// and returns the batch of the requests it created. It stops between districts once ctx is cancelled
+func SendAirQoClimateData2(ctx context.Context, startDate, endDate time.Time) (string, error) {
 	log.Infof("...::...Starting to fetch and send AirQo data to DHIS2...::...")
 	dbConn := db.GetDB()
 	batchId := utils.GetUID()
@@ -206,11 +216,16 @@ func SendAirQoClimateData2(startDate, endDate time.Time) {
 	for currentDate := startDate; !currentDate.After(endDate); currentDate = currentDate.Add(24 * time.Hour) {
 		nextDate := currentDate.Add(24 * time.Hour)
 		for _, districtID := range siteDistricts {
+			if ctx.Err() != nil {
+				log.Info("Shutting down. Stopped fetching and sending AirQo data")
+				return batchId, ctx.Err()
+			}
 			log.Infof("Processing for district %d: startDate %v, endDate: %v", districtID, currentDate, nextDate)
 			processDistrict(dbConn, batchId, dhis2Mappings, districtID, currentDate, nextDate)
 		}
 	}
 	log.Infof("...::...Done fetching and sending AirQo data to DHIS2...::...")
+	return batchId, nil
 }
 
 //func SendAirQoClimateData() {
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"airqo-integrator/config"
+	"airqo-integrator/models"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// setServerOutcome records the outcome of the request on a server, its destination or one of its CC servers
+func (r *RequestObject) setServerOutcome(
+	tx *sqlx.Tx, serverID models.ServerID, serverInCC bool, status models.RequestStatus, statusCode, summary string) {
+	r.applyServerOutcome(serverID, serverInCC, status, statusCode, summary)
+	if serverInCC {
+		r.updateCCServerStatus(tx)
+		return
+	}
+	r.updateRequest(tx)
+}
+
+// applyServerOutcome sets the outcome of the request on a server without saving it
+func (r *RequestObject) applyServerOutcome(
+	serverID models.ServerID, serverInCC bool, status models.RequestStatus, statusCode, summary string) {
+	if serverInCC {
+		key := fmt.Sprintf("%d", serverID)
+		newServerStatus := map[string]interface{}{"errors": summary, "status": status, "retries": 0}
+		if serverStatus, ok := r.CCServersStatus[key].(map[string]interface{}); ok {
+			newServerStatus["retries"] = serverStatus["retries"]
+			newServerStatus["statusCode"] = serverStatus["statusCode"]
+		}
+		if statusCode != "" {
+			newServerStatus["statusCode"] = statusCode
+		}
+		if r.CCServersStatus == nil {
+			r.CCServersStatus = make(map[string]interface{})
+		}
+		r.CCServersStatus[key] = newServerStatus
+		return
+	}
+	r.Status = status
+	r.Errors = summary
+	if statusCode != "" {
+		r.StatusCode = statusCode
+	}
+}
+
+// runAsyncJobCheck polls the DHIS2 async job of a request. Once the job finishes its task summary decides the
+// outcome of the request and its conflicts are saved. A job that vanishes from the server or is still not finished
+// after the server's maximum polling age leaves the request unknown until the values it sent are reconciled.
+// The server is polled outside a transaction and the outcome is saved in a short one
+func runAsyncJobCheck(db *sqlx.DB, schedule models.Schedule, run *models.ScheduleRun) error {
+	logger := log.WithFields(log.Fields{"scheduleID": schedule.ID, "jobID": schedule.AsyncJobID})
+	if schedule.RequestID == nil || schedule.ServerID == nil {
+		return inTx(db, func(tx *sqlx.Tx) error {
+			return endAsyncJobCheck(tx, schedule, run, models.ScheduleRunError, "Async job check without a request or server")
+		})
+	}
+	run.AddRequests(*schedule.RequestID)
+	reqObj, err := GetRequestObjectById(db, *schedule.RequestID)
+	if err != nil {
+		return inTx(db, func(tx *sqlx.Tx) error {
+			return endAsyncJobCheck(tx, schedule, run, models.ScheduleRunError,
+				fmt.Sprintf("Request %d not found: %v", *schedule.RequestID, err))
+		})
+	}
+	serverInCC := schedule.ServerInCC != nil && *schedule.ServerInCC
+	server := models.GetServerByID(int64(*schedule.ServerID))
+	maxAge := server.AsyncJobMaxAge()
+
+	completed, exists, err := models.CheckDhis2AsyncJobStatus(schedule)
+	if err == nil && completed {
+		var taskSummary *models.AsyncJobImportSummary
+		taskSummary, err = models.CheckDhis2AsyncJobTaskSummary(schedule)
+		if err == nil && taskSummary == nil {
+			err = errors.New("empty task summary")
+		}
+		if err == nil {
+			status := models.ImportStatus(models.ResponseStatus(taskSummary.Status), taskSummary.ImportCount)
+			summary := models.ImportCountSummary(taskSummary.ImportCount)
+			if err := inTx(db, func(tx *sqlx.Tx) error {
+				if err := models.SaveRequestConflicts(
+					tx, reqObj.ID, *schedule.ServerID, taskSummary.ImportConflicts); err != nil {
+					return err
+				}
+				reqObj.setServerOutcome(tx, *schedule.ServerID, serverInCC, status, "", summary)
+				return endAsyncJobCheck(tx, schedule, run, models.ScheduleRunCompleted,
+					fmt.Sprintf("Async job finished with status %s. %s", taskSummary.Status, summary))
+			}); err != nil {
+				return err
+			}
+			logger.WithFields(log.Fields{
+				"requestID": reqObj.ID, "status": status, "conflicts": len(taskSummary.ImportConflicts),
+			}).Info("Async job finished")
+			return nil
+		}
+		logger.WithError(err).Error("Failed to get the task summary of the async job")
+	}
+
+	switch {
+	case err == nil && !exists:
+		// e.g. the server was restarted and lost its tasks
+		return reconcileAsyncJob(db, schedule, run, reqObj, serverInCC, "Async job not found on the server")
+	case time.Since(schedule.Created) >= maxAge:
+		return reconcileAsyncJob(db, schedule, run, reqObj, serverInCC,
+			fmt.Sprintf("Async job not finished after %s", maxAge))
+	}
+	message := "Async job still running"
+	if err != nil {
+		message = fmt.Sprintf("Failed to check async job: %v", err)
+	}
+	run.SetOutcome(models.ScheduleRunPending, message)
+	nextRun := time.Now().Add(
+		time.Second * time.Duration(config.AirQoIntegratorConf.Server.Dhis2JobStatusCheckInterval))
+	return inTx(db, func(tx *sqlx.Tx) error {
+		if err := schedule.RecordRunResult(tx, 0, "", message); err != nil {
+			return err
+		}
+		return schedule.UpdateRunDetails(tx, "ready", nextRun)
+	})
+}
+
+// reconcileAsyncJob gives up on an async job. The request is marked unknown and then, when DHIS2
+// dataValueSets confirm whether its values landed, completed, partial or failed
+func reconcileAsyncJob(
+	db *sqlx.DB, schedule models.Schedule, run *models.ScheduleRun, reqObj *RequestObject, serverInCC bool,
+	reason string) error {
+	logger := log.WithFields(log.Fields{"scheduleID": schedule.ID, "requestID": reqObj.ID})
+	logger.Warn(reason + ". Reconciling request")
+	result, err := models.ReconcileDataValues(*schedule.ServerID, []byte(reqObj.Body), reqObj.ObjectType)
+	return inTx(db, func(tx *sqlx.Tx) error {
+		reqObj.setServerOutcome(tx, *schedule.ServerID, serverInCC, models.RequestStatusUnknown, "ERROR04",
+			reason+". Outcome unknown")
+		if err != nil {
+			logger.WithError(err).Warn("Failed to reconcile request")
+			return endAsyncJobCheck(tx, schedule, run, models.ScheduleRunExpired,
+				fmt.Sprintf("%s. Reconciliation failed: %v", reason, err))
+		}
+		reqObj.setServerOutcome(tx, *schedule.ServerID, serverInCC, result.Status(), "", result.Summary())
+		logger.WithFields(log.Fields{
+			"status": result.Status(), "expected": result.Expected, "found": result.Found}).Info("Reconciled request")
+		return endAsyncJobCheck(tx, schedule, run, models.ScheduleRunExpired, reason+". "+result.Summary())
+	})
+}
+
+// endAsyncJobCheck stops polling the async job
+func endAsyncJobCheck(tx *sqlx.Tx, schedule models.Schedule, run *models.ScheduleRun, status, message string) error {
+	run.SetOutcome(status, message)
+	if err := schedule.RecordRunResult(tx, 0, "", message); err != nil {
+		return err
+	}
+	if err := schedule.UpdateRunDetails(tx, status, schedule.NextRunAt); err != nil {
+		return err
+	}
+	return schedule.Deactivate(tx)
+}
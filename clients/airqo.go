@@ -12,11 +12,6 @@ var AirQoClient *Client
 
 var AirQoServer *Server
 
-func init() {
-	InitAirQoServer()
-	AirQoClient, _ = AirQoServer.NewAirQoClient()
-}
-
 func GetAirQoBaseURL(url string) (string, error) {
 	if strings.Contains(url, "/api/v2/") {
 		pos := strings.Index(url, "/api/v2/")
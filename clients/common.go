@@ -5,6 +5,14 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Init creates the clients of the base DHIS2 instance and the AirQo API from the configuration
+func Init() {
+	InitDhis2Server()
+	Dhis2Client, _ = Dhis2Server.NewDhis2Client()
+	InitAirQoServer()
+	AirQoClient, _ = AirQoServer.NewAirQoClient()
+}
+
 type Client struct {
 	RestClient *resty.Client
 	BaseURL    string
@@ -11,11 +11,6 @@ import (
 var Dhis2Client *Client
 var Dhis2Server *Server
 
-func init() {
-	InitDhis2Server()
-	Dhis2Client, _ = Dhis2Server.NewDhis2Client()
-}
-
 func GetDHIS2BaseURL(url string) (string, error) {
 	if strings.Contains(url, "/api/") {
 		pos := strings.Index(url, "/api/")
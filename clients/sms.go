@@ -0,0 +1,124 @@
+package clients
+
+import (
+	"airqo-integrator/config"
+	"airqo-integrator/utils"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// smsBatchSize is the most recipients sent one message in a gateway call
+const smsBatchSize = 100
+
+// SMSProvider sends text messages
+type SMSProvider interface {
+	Name() string
+	// Send sends text to the recipients. It returns the recipients the message could not be sent to
+	Send(ctx context.Context, recipients []string, text string) (failed []string, err error)
+}
+
+// HTTPSMSGateway posts messages as JSON {"from", "to", "message"} to a generic SMS gateway
+type HTTPSMSGateway struct {
+	URL    string
+	Token  string
+	Sender string
+	client *resty.Client
+}
+
+// NewHTTPSMSGateway returns a gateway posting to url with token as bearer token when set
+func NewHTTPSMSGateway(url, token, sender string) (*HTTPSMSGateway, error) {
+	if url == "" {
+		return nil, errors.New("SMS gateway URL not configured")
+	}
+	client := resty.New()
+	client.SetHeaders(map[string]string{
+		"Accept":       "application/json",
+		"Content-Type": "application/json",
+		"User-Agent":   "AirQo-DHIS2 Integrator",
+	})
+	client.SetTimeout(60 * time.Second)
+	client.SetDisableWarn(true)
+	if token != "" {
+		client.SetAuthToken(token)
+	}
+	return &HTTPSMSGateway{URL: url, Token: token, Sender: sender, client: client}, nil
+}
+
+func (g *HTTPSMSGateway) Name() string { return "http" }
+
+func (g *HTTPSMSGateway) Send(ctx context.Context, recipients []string, text string) ([]string, error) {
+	var failed []string
+	var lastErr error
+	for start := 0; start < len(recipients); start += smsBatchSize {
+		batch := recipients[start:min(start+smsBatchSize, len(recipients))]
+		resp, err := g.client.R().SetContext(ctx).SetBody(map[string]any{
+			"from": g.Sender, "to": batch, "message": text,
+		}).Post(g.URL)
+		if err == nil && resp.IsError() {
+			err = fmt.Errorf("SMS gateway responded with status %s", resp.Status())
+		}
+		if err != nil {
+			log.WithError(err).WithField("recipients", len(batch)).Warn("Failed to send SMS")
+			failed = append(failed, batch...)
+			lastErr = err
+		}
+	}
+	return failed, lastErr
+}
+
+// SentSMS is a message sent through the mock provider
+type SentSMS struct {
+	Recipients []string
+	Text       string
+	Sent       time.Time
+}
+
+// MockSMSProvider logs messages instead of sending them and keeps them for inspection
+type MockSMSProvider struct {
+	// Undeliverable are the numbers the mock fails to deliver to
+	Undeliverable []string
+	mu            sync.Mutex
+	sent          []SentSMS
+}
+
+func (m *MockSMSProvider) Name() string { return "mock" }
+
+func (m *MockSMSProvider) Send(_ context.Context, recipients []string, text string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, SentSMS{Recipients: recipients, Text: text, Sent: time.Now()})
+	log.WithFields(log.Fields{"recipients": recipients, "text": text}).Info("Mock SMS sent")
+	failed := lo.Intersect(recipients, m.Undeliverable)
+	if len(failed) > 0 {
+		return failed, fmt.Errorf("mock could not deliver to %d recipients", len(failed))
+	}
+	return nil, nil
+}
+
+// Sent returns the messages sent so far
+func (m *MockSMSProvider) Sent() []SentSMS {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SentSMS{}, m.sent...)
+}
+
+// MockSMS is the provider used when sms_provider is mock
+var MockSMS = &MockSMSProvider{}
+
+// NewSMSProvider returns the SMS provider set in the configuration
+func NewSMSProvider() (SMSProvider, error) {
+	api := config.AirQoIntegratorConf.API
+	switch api.SMSProvider {
+	case "", "http":
+		return NewHTTPSMSGateway(api.SMSGatewayURL, utils.RevealSecret(api.SMSGatewayToken), api.SMSSender)
+	case "mock":
+		return MockSMS, nil
+	}
+	return nil, fmt.Errorf("unknown SMS provider %s", api.SMSProvider)
+}
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -29,12 +30,28 @@ var SkipScheduleProcessing *bool
 var SkipFectchingByDate *bool
 var AIRQODHIS2ServersConfigMap = make(map[string]ServerConf)
 var ShowVersion *bool
+var RotateKeys *bool
+var EncryptSecret *string
 
 const VERSION = "1.0.0"
 
+var (
+	configChangeMutex    sync.Mutex
+	configChangeHandlers []func()
+)
+
+// OnConfigChange registers a handler called after the configuration file is changed and reloaded
+func OnConfigChange(handler func()) {
+	configChangeMutex.Lock()
+	defer configChangeMutex.Unlock()
+	configChangeHandlers = append(configChangeHandlers, handler)
+}
+
 // var FakeSyncToBaseDHIS2 *bool
 
-func init() {
+// Init parses the command line flags and loads the configuration file and the conf.d server configurations.
+// main calls it before anything reads the configuration
+func Init() {
 	// ./airqo-integrator --config-file /etc/airqointegrator/airqod.yml
 	var configFilePath, configDir, conf_dDir string
 	currentOS := runtime.GOOS
@@ -67,6 +84,8 @@ func init() {
 	SkipScheduleProcessing = flag.Bool("skip-schedule-processing", false, "Whether to skip schedule processing")
 	SkipFectchingByDate = flag.Bool("skip-fetching-by-date", false, "Whether to skip fetching measurements by start and end date")
 	ShowVersion = flag.Bool("version", false, "Display version of AIRQO Integrator")
+	RotateKeys = flag.Bool("rotate-keys", false, "Re-encrypt all server secrets with the current master key and exit")
+	EncryptSecret = flag.String("encrypt-secret", "", "Print the encrypted form of a secret for use in conf.d files and exit")
 	// FakeSyncToBaseDHIS2 = flag.Bool("fake-sync-to-base-dhis2", false, "Whether to fake sync to base DHIS2")
 
 	flag.CommandLine.AddGoFlagSet(goflag.CommandLine)
@@ -108,49 +127,17 @@ func init() {
 			log.Fatalf("unable to reread configuration into global conf: %v", err)
 		}
 		_ = viper.Unmarshal(&AirQoIntegratorConf)
+		configChangeMutex.Lock()
+		handlers := append([]func(){}, configChangeHandlers...)
+		configChangeMutex.Unlock()
+		for _, handler := range handlers {
+			handler()
+		}
 	})
 	viper.WatchConfig()
 
-	v := viper.New()
-	v.SetConfigType("json")
-
-	fileList, err := getFilesInDirectory(conf_dDir)
-	if err != nil {
-		log.WithError(err).Info("Error reading directory")
-	}
-	// Loop through the files and read each one
-	for _, file := range fileList {
-		v.SetConfigFile(file)
-
-		if err := v.ReadInConfig(); err != nil {
-			log.WithError(err).WithField("File", file).Error("Error reading config file:")
-			continue
-		}
-
-		// Unmarshal the config data into your structure
-		var config ServerConf
-		if err := v.Unmarshal(&config); err != nil {
-			log.WithError(err).WithField("File", file).Error("Error unmarshaling config file:")
-			continue
-		}
-		AIRQODHIS2ServersConfigMap[config.Name] = config
-
-		// Now you can use the config structure as needed
-		// fmt.Printf("Configuration from %s: %+v\n", file, config)
-	}
-	v.OnConfigChange(func(e fsnotify.Event) {
-		if err := v.ReadInConfig(); err != nil {
-			log.WithError(err).WithField("File", e.Name).Error("Error reading config file:")
-		}
-
-		// Unmarshal the config data into your structure
-		var config ServerConf
-		if err := v.Unmarshal(&config); err != nil {
-			log.WithError(err).WithField("File", e.Name).Fatalf("Error unmarshaling config file:")
-		}
-		AIRQODHIS2ServersConfigMap[config.Name] = config
-	})
-	v.WatchConfig()
+	loadServerConfigs(conf_dDir)
+	go watchServerConfigs(conf_dDir)
 }
 
 // Config is the top level cofiguration object
@@ -172,13 +159,27 @@ type Config struct {
 		SyncOn                      bool   `mapstructure:"sync_on" env:"AIRQOINTEGRATOR_SYNC_ON" env-default:"true"`
 		FakeSyncToBaseDHIS2         bool   `mapstructure:"fake_sync_to_base_dhis2" env:"AIRQOINTEGRATOR_FAKE_SYNC_TO_BASE_DHIS2" env-default:"false"`
 		RequestProcessInterval      int    `mapstructure:"request_process_interval" env:"AIRQOINTEGRATOR_REQUEST_PROCESS_INTERVAL" env-default:"4"`
+		RequestLaneWeights          string `mapstructure:"request_lane_weights" env:"AIRQOINTEGRATOR_REQUEST_LANE_WEIGHTS" env-description:"Comma separated object_type:weight pairs used to share consumers between request lanes" env-default:""`
+		RequestLaneBatchSize        int    `mapstructure:"request_lane_batch_size" env:"AIRQOINTEGRATOR_REQUEST_LANE_BATCH_SIZE" env-description:"The maximum ready requests read per lane on each producer run" env-default:"50"`
+		ShutdownTimeout             int    `mapstructure:"shutdown_timeout" env:"AIRQOINTEGRATOR_SHUTDOWN_TIMEOUT" env-description:"Seconds to wait for in-flight requests to drain on shutdown" env-default:"30"`
+		ScheduleRunTimeout          int    `mapstructure:"schedule_run_timeout" env:"AIRQOINTEGRATOR_SCHEDULE_RUN_TIMEOUT" env-description:"Seconds a running schedule may go without its claim being renewed before it is assumed abandoned and made ready again" env-default:"3600"`
 		Dhis2JobStatusCheckInterval int    `mapstructure:"dhis2_job_status_check_interval" env:"DHIS2_JOB_STATUS_CHECK_INTERVAL" env-description:"The DHIS2 job status check interval in seconds" env-default:"30"`
+		Dhis2AsyncJobMaxAge         int    `mapstructure:"dhis2_async_job_max_age" env:"DHIS2_ASYNC_JOB_MAX_AGE" env-description:"Seconds a DHIS2 async job is polled before the outcome of its request is reconciled" env-default:"86400"`
 		LogDirectory                string `mapstructure:"logdir" env:"AIRQOINTEGRATOR_LOGDIR" env-default:"/var/log/airqointegrator"`
 		MigrationsDirectory         string `mapstructure:"migrations_dir" env:"AIRQOINTEGRATOR_MIGRATTIONS_DIR" env-default:"file:///usr/share/airqointegrator/db/migrations"`
-		UseSSL                      string `mapstructure:"use_ssl" env:"AIRQOINTEGRATOR_USE_SSL" env-default:"true"`
+		UseSSL                      string `mapstructure:"use_ssl" env:"AIRQOINTEGRATOR_USE_SSL" env-description:"Whether the global CA bundle and client certificate apply to servers without their own" env-default:"true"`
 		SSLClientCertKeyFile        string `mapstructure:"ssl_client_certkey_file" env:"SSL_CLIENT_CERTKEY_FILE" env-default:""`
 		SSLServerCertKeyFile        string `mapstructure:"ssl_server_certkey_file" env:"SSL_SERVER_CERTKEY_FILE" env-default:""`
 		SSLTrustedCAFile            string `mapstructure:"ssl_trusted_cafile" env:"SSL_TRUSTED_CA_FILE" env-default:""`
+		MasterKeyFile               string `mapstructure:"master_key_file" env:"AIRQOINTEGRATOR_MASTER_KEY_FILE" env-description:"File holding the 32 byte base64 or hex key encrypting server secrets. AIRQOINTEGRATOR_MASTER_KEY takes precedence" env-default:""`
+		PreviousMasterKeyFiles      string `mapstructure:"previous_master_key_files" env:"AIRQOINTEGRATOR_PREVIOUS_MASTER_KEY_FILES" env-description:"Comma separated files holding retired master keys still used for decryption during rotation" env-default:""`
+		OutboundConnectTimeout      int    `mapstructure:"outbound_connect_timeout" env:"AIRQOINTEGRATOR_OUTBOUND_CONNECT_TIMEOUT" env-description:"Default seconds to connect to a destination server" env-default:"10"`
+		OutboundReadTimeout         int    `mapstructure:"outbound_read_timeout" env:"AIRQOINTEGRATOR_OUTBOUND_READ_TIMEOUT" env-description:"Default seconds to wait for a destination server's response headers" env-default:"60"`
+		OutboundRequestTimeout      int    `mapstructure:"outbound_request_timeout" env:"AIRQOINTEGRATOR_OUTBOUND_REQUEST_TIMEOUT" env-description:"Default overall seconds for a request to a destination server" env-default:"120"`
+		RequestRetentionDays        int    `mapstructure:"request_retention_days" env:"AIRQOINTEGRATOR_REQUEST_RETENTION_DAYS" env-description:"Days completed requests are kept before being archived. 0 keeps them" env-default:"0"`
+		FailedRequestRetentionDays  int    `mapstructure:"failed_request_retention_days" env:"AIRQOINTEGRATOR_FAILED_REQUEST_RETENTION_DAYS" env-description:"Days failed, expired and canceled requests are kept before being archived. 0 keeps them" env-default:"0"`
+		RequestArchiveDir           string `mapstructure:"request_archive_dir" env:"AIRQOINTEGRATOR_REQUEST_ARCHIVE_DIR" env-description:"Directory for gzip JSONL request archives. Requests are archived in the database when empty" env-default:""`
+		RequestPurgeBatchSize       int    `mapstructure:"request_purge_batch_size" env:"AIRQOINTEGRATOR_REQUEST_PURGE_BATCH_SIZE" env-description:"Requests archived per transaction by the purge" env-default:"1000"`
 		TimeZone                    string `mapstructure:"timezone" env:"DISPATCHER2_TIMEZONE" env-default:"Africa/Kampala" env-description:"The time zone used for this dispatcher2 deployment"`
 	} `yaml:"server"`
 
@@ -207,40 +208,86 @@ type Config struct {
 		AIRQOSyncCronExpression        string `mapstructure:"airqo_sync_cron_expression"  env:"AIRQOINTEGRATOR_SYNC_CRON_EXPRESSION" env-description:"The AIRQO Measurements Syncronisation Cron Expression" env-default:"0 0-23/6 * * *"`
 		AIRQORetryCronExpression       string `mapstructure:"airqo_retry_cron_expression"  env:"AIRQOINTEGRATOR_RETRY_CRON_EXPRESSION" env-description:"The AIRQO request retry Cron Expression" env-default:"*/5 * * * *"`
 		AuthToken                      string `mapstructure:"authtoken" env:"RAPIDPRO_AUTH_TOKEN" env-description:"API JWT authorization token"`
+		SMSProvider                    string `mapstructure:"sms_provider" env:"AIRQOINTEGRATOR_SMS_PROVIDER" env-description:"The provider sending SMS alerts, http or mock" env-default:"http"`
+		SMSGatewayURL                  string `mapstructure:"sms_gateway_url" env:"AIRQOINTEGRATOR_SMS_GATEWAY_URL" env-description:"The URL the http SMS provider posts messages to"`
+		SMSGatewayToken                string `mapstructure:"sms_gateway_token" env:"AIRQOINTEGRATOR_SMS_GATEWAY_TOKEN" env-description:"The bearer token of the SMS gateway. May be encrypted with --encrypt-secret"`
+		SMSSender                      string `mapstructure:"sms_sender" env:"AIRQOINTEGRATOR_SMS_SENDER" env-description:"The sender ID of SMS alerts"`
+		SMSPM25Categories              string `mapstructure:"sms_pm25_categories" env:"AIRQOINTEGRATOR_SMS_PM25_CATEGORIES" env-description:"Comma separated category:lower_bound pairs of daily PM2.5 in µg/m³" env-default:"good:0,moderate:12.1,unhealthy_for_sensitive_groups:35.5,unhealthy:55.5,very_unhealthy:150.5,hazardous:250.5"`
 	} `yaml:"api"`
 }
 
 type ServerConf struct {
-	ID                      int64          `mapstructure:"id" json:"-"`
-	UID                     string         `mapstructure:"uid" json:"uid,omitempty"`
-	Name                    string         `mapstructure:"name" json:"name" validate:"required"`
-	Username                string         `mapstructure:"username" json:"username"`
-	Password                string         `mapstructure:"password" json:"password,omitempty"`
-	IsProxyServer           bool           `mapstructure:"isProxyserver" json:"isProxyServer,omitempty"`
-	SystemType              string         `mapstructure:"systemType" json:"systemType,omitempty"`
-	EndPointType            string         `mapstructure:"endpointType" json:"endPointType,omitempty"`
-	AuthToken               string         `mapstructure:"authToken" db:"auth_token" json:"AuthToken"`
-	IPAddress               string         `mapstructure:"IPAddress"  json:"IPAddress"`
-	URL                     string         `mapstructure:"URL" json:"URL" validate:"required,url"`
-	CCURLS                  pq.StringArray `mapstructure:"CCURLS" json:"CCURLS,omitempty"`
-	CallbackURL             string         `mapstructure:"callbackURL" json:"callbackURL,omitempty"`
-	HTTPMethod              string         `mapstructure:"HTTPMethod" json:"HTTPMethod" validate:"required"`
-	AuthMethod              string         `mapstructure:"AuthMethod" json:"AuthMethod" validate:"required"`
-	AllowCallbacks          bool           `mapstructure:"allowCallbacks" json:"allowCallbacks,omitempty"`
-	AllowCopies             bool           `mapstructure:"allowCopies" json:"allowCopies,omitempty"`
-	UseAsync                bool           `mapstructure:"useAsync" json:"useAsync,omitempty"`
-	UseSSL                  bool           `mapstructure:"useSSL" json:"useSSL,omitempty"`
-	ParseResponses          bool           `mapstructure:"parseResponses" json:"parseResponses,omitempty"`
-	SSLClientCertKeyFile    string         `mapstructure:"sslClientCertkeyFile" json:"sslClientCertkeyFile"`
-	StartOfSubmissionPeriod int            `mapstructure:"startSubmissionPeriod" json:"startSubmissionPeriod"`
-	EndOfSubmissionPeriod   int            `mapstructure:"endSubmissionPeriod" json:"endSubmissionPeriod"`
-	XMLResponseXPATH        string         `mapstructure:"XMLResponseXPATH"  json:"XMLResponseXPATH"`
-	JSONResponseXPATH       string         `mapstructure:"JSONResponseXPATH" json:"JSONResponseXPATH"`
-	Suspended               bool           `mapstructure:"suspended" json:"suspended,omitempty"`
-	URLParams               map[string]any `mapstructure:"URLParams" json:"URLParams,omitempty"`
-	Created                 time.Time      `mapstructure:"created" json:"created,omitempty"`
-	Updated                 time.Time      `mapstructure:"updated" json:"updated,omitempty"`
-	AllowedSources          []string       `mapstructure:"allowedSources" json:"allowedSources,omitempty"`
+	ID            int64          `mapstructure:"id" json:"-"`
+	UID           string         `mapstructure:"uid" json:"uid,omitempty"`
+	Name          string         `mapstructure:"name" json:"name" validate:"required"`
+	Username      string         `mapstructure:"username" json:"username"`
+	Password      string         `mapstructure:"password" json:"password,omitempty"`
+	IsProxyServer bool           `mapstructure:"isProxyserver" json:"isProxyServer,omitempty"`
+	SystemType    string         `mapstructure:"systemType" json:"systemType,omitempty"`
+	EndPointType  string         `mapstructure:"endpointType" json:"endPointType,omitempty"`
+	AuthToken     string         `mapstructure:"authToken" db:"auth_token" json:"AuthToken"`
+	IPAddress     string         `mapstructure:"IPAddress"  json:"IPAddress"`
+	URL           string         `mapstructure:"URL" json:"URL" validate:"required,url"`
+	CCURLS        pq.StringArray `mapstructure:"CCURLS" json:"CCURLS,omitempty"`
+	CallbackURL   string         `mapstructure:"callbackURL" json:"callbackURL,omitempty"`
+	HTTPMethod    string         `mapstructure:"HTTPMethod" json:"HTTPMethod" validate:"required"`
+	AuthMethod    string         `mapstructure:"AuthMethod" json:"AuthMethod" validate:"required"`
+	AuthConfig    struct {
+		TokenURL     string   `mapstructure:"tokenURL" json:"tokenURL,omitempty"`
+		ClientID     string   `mapstructure:"clientId" json:"clientId,omitempty"`
+		ClientSecret string   `mapstructure:"clientSecret" json:"clientSecret,omitempty"`
+		Scopes       []string `mapstructure:"scopes" json:"scopes,omitempty"`
+		HeaderName   string   `mapstructure:"headerName" json:"headerName,omitempty"`
+		HMACKeyID    string   `mapstructure:"hmacKeyId" json:"hmacKeyId,omitempty"`
+		HMACSecret   string   `mapstructure:"hmacSecret" json:"hmacSecret,omitempty"`
+		HMACHeader   string   `mapstructure:"hmacHeader" json:"hmacHeader,omitempty"`
+		TokenFile    string   `mapstructure:"tokenFile" json:"tokenFile,omitempty"`
+	} `mapstructure:"authConfig" json:"authConfig"`
+	AllowCallbacks          bool   `mapstructure:"allowCallbacks" json:"allowCallbacks,omitempty"`
+	AllowCopies             bool   `mapstructure:"allowCopies" json:"allowCopies,omitempty"`
+	UseAsync                bool   `mapstructure:"useAsync" json:"useAsync,omitempty"`
+	UseSSL                  bool   `mapstructure:"useSSL" json:"useSSL,omitempty"`
+	ParseResponses          bool   `mapstructure:"parseResponses" json:"parseResponses,omitempty"`
+	HealthURL               string `mapstructure:"healthURL" json:"healthURL,omitempty"`
+	SSLClientCertKeyFile    string `mapstructure:"sslClientCertkeyFile" json:"sslClientCertkeyFile"`
+	SSLTrustedCAFile        string `mapstructure:"sslTrustedCAFile" json:"sslTrustedCAFile,omitempty"`
+	SkipTLSVerify           bool   `mapstructure:"skipTLSVerify" json:"skipTLSVerify,omitempty"`
+	ConnectTimeout          int    `mapstructure:"connectTimeout" json:"connectTimeout,omitempty"`
+	ReadTimeout             int    `mapstructure:"readTimeout" json:"readTimeout,omitempty"`
+	RequestTimeout          int    `mapstructure:"requestTimeout" json:"requestTimeout,omitempty"`
+	AsyncJobMaxAge          int    `mapstructure:"asyncJobMaxAge" json:"asyncJobMaxAge,omitempty"`
+	StartOfSubmissionPeriod int    `mapstructure:"startSubmissionPeriod" json:"startSubmissionPeriod"`
+	EndOfSubmissionPeriod   int    `mapstructure:"endSubmissionPeriod" json:"endSubmissionPeriod"`
+	Timezone                string `mapstructure:"timezone" json:"timezone,omitempty"`
+	SubmissionWindows       []struct {
+		Days  []int  `mapstructure:"days" json:"days,omitempty"`
+		Start string `mapstructure:"start" json:"start"`
+		End   string `mapstructure:"end" json:"end"`
+	} `mapstructure:"submissionWindows" json:"submissionWindows,omitempty"`
+	BlackoutDates  []string `mapstructure:"blackoutDates" json:"blackoutDates,omitempty"`
+	BodyTransforms []struct {
+		Type        string            `mapstructure:"type" json:"type"`
+		ObjectTypes []string          `mapstructure:"objectTypes" json:"objectTypes,omitempty"`
+		UIDMap      map[string]string `mapstructure:"uidMap" json:"uidMap,omitempty"`
+		Fields      []string          `mapstructure:"fields" json:"fields,omitempty"`
+		Patch       []map[string]any  `mapstructure:"patch" json:"patch,omitempty"`
+		Template    string            `mapstructure:"template" json:"template,omitempty"`
+	} `mapstructure:"bodyTransforms" json:"bodyTransforms,omitempty"`
+	XMLResponseXPATH  string `mapstructure:"XMLResponseXPATH"  json:"XMLResponseXPATH"`
+	JSONResponseXPATH string `mapstructure:"JSONResponseXPATH" json:"JSONResponseXPATH"`
+	ResponseRules     struct {
+		SuccessValues []string `mapstructure:"successValues" json:"successValues,omitempty"`
+		RetryValues   []string `mapstructure:"retryValues" json:"retryValues,omitempty"`
+		FailureValues []string `mapstructure:"failureValues" json:"failureValues,omitempty"`
+		ReferencePath string   `mapstructure:"referencePath" json:"referencePath,omitempty"`
+	} `mapstructure:"responseRules" json:"responseRules"`
+	Suspended         bool           `mapstructure:"suspended" json:"suspended,omitempty"`
+	URLParams         map[string]any `mapstructure:"URLParams" json:"URLParams,omitempty"`
+	MaxConcurrent     int            `mapstructure:"maxConcurrent" json:"maxConcurrent,omitempty"`
+	RequestsPerSecond float64        `mapstructure:"requestsPerSecond" json:"requestsPerSecond,omitempty"`
+	Created           time.Time      `mapstructure:"created" json:"created,omitempty"`
+	Updated           time.Time      `mapstructure:"updated" json:"updated,omitempty"`
+	AllowedSources    []string       `mapstructure:"allowedSources" json:"allowedSources,omitempty"`
 }
 
 func getFilesInDirectory(directory string) ([]string, error) {
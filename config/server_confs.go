@@ -0,0 +1,147 @@
+package config
+
+import (
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	serverConfigsMutex    = &sync.RWMutex{}
+	serverConfigHandlers  []func(ServerConf)
+	serverConfigFileNames = make(map[string]string) // conf.d file => server name
+)
+
+// ServerConfigs returns a copy of the server configurations read from conf.d
+func ServerConfigs() map[string]ServerConf {
+	serverConfigsMutex.RLock()
+	defer serverConfigsMutex.RUnlock()
+	confs := make(map[string]ServerConf, len(AIRQODHIS2ServersConfigMap))
+	for k, v := range AIRQODHIS2ServersConfigMap {
+		confs[k] = v
+	}
+	return confs
+}
+
+// OnServerConfigChange registers a handler called with the server configuration
+// whenever a file in conf.d is created or changed
+func OnServerConfigChange(handler func(ServerConf)) {
+	serverConfigsMutex.Lock()
+	defer serverConfigsMutex.Unlock()
+	serverConfigHandlers = append(serverConfigHandlers, handler)
+}
+
+// readServerConfig reads one server configuration file
+func readServerConfig(file string) (ServerConf, error) {
+	var conf ServerConf
+	v := viper.New()
+	v.SetConfigType("json")
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return conf, err
+	}
+	err := v.Unmarshal(&conf)
+	return conf, err
+}
+
+// setServerConfig saves a server configuration and returns the handlers to notify
+func setServerConfig(file string, conf ServerConf) []func(ServerConf) {
+	serverConfigsMutex.Lock()
+	defer serverConfigsMutex.Unlock()
+	if previous, ok := serverConfigFileNames[file]; ok && previous != conf.Name {
+		log.WithFields(log.Fields{"file": file, "from": previous, "to": conf.Name}).Info("Server renamed in config file")
+		delete(AIRQODHIS2ServersConfigMap, previous)
+	}
+	serverConfigFileNames[file] = conf.Name
+	AIRQODHIS2ServersConfigMap[conf.Name] = conf
+	return append([]func(ServerConf){}, serverConfigHandlers...)
+}
+
+func loadServerConfigs(dir string) {
+	fileList, err := getFilesInDirectory(dir)
+	if err != nil {
+		log.WithError(err).Info("Error reading directory")
+	}
+	for _, file := range fileList {
+		conf, err := readServerConfig(file)
+		if err != nil {
+			log.WithError(err).WithField("File", file).Error("Error reading config file:")
+			continue
+		}
+		setServerConfig(file, conf)
+	}
+}
+
+// watchServerConfigs watches conf.d and passes created or changed server configurations to the
+// registered handlers. Editors often write a file several times, so events are debounced per file
+func watchServerConfigs(dir string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.WithError(err).Error("Failed to watch server config directory")
+		return
+	}
+	defer func() { _ = watcher.Close() }()
+	if err := watcher.Add(dir); err != nil {
+		log.WithError(err).WithField("dir", dir).Error("Failed to watch server config directory")
+		return
+	}
+
+	timers := make(map[string]*time.Timer)
+	timersMutex := &sync.Mutex{}
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !strings.HasSuffix(event.Name, ".json") {
+				continue
+			}
+			file := filepath.Clean(event.Name)
+			if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				// servers are kept in the database, they can be suspended or deleted through the API
+				log.WithField("file", file).Warn("Server config file removed, the server remains registered")
+				continue
+			}
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+			timersMutex.Lock()
+			if t, ok := timers[file]; ok {
+				t.Stop()
+			}
+			timers[file] = time.AfterFunc(500*time.Millisecond, func() {
+				timersMutex.Lock()
+				delete(timers, file)
+				timersMutex.Unlock()
+				reloadServerConfig(file)
+			})
+			timersMutex.Unlock()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.WithError(err).Error("Server config watcher error")
+		}
+	}
+}
+
+func reloadServerConfig(file string) {
+	conf, err := readServerConfig(file)
+	if err != nil {
+		log.WithError(err).WithField("File", file).Error("Error reading config file:")
+		return
+	}
+	if conf.Name == "" {
+		log.WithField("File", file).Error("Server config file has no name")
+		return
+	}
+	log.WithFields(log.Fields{"file": file, "server": conf.Name}).Info("Server config file changed")
+	for _, handler := range setServerConfig(file, conf) {
+		handler(conf)
+	}
+}
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"airqo-integrator/models"
+	"airqo-integrator/utils"
+	"airqo-integrator/utils/dbutils"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// ConflictController defines the request conflicts controller methods
+type ConflictController struct{}
+
+// Conflicts method handles the /conflicts GET request
+func (cc *ConflictController) Conflicts(c *gin.Context) {
+	page := c.DefaultQuery("page", "1")
+	pageSize := c.DefaultQuery("pageSize", "50")
+	paging := c.DefaultQuery("paging", "true")
+	orderbys := c.QueryArray("order") // property:desc|asc|iasc|idesc
+	filters := c.QueryArray("filter")
+	qfields := c.DefaultQuery("fields", "*")
+
+	filtered, _ := utils.GetFieldsAndRelationships(models.RequestConflictFields, qfields)
+
+	qbuild := &dbutils.QueryBuilder{}
+	qbuild.QueryTemplate = `SELECT %s
+FROM %s
+%s`
+	qbuild.Table = dbutils.Table{Name: "request_conflicts", Alias: "rc"}
+	var fields []dbutils.Field
+	for _, f := range filtered {
+		fields = append(fields, dbutils.Field{Name: f, TablePrefix: "rc", Alias: ""})
+	}
+	qbuild.Conditions = dbutils.QueryFiltersToConditions(filters, "rc")
+	qbuild.Fields = fields
+	qbuild.OrderBy = dbutils.OrderListToOrderBy(orderbys, models.RequestConflictFields, "rc")
+
+	whereClause := " TRUE"
+	if len(qbuild.Conditions) > 0 {
+		whereClause = dbutils.QueryConditions(qbuild.Conditions)
+	}
+	countquery := fmt.Sprintf("SELECT COUNT(*) AS count FROM request_conflicts rc WHERE %s", whereClause)
+
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	var count int64
+	if err := db.Get(&count, countquery); err != nil {
+		log.WithError(err).Error("Failed to count request conflicts")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	shouldWePage := paging != "false"
+	pager := dbutils.GetPaginator(count, pageSize, page, shouldWePage)
+	qbuild.Limit = pager.PageSize
+	qbuild.Offset = pager.FirstItem() - 1
+
+	jsonquery := fmt.Sprintf("SELECT ROW_TO_JSON(s) FROM (%s) s;", qbuild.ToSQL(shouldWePage))
+
+	var conflicts []dbutils.MapAnything
+	if err := db.Select(&conflicts, jsonquery); err != nil {
+		log.WithError(err).Error("Failed to query request conflicts")
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"pager":     pager,
+		"conflicts": conflicts,
+		"count":     count})
+}
+
+// RequestConflicts method handles the /queue/:id/conflicts GET request
+func (cc *ConflictController) RequestConflicts(c *gin.Context) {
+	uid := c.Param("id")
+	db := c.MustGet("dbConn").(*sqlx.DB)
+
+	var requestID models.RequestID
+	if err := db.Get(&requestID, "SELECT id FROM requests WHERE uid = $1", uid); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Request with uid '%s' not found", uid)})
+		return
+	}
+	conflicts, err := models.GetRequestConflicts(db, requestID)
+	if err != nil {
+		log.WithError(err).Error("Failed to get request conflicts")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"request":   uid,
+		"conflicts": conflicts})
+}
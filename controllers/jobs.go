@@ -0,0 +1,15 @@
+package controllers
+
+import (
+	"airqo-integrator/models"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// JobController defines the cron job controller methods
+type JobController struct{}
+
+// ListJobs handles the /jobs GET request. It shows each job with its schedule and its last and next runs
+func (j *JobController) ListJobs(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"jobs": models.Jobs.Status()})
+}
@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"airqo-integrator/models"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// MaintenanceController defines the maintenance mode controller methods
+type MaintenanceController struct{}
+
+// GetMaintenance handles the /maintenance GET request
+func (m *MaintenanceController) GetMaintenance(c *gin.Context) {
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	mode, err := models.GetMaintenanceMode(db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, mode)
+}
+
+// SetMaintenance handles the /maintenance POST request. While enabled every schedule
+// and the request producer are paused
+func (m *MaintenanceController) SetMaintenance(c *gin.Context) {
+	var body struct {
+		Enabled *bool  `json:"enabled" binding:"required"`
+		Reason  string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	mode, err := models.SetMaintenanceMode(db, *body.Enabled, body.Reason)
+	if err != nil {
+		log.WithError(err).Error("Failed to set maintenance mode")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, mode)
+}
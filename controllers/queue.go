@@ -4,11 +4,14 @@ import (
 	"airqo-integrator/models"
 	"airqo-integrator/utils"
 	"airqo-integrator/utils/dbutils"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"strconv"
 )
 
 // QueueController defines the queue request controller methods
@@ -26,6 +29,18 @@ func (q *QueueController) Queue(c *gin.Context) {
 	req, err := models.NewRequestFromPOST(c, db)
 	if err != nil {
 		log.WithError(err).Error("Failed to add request to queue")
+		if errors.Is(err, models.ErrSourceNotAllowed) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, models.ErrInvalidPriority) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if status, ok := dependencyErrorStatus(err); ok {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
 		c.String(http.StatusBadGateway, "Failed to add request to queue")
 		return
 	}
@@ -46,7 +61,7 @@ var requestFields = []string{
 	"uid", "source", "destination", "ctype", "body", "response", "status", "statuscode",
 	"retries", "errors", "frequency_type", "period", "day", "week", "month", "year",
 	"msisdn", "raw_msg", "facility", "district", "report_type", "extras", "suspended",
-	"body_is_query_param", "submissionid", "url_suffix", "created", "updated", "*"}
+	"body_is_query_param", "submissionid", "url_suffix", "object_type", "priority", "dependency_policy", "external_ref", "created", "updated", "*"}
 
 // Requests method handles the /queque GET request
 func (q *QueueController) Requests(c *gin.Context) {
@@ -179,3 +194,85 @@ func (q *QueueController) DeleteRequest(c *gin.Context) {
 		"status": "deleted"})
 	return
 }
+
+// dependencyErrorStatus maps errors about request dependencies to HTTP statuses
+func dependencyErrorStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, models.ErrDependencyCycle):
+		return http.StatusConflict, true
+	case errors.Is(err, models.ErrRequestNotFound):
+		return http.StatusNotFound, true
+	case errors.Is(err, models.ErrInvalidDependencyPolicy):
+		return http.StatusBadRequest, true
+	}
+	return 0, false
+}
+
+// AddDependencies method handles the /queue/:id/dependencies POST request
+func (q *QueueController) AddDependencies(c *gin.Context) {
+	var body struct {
+		DependsOn []string                `json:"dependsOn" binding:"required"` // request uids
+		Policy    models.DependencyPolicy `json:"dependencyPolicy"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	uid := c.Param("id")
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	if err := models.AddDependenciesToRequest(db, uid, body.DependsOn, body.Policy); err != nil {
+		log.WithError(err).WithField("uid", uid).Error("Failed to add request dependencies")
+		if status, ok := dependencyErrorStatus(err); ok {
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"uid":       uid,
+		"dependsOn": body.DependsOn})
+}
+
+// BatchDependencies method handles the /batches/:batch/dependencies GET request
+func (q *QueueController) BatchDependencies(c *gin.Context) {
+	batch := c.Param("batch")
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	tree, err := models.GetBatchDependencyTree(db, batch)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Batch '%s' not found", batch)})
+			return
+		}
+		log.WithError(err).WithField("batch", batch).Error("Failed to get batch dependencies")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tree)
+}
+
+// ArchivedRequests method handles the /archive/requests GET request. Requests are searched by
+// uid and/or batch and include the full archived request unless full=false
+func (q *QueueController) ArchivedRequests(c *gin.Context) {
+	uid := c.Query("uid")
+	batch := c.Query("batch")
+	if uid == "" && batch == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "uid or batch is required"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+		return
+	}
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	requests, err := models.SearchArchivedRequests(db, uid, batch, c.DefaultQuery("full", "true") != "false", limit)
+	if err != nil {
+		log.WithError(err).Error("Failed to search archived requests")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"requests": requests,
+		"count":    len(requests)})
+}
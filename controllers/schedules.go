@@ -2,8 +2,12 @@ package controllers
 
 import (
 	"airqo-integrator/models"
+	"airqo-integrator/utils/dbutils"
+	"database/sql"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
 	"net/http"
 	"strconv"
 	"time"
@@ -20,6 +24,10 @@ func (s *ScheduleController) NewSchedule(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error SCHED-001": err.Error()})
 		return
 	}
+	if err := schedule.Validate(); err != nil {
+		scheduleValidationError(c, err)
+		return
+	}
 	schedule.Created = time.Now().In(models.Location)
 	schedule.Updated = time.Now().In(models.Location)
 	id, err := models.CreateSchedule(db, schedule)
@@ -86,7 +94,14 @@ func (s *ScheduleController) UpdateSchedule(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := schedule.Validate(); err != nil {
+		scheduleValidationError(c, err)
+		return
+	}
 	schedule.ID = id
+	if schedule.NextRunAt.IsZero() {
+		schedule.NextRunAt = schedule.FirstRun(time.Now().In(models.Location))
+	}
 	err = models.UpdateSchedule(db, schedule)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -94,3 +109,98 @@ func (s *ScheduleController) UpdateSchedule(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, gin.H{"status": "updated"})
 }
+
+// scheduleValidationError responds to an invalid schedule, listing the fields of invalid params
+func scheduleValidationError(c *gin.Context, err error) {
+	var paramsErr *models.ParamsError
+	if errors.As(err, &paramsErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "fieldErrors": paramsErr.Fields})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+// ListTypes lists the schedule types that can be created and the JSON schemas of their params
+func (s *ScheduleController) ListTypes(c *gin.Context) {
+	types := make([]models.ScheduleType, 0)
+	for _, t := range models.ScheduleTypes() {
+		if !t.Internal {
+			types = append(types, t)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"types": types})
+}
+
+// ListCommands lists the internal tasks command schedules can run
+func (s *ScheduleController) ListCommands(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"commands": models.ScheduleTaskNames()})
+}
+
+// ScheduleRuns lists the runs of a schedule, latest first
+func (s *ScheduleController) ScheduleRuns(c *gin.Context) {
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	count, err := models.CountScheduleRuns(db, id)
+	if err != nil {
+		log.WithError(err).Error("Failed to count schedule runs")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	pager := dbutils.GetPaginator(count, c.DefaultQuery("pageSize", "50"), c.DefaultQuery("page", "1"), true)
+	runs, err := models.ListScheduleRuns(db, id, pager.PageSize, max(pager.Offset, 0)) // Offset is -1 without runs
+	if err != nil {
+		log.WithError(err).Error("Failed to list schedule runs")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"pager": pager,
+		"runs":  runs,
+		"count": count})
+}
+
+// scheduleControl runs one of the pause, resume and run-now controls on the schedule in the path
+func scheduleControl(c *gin.Context, control func(*sqlx.DB, int64) error) {
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	switch err := control(db, id); {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return
+	case errors.Is(err, models.ErrScheduleRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	schedule, err := models.GetSchedule(db, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, schedule)
+}
+
+// PauseSchedule stops a schedule from running until it is resumed
+func (s *ScheduleController) PauseSchedule(c *gin.Context) {
+	scheduleControl(c, models.PauseSchedule)
+}
+
+// ResumeSchedule lets a paused schedule run again
+func (s *ScheduleController) ResumeSchedule(c *gin.Context) {
+	scheduleControl(c, models.ResumeSchedule)
+}
+
+// RunScheduleNow runs a schedule as soon as possible without changing its recurrence
+func (s *ScheduleController) RunScheduleNow(c *gin.Context) {
+	scheduleControl(c, models.RunScheduleNow)
+}
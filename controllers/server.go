@@ -3,11 +3,13 @@ package controllers
 import (
 	"airqo-integrator/models"
 	"encoding/json"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net/http"
-	"strconv"
+	"strings"
 )
 
 type ServerController struct{}
@@ -23,8 +25,7 @@ func (s *ServerController) CreateServer(c *gin.Context) {
 		})
 		return
 	}
-	models.ServerMap[strconv.Itoa(int(srv.ID()))] = srv
-	models.ServerMapByName[srv.Name()] = srv
+	models.CacheServer(srv)
 
 	c.JSON(http.StatusOK, srv.Self())
 }
@@ -54,9 +55,135 @@ func (s *ServerController) ImportServers(c *gin.Context) {
 		})
 		return
 	}
+	_ = models.ReloadServers(db)
 	summary, _ := json.Marshal(importSummary)
 	c.JSON(http.StatusOK, gin.H{
 		"status":       "SUCCCESS",
 		"importSumary": summary,
 	})
 }
+
+// ListServers handles the GET /servers request. Secrets are redacted
+func (s *ServerController) ListServers(c *gin.Context) {
+	page := c.DefaultQuery("page", "1")
+	pageSize := c.DefaultQuery("pageSize", "50")
+	paging := c.DefaultQuery("paging", "true")
+	orderbys := c.QueryArray("order") // property:desc|asc|iasc|idesc
+	filters := c.QueryArray("filter")
+	qfields := c.DefaultQuery("fields", "*")
+
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	servers, pager, err := models.GetServers(db, page, pageSize, paging != "false", orderbys, qfields, filters)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"pager":   pager,
+		"servers": servers,
+		"count":   pager.Total})
+}
+
+// getServer returns the server in the id parameter, which may be the server id or uid
+func getServer(c *gin.Context) (models.Server, bool) {
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	srv, err := models.GetServerByIDOrUID(db, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return srv, false
+	}
+	return srv, true
+}
+
+// GetServer handles the GET /servers/:id request
+func (s *ServerController) GetServer(c *gin.Context) {
+	srv, ok := getServer(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, srv.Self())
+}
+
+// UpdateServer handles the PUT /servers/:id request. Only the fields in the body are changed
+func (s *ServerController) UpdateServer(c *gin.Context) {
+	srv, ok := getServer(c)
+	if !ok {
+		return
+	}
+	if !strings.HasPrefix(c.ContentType(), "application/json") {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported Content-Type: " + c.ContentType()})
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	srv, err = models.UpdateServer(db, srv, body)
+	if err != nil {
+		log.WithError(err).Error("Failed to update server")
+		c.JSON(http.StatusConflict, gin.H{
+			"message":  "Failed to update server",
+			"conflict": err.Error(),
+		})
+		return
+	}
+	models.CacheServer(srv)
+	c.JSON(http.StatusOK, srv.Self())
+}
+
+func (s *ServerController) setSuspended(c *gin.Context, suspended bool) {
+	srv, ok := getServer(c)
+	if !ok {
+		return
+	}
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	srv, err := models.SetServerSuspended(db, srv.ID(), suspended)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	models.CacheServer(srv)
+	log.WithFields(log.Fields{"server": srv.Name(), "suspended": suspended}).Info("Server suspension changed")
+	c.JSON(http.StatusOK, srv.Self())
+}
+
+// SuspendServer handles the POST /servers/:id/suspend request
+func (s *ServerController) SuspendServer(c *gin.Context) { s.setSuspended(c, true) }
+
+// ResumeServer handles the POST /servers/:id/resume request
+func (s *ServerController) ResumeServer(c *gin.Context) { s.setSuspended(c, false) }
+
+// DeleteServer handles the DELETE /servers/:id request
+func (s *ServerController) DeleteServer(c *gin.Context) {
+	srv, ok := getServer(c)
+	if !ok {
+		return
+	}
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	if err := models.DeleteServer(db, srv.ID()); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, models.ErrServerInUse) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	models.UncacheServer(srv.ID())
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// TestConnection handles the POST /servers/:id/test request
+func (s *ServerController) TestConnection(c *gin.Context) {
+	srv, ok := getServer(c)
+	if !ok {
+		return
+	}
+	result := srv.TestConnection(c.Request.Context())
+	status := http.StatusOK
+	if !result.OK {
+		status = http.StatusBadGateway
+	}
+	c.JSON(status, result)
+}
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"airqo-integrator/models"
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+// SMSController defines the SMS subscriber controller methods
+type SMSController struct{}
+
+// ListSubscribers handles the /sms/subscribers GET request. The orgUnit query param limits them to one list
+func (s *SMSController) ListSubscribers(c *gin.Context) {
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	orgUnitID, _ := strconv.ParseInt(c.DefaultQuery("orgUnit", "0"), 10, 64)
+	subscribers, err := models.ListSMSSubscribers(db, orgUnitID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscribers": subscribers, "count": len(subscribers)})
+}
+
+// SaveSubscriber handles the /sms/subscribers POST request. It adds a number to the list of a
+// district or sub-county, or updates it when already there
+func (s *SMSController) SaveSubscriber(c *gin.Context) {
+	var body struct {
+		OrgUnitID int64  `json:"orgUnitID" binding:"required"`
+		MSISDN    string `json:"msisdn" binding:"required"`
+		Name      string `json:"name"`
+		IsActive  *bool  `json:"isActive"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := models.GetOrganisationUnitByID(body.OrgUnitID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Organisation unit not found"})
+		return
+	}
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	subscriber := models.SMSSubscriber{OrgUnitID: body.OrgUnitID, MSISDN: body.MSISDN, Name: body.Name,
+		IsActive: body.IsActive == nil || *body.IsActive}
+	if err := models.SaveSMSSubscriber(db, &subscriber); err != nil {
+		log.WithError(err).Error("Failed to save SMS subscriber")
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, subscriber)
+}
+
+// DeleteSubscriber handles the /sms/subscribers/:id DELETE request
+func (s *SMSController) DeleteSubscriber(c *gin.Context) {
+	db := c.MustGet("dbConn").(*sqlx.DB)
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+	switch err := models.DeleteSMSSubscriber(db, id); {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscriber not found"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
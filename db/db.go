@@ -10,7 +10,8 @@ import (
 
 var db *sqlx.DB
 
-func init() {
+// Init connects to the configured database
+func Init() {
 	psqlInfo := config.AirQoIntegratorConf.Database.URI
 	//
 	var err error
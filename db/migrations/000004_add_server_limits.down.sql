@@ -0,0 +1,2 @@
+ALTER TABLE servers DROP COLUMN IF EXISTS requests_per_second;
+ALTER TABLE servers DROP COLUMN IF EXISTS max_concurrent;
@@ -0,0 +1,2 @@
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS max_concurrent INTEGER NOT NULL DEFAULT 0; -- max in-flight requests, 0 = unlimited
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS requests_per_second DOUBLE PRECISION NOT NULL DEFAULT 0; -- 0 = unlimited
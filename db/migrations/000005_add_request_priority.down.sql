@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS requests_object_type;
+DROP INDEX IF EXISTS requests_priority;
+ALTER TABLE requests DROP COLUMN IF EXISTS priority;
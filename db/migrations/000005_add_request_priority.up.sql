@@ -0,0 +1,4 @@
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 0; -- higher values are sent first within a lane
+
+CREATE INDEX IF NOT EXISTS requests_priority ON requests (priority);
+CREATE INDEX IF NOT EXISTS requests_object_type ON requests (object_type);
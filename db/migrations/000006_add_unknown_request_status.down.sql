@@ -0,0 +1,6 @@
+UPDATE requests SET status = 'failed' WHERE status = 'unknown';
+ALTER TABLE requests DROP CONSTRAINT IF EXISTS requests_status_check;
+ALTER TABLE requests ADD CONSTRAINT requests_status_check CHECK ( status IN
+                                                                  ('pending', 'ready', 'inprogress',
+                                                                   'failed', 'error', 'expired',
+                                                                   'completed', 'canceled'));
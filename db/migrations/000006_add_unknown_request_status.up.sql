@@ -0,0 +1,6 @@
+-- 'unknown' marks requests whose send was interrupted (e.g. on shutdown) and must be reconciled
+ALTER TABLE requests DROP CONSTRAINT IF EXISTS requests_status_check;
+ALTER TABLE requests ADD CONSTRAINT requests_status_check CHECK ( status IN
+                                                                  ('pending', 'ready', 'inprogress',
+                                                                   'failed', 'error', 'expired',
+                                                                   'completed', 'canceled', 'unknown'));
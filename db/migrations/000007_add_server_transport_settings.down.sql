@@ -0,0 +1,5 @@
+ALTER TABLE servers DROP COLUMN IF EXISTS request_timeout;
+ALTER TABLE servers DROP COLUMN IF EXISTS read_timeout;
+ALTER TABLE servers DROP COLUMN IF EXISTS connect_timeout;
+ALTER TABLE servers DROP COLUMN IF EXISTS skip_tls_verify;
+ALTER TABLE servers DROP COLUMN IF EXISTS ssl_trusted_cafile;
@@ -0,0 +1,5 @@
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS ssl_trusted_cafile TEXT NOT NULL DEFAULT ''; -- CA bundle used to verify the server certificate
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS skip_tls_verify BOOLEAN NOT NULL DEFAULT FALSE; -- explicit opt-out of certificate verification
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS connect_timeout INTEGER NOT NULL DEFAULT 0; -- seconds, 0 = use global default
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS read_timeout INTEGER NOT NULL DEFAULT 0; -- seconds to wait for response headers, 0 = use global default
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS request_timeout INTEGER NOT NULL DEFAULT 0; -- overall seconds per request, 0 = use global default
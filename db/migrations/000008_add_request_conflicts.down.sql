@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS request_conflicts;
+
+UPDATE requests SET status = 'completed' WHERE status = 'partial';
+ALTER TABLE requests DROP CONSTRAINT IF EXISTS requests_status_check;
+ALTER TABLE requests ADD CONSTRAINT requests_status_check CHECK ( status IN
+                                                                  ('pending', 'ready', 'inprogress',
+                                                                   'failed', 'error', 'expired',
+                                                                   'completed', 'canceled', 'unknown'));
@@ -0,0 +1,25 @@
+ALTER TABLE requests DROP CONSTRAINT IF EXISTS requests_status_check;
+ALTER TABLE requests ADD CONSTRAINT requests_status_check CHECK ( status IN
+                                                                  ('pending', 'ready', 'inprogress',
+                                                                   'failed', 'error', 'expired',
+                                                                   'completed', 'canceled', 'unknown',
+                                                                   'partial'));
+
+-- conflicts reported by DHIS2 in the import summary of a request
+CREATE TABLE IF NOT EXISTS request_conflicts (
+    id BIGSERIAL PRIMARY KEY,
+    request_id BIGINT NOT NULL REFERENCES requests(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    server_id BIGINT REFERENCES servers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    data_element TEXT NOT NULL DEFAULT '',
+    org_unit TEXT NOT NULL DEFAULT '',
+    period TEXT NOT NULL DEFAULT '',
+    category_option_combo TEXT NOT NULL DEFAULT '',
+    object TEXT NOT NULL DEFAULT '',
+    property TEXT NOT NULL DEFAULT '',
+    message TEXT NOT NULL DEFAULT '',
+    error_code TEXT NOT NULL DEFAULT '',
+    created TIMESTAMPTZ NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS request_conflicts_request ON request_conflicts(request_id);
+CREATE INDEX IF NOT EXISTS request_conflicts_error_code ON request_conflicts(error_code);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS requests_external_ref;
+ALTER TABLE requests DROP COLUMN IF EXISTS external_ref;
+ALTER TABLE servers DROP COLUMN IF EXISTS response_rules;
@@ -0,0 +1,5 @@
+-- rules deciding success, failure or retry from the value at json_response_xpath/xml_response_xpath
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS response_rules JSONB NOT NULL DEFAULT '{}'::jsonb;
+-- reference (e.g. resource id) returned by the destination server
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS external_ref TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS requests_external_ref ON requests(external_ref);
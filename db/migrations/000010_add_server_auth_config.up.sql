@@ -0,0 +1,2 @@
+-- settings for the OAuth2, Bearer, Header and HMAC auth methods
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS auth_config JSONB NOT NULL DEFAULT '{}'::jsonb;
@@ -0,0 +1,2 @@
+-- URL called by the test connection endpoint. DHIS2 servers default to /api/system/info when empty
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS health_url TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,28 @@
+CREATE OR REPLACE FUNCTION is_allowed_source(source integer, dest integer) RETURNS BOOLEAN AS
+$delim$
+DECLARE
+    t boolean;
+BEGIN
+    select source = ANY (allowed_sources) INTO t FROM server_allowed_sources WHERE server_id = dest;
+    RETURN t;
+END;
+$delim$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION in_submission_period(server_id integer) RETURNS BOOLEAN AS
+$delim$
+DECLARE
+    t boolean;
+BEGIN
+    SELECT to_char(current_timestamp, 'HH24')::int >= start_submission_period
+               AND
+           to_char(current_timestamp, 'HH24')::int <= end_submission_period
+    INTO t
+    FROM servers
+    WHERE id = server_id;
+    RETURN t;
+END;
+$delim$ LANGUAGE plpgsql;
+
+ALTER TABLE servers DROP COLUMN IF EXISTS blackout_dates;
+ALTER TABLE servers DROP COLUMN IF EXISTS submission_windows;
+ALTER TABLE servers DROP COLUMN IF EXISTS timezone;
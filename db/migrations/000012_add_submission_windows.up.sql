@@ -0,0 +1,81 @@
+-- submission windows in the server's time zone, e.g. [{"days": [1, 2, 3, 4, 5], "start": "18:00", "end": "23:59"}]
+-- days are ISO days of the week (1 = Monday). Without windows the start/end submission period hours apply
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT '';
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS submission_windows JSONB NOT NULL DEFAULT '[]'::jsonb;
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS blackout_dates DATE[] NOT NULL DEFAULT ARRAY []::DATE[];
+
+CREATE OR REPLACE FUNCTION in_submission_period(server_id integer) RETURNS BOOLEAN AS
+$delim$
+DECLARE
+    srv        RECORD;
+    local_now  TIMESTAMP;
+    local_day  INTEGER;
+    prev_day   INTEGER;
+    local_time TIME;
+    w          JSONB;
+    w_days     JSONB;
+    w_start    TIME;
+    w_end      TIME;
+BEGIN
+    SELECT timezone, submission_windows, blackout_dates, start_submission_period, end_submission_period
+    INTO srv
+    FROM servers
+    WHERE id = server_id;
+    IF NOT FOUND THEN
+        RETURN FALSE;
+    END IF;
+
+    IF srv.timezone <> '' THEN
+        local_now := current_timestamp AT TIME ZONE srv.timezone;
+    ELSE
+        local_now := localtimestamp;
+    END IF;
+    IF local_now::date = ANY (srv.blackout_dates) THEN
+        RETURN FALSE;
+    END IF;
+
+    IF jsonb_array_length(srv.submission_windows) = 0 THEN
+        RETURN extract(HOUR FROM local_now)::int >= srv.start_submission_period
+            AND extract(HOUR FROM local_now)::int <= srv.end_submission_period;
+    END IF;
+
+    local_day := extract(ISODOW FROM local_now)::int;
+    prev_day := CASE WHEN local_day = 1 THEN 7 ELSE local_day - 1 END;
+    local_time := local_now::time;
+    FOR w IN SELECT * FROM jsonb_array_elements(srv.submission_windows)
+        LOOP
+            w_days := COALESCE(w -> 'days', '[]'::jsonb);
+            w_start := COALESCE(NULLIF(w ->> 'start', ''), '00:00')::time;
+            w_end := COALESCE(NULLIF(w ->> 'end', ''), '23:59:59')::time;
+            IF w_start <= w_end THEN
+                IF (jsonb_array_length(w_days) = 0 OR w_days @> to_jsonb(local_day))
+                    AND local_time >= w_start AND local_time <= w_end THEN
+                    RETURN TRUE;
+                END IF;
+            ELSE
+                -- windows past midnight, e.g. 22:00 to 04:00, belong to the day they start on
+                IF (jsonb_array_length(w_days) = 0 OR w_days @> to_jsonb(local_day)) AND local_time >= w_start THEN
+                    RETURN TRUE;
+                END IF;
+                IF (jsonb_array_length(w_days) = 0 OR w_days @> to_jsonb(prev_day)) AND local_time <= w_end THEN
+                    RETURN TRUE;
+                END IF;
+            END IF;
+        END LOOP;
+    RETURN FALSE;
+END;
+$delim$ LANGUAGE plpgsql;
+
+-- destinations without allowed sources accept requests from any source
+CREATE OR REPLACE FUNCTION is_allowed_source(source integer, dest integer) RETURNS BOOLEAN AS
+$delim$
+DECLARE
+    t boolean;
+BEGIN
+    SELECT cardinality(allowed_sources) = 0 OR source = ANY (allowed_sources)
+    INTO t
+    FROM server_allowed_sources
+    WHERE server_id = dest;
+    RETURN COALESCE(t, TRUE);
+END;
+$delim$ LANGUAGE plpgsql;
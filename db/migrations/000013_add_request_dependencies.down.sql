@@ -0,0 +1,22 @@
+DROP TRIGGER IF EXISTS cancel_dependent_requests_trigger ON requests;
+DROP FUNCTION IF EXISTS cancel_dependent_requests_trigger_function();
+DROP TRIGGER IF EXISTS add_request_dependency_trigger ON requests;
+DROP FUNCTION IF EXISTS add_request_dependency_trigger_function();
+
+CREATE OR REPLACE FUNCTION status_of_dependence(reqId BIGINT) RETURNS TEXT AS
+$delim$
+DECLARE
+    dep_status TEXT := '';
+    dependence BIGINT;
+BEGIN
+    SELECT depends_on INTO dependence FROM requests WHERE id = reqId;
+    IF dependence IS NOT NULL THEN
+        SELECT status INTO dep_status FROM requests WHERE id = dependence;
+        RETURN dep_status;
+    END IF;
+    RETURN dep_status;
+END;
+$delim$ LANGUAGE 'plpgsql';
+
+ALTER TABLE requests DROP COLUMN IF EXISTS dependency_policy;
+DROP TABLE IF EXISTS request_dependencies;
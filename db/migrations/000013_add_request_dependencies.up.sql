@@ -0,0 +1,101 @@
+-- a request may depend on several requests. requests.depends_on keeps the first one
+CREATE TABLE IF NOT EXISTS request_dependencies
+(
+    request_id BIGINT NOT NULL REFERENCES requests (id) ON DELETE CASCADE,
+    depends_on BIGINT NOT NULL REFERENCES requests (id) ON DELETE CASCADE,
+    created    TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (request_id, depends_on),
+    CHECK (request_id <> depends_on)
+);
+CREATE INDEX IF NOT EXISTS request_dependencies_depends_on ON request_dependencies (depends_on);
+
+INSERT INTO request_dependencies (request_id, depends_on)
+SELECT id, depends_on FROM requests WHERE depends_on IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+-- keep requests queued with a single depends_on in the graph
+CREATE OR REPLACE FUNCTION add_request_dependency_trigger_function()
+    RETURNS TRIGGER AS
+$$
+BEGIN
+    INSERT INTO request_dependencies (request_id, depends_on)
+    VALUES (NEW.id, NEW.depends_on)
+    ON CONFLICT DO NOTHING;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER add_request_dependency_trigger
+    AFTER INSERT
+    ON requests
+    FOR EACH ROW
+    WHEN (NEW.depends_on IS NOT NULL)
+EXECUTE PROCEDURE add_request_dependency_trigger_function();
+
+-- what happens to a request when a request it depends on fails for good (error, expired or canceled):
+-- cancel it, keep waiting in case the dependency is fixed and re-queued, or send it anyway
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS dependency_policy TEXT NOT NULL DEFAULT 'wait'
+    CHECK (dependency_policy IN ('cancel', 'wait', 'proceed'));
+
+-- status_of_dependence returns '' without dependencies, 'completed' once all dependencies completed,
+-- 'failed' or 'canceled' when a dependency failed for good depending on the policy, otherwise 'ready'
+CREATE OR REPLACE FUNCTION status_of_dependence(reqId BIGINT) RETURNS TEXT AS
+$delim$
+DECLARE
+    policy     TEXT;
+    total      INTEGER;
+    done       INTEGER;
+    failed     INTEGER;
+BEGIN
+    SELECT count(*),
+           count(*) FILTER (WHERE r.status IN ('completed', 'partial')),
+           count(*) FILTER (WHERE r.status IN ('error', 'expired', 'canceled'))
+    INTO total, done, failed
+    FROM request_dependencies d
+             JOIN requests r ON r.id = d.depends_on
+    WHERE d.request_id = reqId;
+    IF total = 0 THEN
+        RETURN '';
+    END IF;
+    IF done = total THEN
+        RETURN 'completed';
+    END IF;
+    IF failed > 0 THEN
+        SELECT dependency_policy INTO policy FROM requests WHERE id = reqId;
+        IF policy = 'proceed' AND done + failed = total THEN
+            RETURN 'completed';
+        ELSIF policy = 'cancel' THEN
+            RETURN 'canceled';
+        END IF;
+        RETURN 'failed';
+    END IF;
+    RETURN 'ready';
+END;
+$delim$ LANGUAGE 'plpgsql';
+
+-- cancel the ready requests depending on a request that failed for good when their policy is cancel.
+-- Canceling a request fires the trigger again so the whole branch is canceled
+CREATE OR REPLACE FUNCTION cancel_dependent_requests_trigger_function()
+    RETURNS TRIGGER AS
+$$
+BEGIN
+    UPDATE requests r
+    SET status     = 'canceled',
+        statuscode = 'ERROR05',
+        errors     = format('Dependency %s %s', NEW.uid, NEW.status),
+        updated    = current_timestamp
+    FROM request_dependencies d
+    WHERE d.depends_on = NEW.id
+      AND r.id = d.request_id
+      AND r.status = 'ready'
+      AND r.dependency_policy = 'cancel';
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER cancel_dependent_requests_trigger
+    AFTER UPDATE OF status
+    ON requests
+    FOR EACH ROW
+    WHEN (NEW.status IN ('error', 'expired', 'canceled') AND OLD.status IS DISTINCT FROM NEW.status)
+EXECUTE PROCEDURE cancel_dependent_requests_trigger_function();
@@ -0,0 +1,2 @@
+-- rules rewriting request bodies per destination: UID remapping, JSON Patch or Go templates
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS body_transforms JSONB NOT NULL DEFAULT '[]'::JSONB;
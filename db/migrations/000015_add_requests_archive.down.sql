@@ -0,0 +1,9 @@
+ALTER TABLE schedules DROP CONSTRAINT IF EXISTS schedules_request_id_fkey;
+ALTER TABLE schedules ADD CONSTRAINT schedules_request_id_fkey
+    FOREIGN KEY (request_id) REFERENCES requests (id);
+ALTER TABLE requests DROP CONSTRAINT IF EXISTS requests_depends_on_fkey;
+ALTER TABLE requests ADD CONSTRAINT requests_depends_on_fkey
+    FOREIGN KEY (depends_on) REFERENCES requests (id);
+
+DROP INDEX IF EXISTS requests_status_updated;
+DROP TABLE IF EXISTS requests_archive;
@@ -0,0 +1,31 @@
+-- requests past their retention period are moved here. The request is kept gzip compressed in payload,
+-- or in a gzip JSONL file on disk when archive_file is set, while uid and batch stay searchable
+CREATE TABLE IF NOT EXISTS requests_archive
+(
+    id           BIGINT PRIMARY KEY NOT NULL, -- id the request had in requests
+    uid          VARCHAR(11)        NOT NULL,
+    batchid      TEXT               NOT NULL DEFAULT '',
+    source       INTEGER,
+    destination  INTEGER,
+    status       VARCHAR(32)        NOT NULL DEFAULT '',
+    object_type  TEXT               NOT NULL DEFAULT '',
+    district     TEXT               NOT NULL DEFAULT '',
+    archive_file TEXT               NOT NULL DEFAULT '',
+    payload      BYTEA,
+    created      TIMESTAMPTZ,
+    updated      TIMESTAMPTZ,
+    archived     TIMESTAMPTZ                 DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS requests_archive_uid ON requests_archive (uid);
+CREATE INDEX IF NOT EXISTS requests_archive_batchid ON requests_archive (batchid);
+CREATE INDEX IF NOT EXISTS requests_archive_archived ON requests_archive (archived);
+
+CREATE INDEX IF NOT EXISTS requests_status_updated ON requests (status, updated);
+
+-- archiving a request must not be blocked by finished requests or schedules referring to it
+ALTER TABLE requests DROP CONSTRAINT IF EXISTS requests_depends_on_fkey;
+ALTER TABLE requests ADD CONSTRAINT requests_depends_on_fkey
+    FOREIGN KEY (depends_on) REFERENCES requests (id) ON DELETE SET NULL;
+ALTER TABLE schedules DROP CONSTRAINT IF EXISTS schedules_request_id_fkey;
+ALTER TABLE schedules ADD CONSTRAINT schedules_request_id_fkey
+    FOREIGN KEY (request_id) REFERENCES requests (id) ON DELETE SET NULL;
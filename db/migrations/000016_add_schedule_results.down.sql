@@ -0,0 +1,3 @@
+ALTER TABLE schedules DROP COLUMN IF EXISTS last_message;
+ALTER TABLE schedules DROP COLUMN IF EXISTS last_response;
+ALTER TABLE schedules DROP COLUMN IF EXISTS last_status_code;
@@ -0,0 +1,4 @@
+-- outcome of the latest run, e.g. the status code and an excerpt of the response of url schedules
+ALTER TABLE schedules ADD COLUMN IF NOT EXISTS last_status_code INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE schedules ADD COLUMN IF NOT EXISTS last_response TEXT NOT NULL DEFAULT '';
+ALTER TABLE schedules ADD COLUMN IF NOT EXISTS last_message TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- what happens to the runs a schedule missed: skip them or catch up with a run for each
+ALTER TABLE schedules ADD COLUMN IF NOT EXISTS misfire_policy TEXT NOT NULL DEFAULT 'skip'
+    CHECK (misfire_policy IN ('skip', 'catch_up'));
@@ -0,0 +1,14 @@
+-- one row per run of a schedule so its history is kept beyond the latest status
+CREATE TABLE IF NOT EXISTS schedule_runs
+(
+    id          bigserial   NOT NULL PRIMARY KEY,
+    schedule_id BIGINT      NOT NULL REFERENCES schedules (id) ON DELETE CASCADE,
+    started     TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished    TIMESTAMPTZ,
+    outcome     TEXT        NOT NULL DEFAULT 'running' CHECK (
+        outcome IN ('running', 'completed', 'failed', 'error', 'pending', 'expired', 'skipped')),
+    message     TEXT        NOT NULL DEFAULT '',
+    request_ids BIGINT[]    NOT NULL DEFAULT '{}' -- requests created or updated by the run
+);
+
+CREATE INDEX IF NOT EXISTS schedule_runs_schedule_started ON schedule_runs (schedule_id, started DESC);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS schedules_running;
+DROP INDEX IF EXISTS schedules_due;
+UPDATE schedules SET status = 'ready' WHERE status = 'running';
+ALTER TABLE schedules DROP COLUMN IF EXISTS claimed_at;
+ALTER TABLE schedules DROP CONSTRAINT IF EXISTS schedules_status_check;
+ALTER TABLE schedules ADD CONSTRAINT schedules_status_check CHECK (
+    status IN ('ready', 'skipped', 'expired', 'canceled', 'sent', 'failed', 'error', 'completed'));
@@ -0,0 +1,10 @@
+-- schedules are claimed by setting them running so that a schedule is dispatched once
+-- even with several integrators sharing the database
+ALTER TABLE schedules DROP CONSTRAINT IF EXISTS schedules_status_check;
+ALTER TABLE schedules ADD CONSTRAINT schedules_status_check CHECK (
+    status IN ('ready', 'running', 'skipped', 'expired', 'canceled', 'sent', 'failed', 'error', 'completed'));
+-- when the schedule was last claimed. Schedules running for too long are made ready again
+ALTER TABLE schedules ADD COLUMN IF NOT EXISTS claimed_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS schedules_due ON schedules (next_run_at) WHERE status = 'ready' AND is_active;
+CREATE INDEX IF NOT EXISTS schedules_running ON schedules (claimed_at) WHERE status = 'running';
@@ -0,0 +1 @@
+ALTER TABLE servers DROP COLUMN IF EXISTS async_job_max_age;
@@ -0,0 +1,2 @@
+-- seconds async jobs on the server are polled before the outcome of their request is reconciled. 0 uses the global default
+ALTER TABLE servers ADD COLUMN IF NOT EXISTS async_job_max_age INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS maintenance_mode;
+DROP INDEX IF EXISTS schedules_due;
+CREATE INDEX IF NOT EXISTS schedules_due ON schedules (next_run_at) WHERE status = 'ready' AND is_active;
+ALTER TABLE schedules DROP COLUMN IF EXISTS run_requested_at;
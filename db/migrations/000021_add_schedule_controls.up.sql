@@ -0,0 +1,16 @@
+-- set by run-now. The schedule is claimed as soon as possible while its next_run_at is kept
+ALTER TABLE schedules ADD COLUMN IF NOT EXISTS run_requested_at TIMESTAMPTZ;
+
+DROP INDEX IF EXISTS schedules_due;
+CREATE INDEX IF NOT EXISTS schedules_due ON schedules (next_run_at) WHERE status = 'ready';
+
+-- a single row. While enabled no schedules are run and no requests are sent, e.g. during DHIS2 upgrades
+CREATE TABLE IF NOT EXISTS maintenance_mode
+(
+    id         BOOLEAN     NOT NULL PRIMARY KEY DEFAULT TRUE CHECK (id),
+    enabled    BOOLEAN     NOT NULL DEFAULT FALSE,
+    reason     TEXT        NOT NULL DEFAULT '',
+    updated    TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO maintenance_mode (id) VALUES (TRUE) ON CONFLICT DO NOTHING;
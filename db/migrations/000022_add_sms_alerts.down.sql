@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS sms_alerts;
+DROP TABLE IF EXISTS sms_subscribers;
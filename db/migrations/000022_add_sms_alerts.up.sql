@@ -0,0 +1,30 @@
+-- subscriber lists are kept per org unit, a district or a sub-county. A sub-county's alerts go to its
+-- subscribers and those of its ancestors
+CREATE TABLE IF NOT EXISTS sms_subscribers
+(
+    id         BIGSERIAL   NOT NULL PRIMARY KEY,
+    orgunit_id BIGINT      NOT NULL REFERENCES organisationunit (id) ON DELETE CASCADE,
+    msisdn     TEXT        NOT NULL,
+    name       TEXT        NOT NULL DEFAULT '',
+    is_active  BOOLEAN     NOT NULL DEFAULT TRUE,
+    created    TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated    TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (orgunit_id, msisdn)
+);
+CREATE INDEX IF NOT EXISTS sms_subscribers_msisdn ON sms_subscribers (msisdn);
+
+-- one alert per sub-county, day and category so reruns do not send it again
+CREATE TABLE IF NOT EXISTS sms_alerts
+(
+    id          BIGSERIAL        NOT NULL PRIMARY KEY,
+    schedule_id BIGINT REFERENCES schedules (id) ON DELETE SET NULL,
+    orgunit_id  BIGINT           NOT NULL REFERENCES organisationunit (id) ON DELETE CASCADE,
+    period      DATE             NOT NULL,
+    category    TEXT             NOT NULL,
+    pm25        DOUBLE PRECISION NOT NULL,
+    message     TEXT             NOT NULL,
+    recipients  INTEGER          NOT NULL DEFAULT 0,
+    failed      INTEGER          NOT NULL DEFAULT 0,
+    created     TIMESTAMPTZ      NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (orgunit_id, period, category)
+);
@@ -0,0 +1,25 @@
+-- a CC server is retried when its recorded outcome is failed. The HTTP status code only decides for
+-- entries without an outcome, so response rules can retry a 200 and give up on a 4xx
+CREATE OR REPLACE FUNCTION failed_cc_servers(servers integer[], servers_status jsonb) RETURNS integer[] AS
+$delim$
+DECLARE
+    i              integer;
+    failed_servers integer[] := '{}'::int[];
+    status_code    text;
+    status         text;
+BEGIN
+    IF array_length(servers, 1) IS NOT NULL THEN
+        FOR i IN array_lower(servers, 1) .. array_upper(servers, 1)
+            LOOP
+                status_code := servers_status -> ((servers)[i])::text ->> 'statusCode';
+                status := servers_status -> ((servers)[i])::text ->> 'status';
+                IF status IN ('failed', '') OR (status IS NULL AND (status_code LIKE '4%' OR status_code LIKE '5%')) THEN
+                    failed_servers := array_append(failed_servers, servers[i]);
+                END IF;
+
+            END LOOP;
+    END IF;
+
+    RETURN failed_servers;
+END;
+$delim$ LANGUAGE plpgsql;
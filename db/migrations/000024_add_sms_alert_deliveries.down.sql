@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS sms_alerts_failed;
+DROP TABLE IF EXISTS sms_alert_deliveries;
@@ -0,0 +1,10 @@
+-- the numbers an alert was delivered to. Numbers left out when the provider fails are sent the alert
+-- again on later runs, for the same period, while the alert is pending
+CREATE TABLE IF NOT EXISTS sms_alert_deliveries
+(
+    alert_id BIGINT      NOT NULL REFERENCES sms_alerts (id) ON DELETE CASCADE,
+    msisdn   TEXT        NOT NULL,
+    created  TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (alert_id, msisdn)
+);
+CREATE INDEX IF NOT EXISTS sms_alerts_failed ON sms_alerts (created) WHERE failed > 0;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS blacklist_normalized_msisdn;
+DROP FUNCTION IF EXISTS normalize_msisdn(text);
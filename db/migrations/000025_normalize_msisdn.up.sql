@@ -0,0 +1,7 @@
+-- normalize_msisdn matches models.NormalizeMSISDN so blacklisted numbers match subscribers however they were entered
+CREATE OR REPLACE FUNCTION normalize_msisdn(msisdn text) RETURNS text AS
+$delim$
+SELECT regexp_replace(regexp_replace(msisdn, '[[:space:]()-]', '', 'g'), '^\+', '');
+$delim$ LANGUAGE sql IMMUTABLE;
+
+CREATE INDEX IF NOT EXISTS blacklist_normalized_msisdn ON blacklist (normalize_msisdn(msisdn));
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"airqo-integrator/config"
+	"airqo-integrator/models"
+	"context"
+	"time"
+)
+
+// jobDefinitions returns the integrator's cron jobs as currently configured
+func jobDefinitions(sendCtx context.Context) []models.JobDefinition {
+	return []models.JobDefinition{
+		{
+			Name:    "sync_measurements",
+			Spec:    config.AirQoIntegratorConf.API.AIRQOSyncCronExpression,
+			Enabled: !*config.SkipSync,
+			Run: func(ctx context.Context) {
+				_, _ = SendAirQoClimateData2(ctx, time.Now().Add(-24*time.Hour), time.Now())
+			},
+		},
+		{
+			Name:    "retry_incomplete_requests",
+			Spec:    config.AirQoIntegratorConf.API.AIRQORetryCronExpression,
+			Enabled: !*config.SkipRequestProcessing,
+			Run: func(ctx context.Context) {
+				RetryIncompleteRequests(ctx, sendCtx)
+			},
+		},
+	}
+}
@@ -6,24 +6,26 @@ import (
 	"airqo-integrator/models"
 	"encoding/json"
 	log "github.com/sirupsen/logrus"
-	"strconv"
 )
 
 // LoadServersFromConfigFiles saves the servers read from /etc/airqointegrator/conf.d
 func LoadServersFromConfigFiles(serverConfMap map[string]config.ServerConf) {
 	for k := range serverConfMap {
-		// log.WithField("SERVER", serverConfMap[k]).Info("SERVER_CONFIG >>>")
-		serverJSON, err := json.Marshal(serverConfMap[k])
-		if err != nil {
-			log.WithError(err).Error("Failed to marshal server configuration to []byte:")
-			continue
-		}
-		dbConn := db.GetDB()
-		srv, err := models.CreateServerFromJSON(dbConn, serverJSON)
-		if err != nil {
-			log.WithError(err).Error("Failed to create/update server")
-		}
-		models.ServerMap[strconv.Itoa(int(srv.ID()))] = srv
-		models.ServerMapByName[srv.Name()] = srv
+		upsertServerConfig(serverConfMap[k])
 	}
 }
+
+// upsertServerConfig creates or updates the server in a conf.d file and swaps it into the server registry
+func upsertServerConfig(conf config.ServerConf) {
+	serverJSON, err := json.Marshal(conf)
+	if err != nil {
+		log.WithError(err).Error("Failed to marshal server configuration to []byte:")
+		return
+	}
+	srv, err := models.CreateServerFromJSON(db.GetDB(), serverJSON)
+	if err != nil {
+		log.WithError(err).WithField("server", conf.Name).Error("Failed to create/update server")
+		return
+	}
+	models.CacheServer(srv)
+}
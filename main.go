@@ -1,17 +1,24 @@
 package main
 
 import (
+	"airqo-integrator/clients"
 	"airqo-integrator/config"
 	"airqo-integrator/controllers"
+	"airqo-integrator/db"
 	"airqo-integrator/models"
+	"airqo-integrator/utils"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
-	"github.com/robfig/cron/v3"
 	"github.com/samply/golang-fhir-models/fhir-models/fhir"
 	log "github.com/sirupsen/logrus"
+	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -35,18 +42,47 @@ var splash = `
 ╹ ╹╹╹┗╸┗┻┛┗━┛    ╹ ┗━┛   ╺┻┛╹ ╹╹┗━┛┗━╸
 `
 
-func testing(msg string) {
-	log.Infof("Hi %s, You're testing schedules task at %v", msg, time.Now().Format("15:04:05"))
-}
-
 func main() {
 	fmt.Printf(splash)
+	config.Init()
+	db.Init()
+	clients.Init()
+	models.Init()
+	// ctx is cancelled on SIGINT/SIGTERM. Producers then stop claiming new work
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// sendCtx is only cancelled when in-flight sends do not drain within the shutdown timeout
+	sendCtx, abortSends := context.WithCancel(context.Background())
+	defer abortSends()
+
+	if *config.EncryptSecret != "" {
+		if !utils.EncryptionEnabled() {
+			log.Fatalln("No master key configured")
+		}
+		encrypted, err := utils.EncryptSecret(*config.EncryptSecret)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(encrypted)
+		os.Exit(0)
+	}
+
 	dbConn, err := sqlx.Connect("postgres", config.AirQoIntegratorConf.Database.URI)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if *config.RotateKeys {
+		rotated, err := models.RotateServerSecrets(dbConn)
+		if err != nil {
+			log.WithError(err).Fatalln("Failed to rotate server secrets")
+		}
+		log.WithField("servers", rotated).Info("Server secrets rotated")
+		os.Exit(0)
+	}
 	// log.WithField("DHIS2_SERVER_CONFIGS", config.MFLDHIS2ServersConfigMap).Info("SERVER: =======>")
-	LoadServersFromConfigFiles(config.AIRQODHIS2ServersConfigMap)
+	LoadServersFromConfigFiles(config.ServerConfigs())
+	// changes to conf.d files are saved and take effect without a restart
+	config.OnServerConfigChange(upsertServerConfig)
 	// log.WithFields(log.Fields{"Servers": models.ServerMapByName["localhost"]}).Info("SERVERS==>>")
 	// os.Exit(1)
 
@@ -73,40 +109,29 @@ func main() {
 				fmt.Println("Error parsing end date:", err)
 				return
 			}
-			SendAirQoClimateData2(startDate, endDate)
+			_, _ = SendAirQoClimateData2(ctx, startDate, endDate)
 		}
 	}()
 
-	go func() {
-		// Create a new scheduler
-		c := cron.New()
+	var wg sync.WaitGroup
 
-		if !*config.SkipSync {
-			_, err := c.AddFunc(config.AirQoIntegratorConf.API.AIRQOSyncCronExpression, func() {
-				SendAirQoClimateData2(time.Now().Add(-24*time.Hour), time.Now())
-			})
-			if err != nil {
-				log.WithError(err).Error("Error scheduling measurements sync task:")
-				return
-			}
-		}
-		if !*config.SkipRequestProcessing {
-			_, err := c.AddFunc(config.AirQoIntegratorConf.API.AIRQORetryCronExpression, func() {
-				RetryIncompleteRequests()
-			})
-			if err != nil {
-				log.WithError(err).Error("Error scheduling incomplete request retry task:")
-			}
+	models.Jobs.Configure(jobDefinitions(sendCtx))
+	// cron expressions changed in the config file take effect without a restart
+	config.OnConfigChange(func() { models.Jobs.Configure(jobDefinitions(sendCtx)) })
+	models.Jobs.Start(ctx, dbConn)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		// wait for running jobs, but not beyond the shutdown timeout
+		if !models.Jobs.Stop(shutdownTimeout()) {
+			log.Warn("Scheduled jobs still running at shutdown")
 		}
-
-		c.Start()
 	}()
 
 	jobs := make(chan int)
-	var wg sync.WaitGroup
 
 	seenMap := make(map[models.RequestID]bool)
-	mutex := &sync.Mutex{}
 	rWMutex := &sync.RWMutex{}
 
 	if !*config.SkipRequestProcessing {
@@ -114,38 +139,43 @@ func main() {
 
 		// Start the producer goroutine
 		wg.Add(1)
-		go Produce(dbConn, jobs, &wg, mutex, seenMap)
+		go Produce(ctx, dbConn, jobs, &wg, rWMutex, seenMap)
 
 		// Start the consumer goroutine
 		wg.Add(1)
-		go StartConsumers(jobs, &wg, rWMutex, seenMap)
+		go StartConsumers(sendCtx, jobs, &wg, rWMutex, seenMap)
 	}
 	scheduledJobs := make(chan int64)
-	workingOn := make(map[int64]bool)
-	var workingOnMutex = &sync.Mutex{}
-	var rWworkingOnMutex = &sync.RWMutex{}
 
 	if !*config.SkipScheduleProcessing {
+		if err := models.EnsureRequestPurgeSchedule(dbConn); err != nil {
+			log.WithError(err).Error("Failed to create request purge schedule")
+		}
 		wg.Add(1)
-		go ProduceSchedules(dbConn, scheduledJobs, &wg, workingOnMutex, workingOn)
+		go ProduceSchedules(ctx, dbConn, scheduledJobs, &wg)
 
 		wg.Add(1)
-		go StartScheduleConsumers(scheduledJobs, &wg, rWworkingOnMutex, workingOn)
+		go StartScheduleConsumers(ctx, sendCtx, scheduledJobs, &wg)
 
 	}
 
 	// Start the backend API gin server
 	if !*config.DisableHTTPServer {
 		wg.Add(1)
-		go startAPIServer(&wg)
+		go startAPIServer(ctx, &wg)
 	}
 
-	wg.Wait()
-	close(scheduledJobs)
-	close(jobs)
+	<-ctx.Done()
+	log.Info("Shutdown requested. Draining in-flight requests")
+	if !waitTimeout(&wg, shutdownTimeout()) {
+		log.Warn("In-flight requests did not drain in time. Aborting sends")
+		abortSends()
+		wg.Wait()
+	}
+	log.Info("AirQo integrator stopped")
 }
 
-func startAPIServer(wg *sync.WaitGroup) {
+func startAPIServer(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 	router := gin.Default()
 	v2 := router.Group("/api", BasicAuth())
@@ -164,6 +194,13 @@ func startAPIServer(wg *sync.WaitGroup) {
 		v2.GET("/queue", q.Requests)
 		v2.GET("/queue/:id", q.GetRequest)
 		v2.DELETE("/queue/:id", q.DeleteRequest)
+		v2.POST("/queue/:id/dependencies", q.AddDependencies)
+		v2.GET("/batches/:batch/dependencies", q.BatchDependencies)
+		v2.GET("/archive/requests", q.ArchivedRequests)
+
+		cf := new(controllers.ConflictController)
+		v2.GET("/queue/:id/conflicts", cf.RequestConflicts)
+		v2.GET("/conflicts", cf.Conflicts)
 
 		ou := new(controllers.OrgUnitController)
 		v2.POST("/organisationUnits", ou.OrgUnit)
@@ -172,6 +209,13 @@ func startAPIServer(wg *sync.WaitGroup) {
 		s := new(controllers.ServerController)
 		v2.POST("/servers", s.CreateServer)
 		v2.POST("/importServers", s.ImportServers)
+		v2.GET("/servers", s.ListServers)
+		v2.GET("/servers/:id", s.GetServer)
+		v2.PUT("/servers/:id", s.UpdateServer)
+		v2.DELETE("/servers/:id", s.DeleteServer)
+		v2.POST("/servers/:id/suspend", s.SuspendServer)
+		v2.POST("/servers/:id/resume", s.ResumeServer)
+		v2.POST("/servers/:id/test", s.TestConnection)
 
 		ot := new(controllers.OrgUnitTreeController)
 		v2.GET("/outree/:server", ot.CreateOrgUnitTree)
@@ -185,18 +229,51 @@ func startAPIServer(wg *sync.WaitGroup) {
 
 		sc := new(controllers.ScheduleController)
 		v2.GET("/schedules", sc.ListSchedules)
+		v2.GET("/schedules/commands", sc.ListCommands)
+		v2.GET("/schedules/types", sc.ListTypes)
 		v2.POST("/schedules", sc.NewSchedule)
 		v2.GET("/schedules/:id", sc.GetSchedule)
+		v2.GET("/schedules/:id/runs", sc.ScheduleRuns)
+		v2.POST("/schedules/:id/pause", sc.PauseSchedule)
+		v2.POST("/schedules/:id/resume", sc.ResumeSchedule)
+		v2.POST("/schedules/:id/run-now", sc.RunScheduleNow)
 		v2.POST("/schedules/:id", sc.UpdateSchedule)
 		v2.DELETE("/schedules/:id", sc.DeleteSchedule)
 
+		mc := new(controllers.MaintenanceController)
+		v2.GET("/maintenance", mc.GetMaintenance)
+		v2.POST("/maintenance", mc.SetMaintenance)
+
+		jc := new(controllers.JobController)
+		v2.GET("/jobs", jc.ListJobs)
+
+		smc := new(controllers.SMSController)
+		v2.GET("/sms/subscribers", smc.ListSubscribers)
+		v2.POST("/sms/subscribers", smc.SaveSubscriber)
+		v2.DELETE("/sms/subscribers/:id", smc.DeleteSubscriber)
+
 	}
 	// Handle error response when a route is not defined
 	router.NoRoute(func(c *gin.Context) {
 		c.String(404, "Page Not Found!")
 	})
 
-	_ = router.Run(":" + fmt.Sprintf("%s", config.AirQoIntegratorConf.Server.Port))
+	srv := &http.Server{
+		Addr:    ":" + fmt.Sprintf("%s", config.AirQoIntegratorConf.Server.Port),
+		Handler: router,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Error("API server failed")
+		}
+	}()
+
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.WithError(err).Error("API server shutdown failed")
+	}
 }
 
 //TIP See GoLand help at <a href="https://www.jetbrains.com/help/go/">jetbrains.com/help/go/</a>.
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"airqo-integrator/models"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// maintenanceGate tells a producer whether maintenance mode pauses it, logging when the pause starts and ends
+type maintenanceGate struct {
+	producer string
+	paused   bool
+}
+
+func (g *maintenanceGate) closed(db *sqlx.DB) bool {
+	inMaintenance := models.InMaintenance(db)
+	if inMaintenance != g.paused {
+		if inMaintenance {
+			log.WithField("producer", g.producer).Warn("Maintenance mode enabled. Producer paused")
+		} else {
+			log.WithField("producer", g.producer).Info("Maintenance mode disabled. Producer resumed")
+		}
+		g.paused = inMaintenance
+	}
+	return inMaintenance
+}
@@ -0,0 +1,164 @@
+package models
+
+import (
+	"airqo-integrator/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrNothingToReconcile is returned for request bodies without data values
+var ErrNothingToReconcile = errors.New("request has no data values to reconcile")
+
+// reconciledValue is a data value as sent in a request body or returned by DHIS2 dataValueSets
+type reconciledValue struct {
+	DataElement          string           `json:"dataElement"`
+	Period               string           `json:"period,omitempty"`
+	OrgUnit              string           `json:"orgUnit,omitempty"`
+	CategoryOptionCombo  string           `json:"categoryOptionCombo,omitempty"`
+	AttributeOptionCombo string           `json:"attributeOptionCombo,omitempty"`
+	Value                utils.FlexString `json:"value"`
+}
+
+// key identifies the value. Values sent without a category option combo match any
+func (v reconciledValue) key(withCOC bool) string {
+	k := strings.Join([]string{v.DataElement, v.OrgUnit, v.Period}, ".")
+	if withCOC {
+		k += "." + v.CategoryOptionCombo
+	}
+	return k
+}
+
+// sameValue compares values numerically when both are numbers since DHIS2 normalises them, e.g. 1.50 to 1.5
+func sameValue(a, b string) bool {
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		return fa == fb
+	}
+	return strings.TrimSpace(a) == strings.TrimSpace(b)
+}
+
+// DataValuesReconciliation is the outcome of looking up the values of a request in DHIS2
+type DataValuesReconciliation struct {
+	Expected int      `json:"expected"`
+	Found    int      `json:"found"`
+	Missing  []string `json:"missing,omitempty"` // dataElement.orgUnit.period of values not stored or stored with another value
+}
+
+// Status returns the request status the reconciliation confirms
+func (r DataValuesReconciliation) Status() RequestStatus {
+	switch {
+	case r.Found == r.Expected:
+		return RequestStatusCompleted
+	case r.Found > 0:
+		return RequestStatusPartial
+	}
+	return RequestStatusFailed
+}
+
+// Summary describes the reconciliation for the request errors
+func (r DataValuesReconciliation) Summary() string {
+	summary := fmt.Sprintf("Reconciled: %d of %d values found in DHIS2", r.Found, r.Expected)
+	if len(r.Missing) > 0 {
+		missing := r.Missing
+		if len(missing) > 10 {
+			missing = append(missing[:10:10], "...")
+		}
+		summary += fmt.Sprintf(". Missing: %s", strings.Join(missing, ", "))
+	}
+	return summary
+}
+
+// requestDataValues reads the data values of a dataValueSets body. Values without their own
+// org unit or period take those of the set
+func requestDataValues(body []byte) (dataSet string, values []reconciledValue, err error) {
+	var set struct {
+		DataSet              string            `json:"dataSet"`
+		Period               string            `json:"period"`
+		OrgUnit              string            `json:"orgUnit"`
+		AttributeOptionCombo string            `json:"attributeOptionCombo"`
+		DataValues           []reconciledValue `json:"dataValues"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return "", nil, err
+	}
+	for _, v := range set.DataValues {
+		if v.OrgUnit == "" {
+			v.OrgUnit = set.OrgUnit
+		}
+		if v.Period == "" {
+			v.Period = set.Period
+		}
+		if v.DataElement != "" && v.OrgUnit != "" && v.Period != "" {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return "", nil, ErrNothingToReconcile
+	}
+	return set.DataSet, values, nil
+}
+
+// ReconcileDataValues checks which data values of a request body are stored in DHIS2 by querying
+// dataValueSets for each org unit and period in the body. The server's body transforms are applied
+// first so the values are compared with what was sent
+func ReconcileDataValues(serverID ServerID, body []byte, objectType string) (DataValuesReconciliation, error) {
+	var result DataValuesReconciliation
+	server := GetServerByID(int64(serverID))
+	if transforms := server.BodyTransforms(); len(transforms) > 0 {
+		transformed, err := transforms.Apply(body, objectType)
+		if err != nil {
+			return result, err
+		}
+		body = transformed
+	}
+	dataSet, values, err := requestDataValues(body)
+	if err != nil {
+		return result, err
+	}
+	// one query per org unit and period
+	groups := make(map[string][]reconciledValue)
+	for _, v := range values {
+		k := v.OrgUnit + "." + v.Period
+		groups[k] = append(groups[k], v)
+	}
+	for _, group := range groups {
+		params := url.Values{"orgUnit": {group[0].OrgUnit}, "period": {group[0].Period}}
+		if dataSet != "" {
+			params.Set("dataSet", dataSet)
+		} else {
+			for _, v := range group {
+				params.Add("dataElement", v.DataElement)
+			}
+		}
+		resp, err := server.GetDHIS2Resource("dataValueSets", params)
+		if err != nil {
+			return result, err
+		}
+		var stored struct {
+			DataValues []reconciledValue `json:"dataValues"`
+		}
+		if err := json.Unmarshal(resp, &stored); err != nil {
+			return result, err
+		}
+		storedValues := make(map[string]string, 2*len(stored.DataValues))
+		for _, v := range stored.DataValues {
+			storedValues[v.key(true)] = string(v.Value)
+			storedValues[v.key(false)] = string(v.Value)
+		}
+		for _, v := range group {
+			result.Expected++
+			storedValue, ok := storedValues[v.key(v.CategoryOptionCombo != "")]
+			if ok && sameValue(storedValue, string(v.Value)) {
+				result.Found++
+				continue
+			}
+			result.Missing = append(result.Missing, v.key(false))
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,188 @@
+package models
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/samber/lo"
+	"strings"
+	"text/template"
+)
+
+// constants for the body transform types
+const (
+	BodyTransformUIDMap    = "uid_map"    // replace UIDs using a lookup table
+	BodyTransformJSONPatch = "json_patch" // apply an RFC 6902 JSON Patch
+	BodyTransformTemplate  = "template"   // render the body with a Go text/template
+)
+
+// BodyTransform is a rule rewriting a request body before it is sent to a server, e.g. to
+// use the data element, category option combo and org unit UIDs of a district instance
+type BodyTransform struct {
+	Type        string            `json:"type"`
+	ObjectTypes []string          `json:"objectTypes,omitempty"` // request object types the rule applies to. Empty means all
+	UIDMap      map[string]string `json:"uidMap,omitempty"`      // uid_map: source UID to destination UID
+	Fields      []string          `json:"fields,omitempty"`      // uid_map: only remap values of these keys. Empty means all values
+	Patch       json.RawMessage   `json:"patch,omitempty"`       // json_patch: the patch operations
+	Template    string            `json:"template,omitempty"`    // template: rendered with the decoded body as dot
+}
+
+// BodyTransforms are applied in order to the bodies sent to a server
+type BodyTransforms []BodyTransform
+
+// Value implements the driver.Valuer interface
+func (t BodyTransforms) Value() (driver.Value, error) {
+	if t == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(t)
+}
+
+// Scan implements the sql.Scanner interface
+func (t *BodyTransforms) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, t)
+}
+
+// Validate checks the type of each rule and that its patch or template parses
+func (t BodyTransforms) Validate() error {
+	for i, rule := range t {
+		switch rule.Type {
+		case BodyTransformUIDMap:
+			if len(rule.UIDMap) == 0 {
+				return fmt.Errorf("body transform %d: uidMap is empty", i+1)
+			}
+		case BodyTransformJSONPatch:
+			if _, err := jsonpatch.DecodePatch(rule.Patch); err != nil {
+				return fmt.Errorf("body transform %d: invalid JSON Patch: %w", i+1, err)
+			}
+		case BodyTransformTemplate:
+			if _, err := rule.parseTemplate(); err != nil {
+				return fmt.Errorf("body transform %d: invalid template: %w", i+1, err)
+			}
+		default:
+			return fmt.Errorf("body transform %d: unknown type '%s'", i+1, rule.Type)
+		}
+	}
+	return nil
+}
+
+// Apply runs the rules matching objectType on body. uid_map and json_patch rules only apply to JSON bodies
+func (t BodyTransforms) Apply(body []byte, objectType string) ([]byte, error) {
+	for i, rule := range t {
+		if len(rule.ObjectTypes) > 0 && !lo.Contains(rule.ObjectTypes, objectType) {
+			continue
+		}
+		var err error
+		isJSON := json.Valid(body)
+		switch rule.Type {
+		case BodyTransformUIDMap:
+			if isJSON {
+				body, err = rule.remapUIDs(body)
+			}
+		case BodyTransformJSONPatch:
+			if isJSON {
+				body, err = rule.applyPatch(body)
+			}
+		case BodyTransformTemplate:
+			body, err = rule.render(body, isJSON)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("body transform %d (%s): %w", i+1, rule.Type, err)
+		}
+	}
+	return body, nil
+}
+
+func decodeJSON(body []byte) (interface{}, error) {
+	var data interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber() // keep numbers as they were written
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (rule BodyTransform) remapUIDs(body []byte) ([]byte, error) {
+	data, err := decodeJSON(body)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(rule.remapValue(data, len(rule.Fields) == 0))
+}
+
+// remapValue replaces the strings found in the UID map. Only values under one of
+// the rule's fields are replaced unless the rule has no fields
+func (rule BodyTransform) remapValue(v interface{}, remap bool) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = rule.remapValue(item, remap || lo.Contains(rule.Fields, k))
+		}
+		return val
+	case []interface{}:
+		for i, item := range val {
+			val[i] = rule.remapValue(item, remap)
+		}
+		return val
+	case string:
+		if mapped, ok := rule.UIDMap[val]; ok && remap {
+			return mapped
+		}
+		return val
+	default:
+		return val
+	}
+}
+
+func (rule BodyTransform) applyPatch(body []byte) ([]byte, error) {
+	patch, err := jsonpatch.DecodePatch(rule.Patch)
+	if err != nil {
+		return nil, err
+	}
+	return patch.Apply(body)
+}
+
+func (rule BodyTransform) parseTemplate() (*template.Template, error) {
+	return template.New("body").Option("missingkey=zero").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"uid": func(uid string) string { // remap using the rule's UID map
+			if mapped, ok := rule.UIDMap[uid]; ok {
+				return mapped
+			}
+			return uid
+		},
+		"join": func(sep string, items []interface{}) string {
+			return strings.Join(lo.Map(items, func(item interface{}, _ int) string { return fmt.Sprint(item) }), sep)
+		},
+	}).Parse(rule.Template)
+}
+
+// render executes the template with the decoded body, or the raw body for non JSON bodies, as dot
+func (rule BodyTransform) render(body []byte, isJSON bool) ([]byte, error) {
+	tmpl, err := rule.parseTemplate()
+	if err != nil {
+		return nil, err
+	}
+	var data interface{} = string(body)
+	if isJSON {
+		if data, err = decodeJSON(body); err != nil {
+			return nil, err
+		}
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
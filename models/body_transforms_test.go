@@ -0,0 +1,152 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestBodyTransformsApply(t *testing.T) {
+	uidMap := map[string]string{"deA": "deB", "ouA": "ouB"}
+	tests := []struct {
+		name       string
+		transforms BodyTransforms
+		objectType string
+		body       string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "uid_map without fields remaps every value",
+			transforms: BodyTransforms{{Type: BodyTransformUIDMap, UIDMap: uidMap}},
+			body:       `{"orgUnit":"ouA","dataValues":[{"dataElement":"deA","comment":"ouA"}]}`,
+			want:       `{"dataValues":[{"comment":"ouB","dataElement":"deB"}],"orgUnit":"ouB"}`,
+		},
+		{
+			name:       "uid_map with fields only remaps values under those keys",
+			transforms: BodyTransforms{{Type: BodyTransformUIDMap, UIDMap: uidMap, Fields: []string{"dataElement"}}},
+			body:       `{"orgUnit":"ouA","dataValues":[{"dataElement":"deA","comment":"deA"}]}`,
+			want:       `{"dataValues":[{"comment":"deA","dataElement":"deB"}],"orgUnit":"ouA"}`,
+		},
+		{
+			name:       "uid_map with fields remaps everything below a matching key",
+			transforms: BodyTransforms{{Type: BodyTransformUIDMap, UIDMap: uidMap, Fields: []string{"ids"}}},
+			body:       `{"ids":["deA",{"nested":"ouA"}],"other":"deA"}`,
+			want:       `{"ids":["deB",{"nested":"ouB"}],"other":"deA"}`,
+		},
+		{
+			name:       "uid_map keeps number precision",
+			transforms: BodyTransforms{{Type: BodyTransformUIDMap, UIDMap: uidMap}},
+			body:       `{"dataElement":"deA","value":12345678901234567890.10}`,
+			want:       `{"dataElement":"deB","value":12345678901234567890.10}`,
+		},
+		{
+			name:       "uid_map leaves non JSON bodies alone",
+			transforms: BodyTransforms{{Type: BodyTransformUIDMap, UIDMap: uidMap}},
+			body:       `<dataValue dataElement="deA"/>`,
+			want:       `<dataValue dataElement="deA"/>`,
+		},
+		{
+			name:       "rules for other object types are skipped",
+			transforms: BodyTransforms{{Type: BodyTransformUIDMap, UIDMap: uidMap, ObjectTypes: []string{"ORGANISATION_UNIT"}}},
+			objectType: "AGGREGATE_DATA",
+			body:       `{"dataElement":"deA"}`,
+			want:       `{"dataElement":"deA"}`,
+		},
+		{
+			name: "json_patch",
+			transforms: BodyTransforms{{Type: BodyTransformJSONPatch,
+				Patch: json.RawMessage(`[{"op":"add","path":"/dataSet","value":"ds1"},{"op":"remove","path":"/comment"}]`)}},
+			body: `{"comment":"x","period":"20240101"}`,
+			want: `{"dataSet":"ds1","period":"20240101"}`,
+		},
+		{
+			name: "json_patch leaves non JSON bodies alone",
+			transforms: BodyTransforms{{Type: BodyTransformJSONPatch,
+				Patch: json.RawMessage(`[{"op":"add","path":"/dataSet","value":"ds1"}]`)}},
+			body: `period=20240101`,
+			want: `period=20240101`,
+		},
+		{
+			name: "json_patch failing on the body is an error",
+			transforms: BodyTransforms{{Type: BodyTransformJSONPatch,
+				Patch: json.RawMessage(`[{"op":"remove","path":"/missing"}]`)}},
+			body:    `{"period":"20240101"}`,
+			wantErr: true,
+		},
+		{
+			name: "template renders the decoded JSON body",
+			transforms: BodyTransforms{{Type: BodyTransformTemplate, UIDMap: uidMap,
+				Template: `{"de":"{{uid .dataElement}}","value":{{.value}},"tags":"{{join "," .tags}}","raw":{{json .orgUnit}}}`}},
+			body: `{"dataElement":"deA","value":1.50,"tags":["a","b"],"orgUnit":"ouA"}`,
+			want: `{"de":"deB","value":1.50,"tags":"a,b","raw":"ouA"}`,
+		},
+		{
+			name:       "template gets the raw body when it is not JSON",
+			transforms: BodyTransforms{{Type: BodyTransformTemplate, Template: `<wrap>{{.}}</wrap>`}},
+			body:       `plain text`,
+			want:       `<wrap>plain text</wrap>`,
+		},
+		{
+			name:       "template with a missing key renders the zero value",
+			transforms: BodyTransforms{{Type: BodyTransformTemplate, Template: `[{{.missing}}]`}},
+			body:       `{"present":1}`,
+			want:       `[<no value>]`,
+		},
+		{
+			name: "rules apply in order",
+			transforms: BodyTransforms{
+				{Type: BodyTransformUIDMap, UIDMap: uidMap},
+				{Type: BodyTransformTemplate, Template: `{{.dataElement}}`},
+			},
+			body: `{"dataElement":"deA"}`,
+			want: `deB`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.transforms.Apply([]byte(tt.body), tt.objectType)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBodyTransformsValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		transforms BodyTransforms
+		wantErr    string
+	}{
+		{"valid rules", BodyTransforms{
+			{Type: BodyTransformUIDMap, UIDMap: map[string]string{"a": "b"}},
+			{Type: BodyTransformJSONPatch, Patch: json.RawMessage(`[]`)},
+			{Type: BodyTransformTemplate, Template: `{{.}}`},
+		}, ""},
+		{"empty uid map", BodyTransforms{{Type: BodyTransformUIDMap}}, "uidMap is empty"},
+		{"invalid patch", BodyTransforms{{Type: BodyTransformJSONPatch, Patch: json.RawMessage(`{}`)}}, "invalid JSON Patch"},
+		{"invalid template", BodyTransforms{{Type: BodyTransformTemplate, Template: `{{.x`}}, "invalid template"},
+		{"unknown type", BodyTransforms{{Type: "xslt"}}, "unknown type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.transforms.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
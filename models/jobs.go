@@ -0,0 +1,200 @@
+package models
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobDefinition is a named task the job manager runs on a cron expression
+type JobDefinition struct {
+	Name    string
+	Spec    string // standard cron expression or a descriptor such as @daily
+	Enabled bool
+	Run     func(ctx context.Context)
+}
+
+// JobStatus is what the API shows of a job
+type JobStatus struct {
+	Name         string     `json:"name"`
+	Spec         string     `json:"spec"`
+	Enabled      bool       `json:"enabled"`
+	Running      bool       `json:"running"`
+	LastStart    *time.Time `json:"lastStart,omitempty"`
+	LastFinish   *time.Time `json:"lastFinish,omitempty"`
+	LastDuration string     `json:"lastDuration,omitempty"`
+	NextRun      *time.Time `json:"nextRun,omitempty"`
+	Runs         int        `json:"runs"`
+	Skipped      int        `json:"skipped"` // runs skipped because the previous one was still running or in maintenance mode
+	Error        string     `json:"error,omitempty"`
+}
+
+type job struct {
+	def     JobDefinition
+	entryID cron.EntryID
+	status  JobStatus
+}
+
+// JobManager runs named jobs on cron expressions. A job is skipped while its previous run is still going
+// and while the integrator is in maintenance mode. The jobs can be reconfigured while the manager runs
+type JobManager struct {
+	mu   sync.Mutex
+	cron *cron.Cron
+	db   *sqlx.DB
+	ctx  context.Context
+	jobs map[string]*job
+}
+
+// Jobs is the job manager of the integrator
+var Jobs = &JobManager{jobs: map[string]*job{}}
+
+// Start starts running the configured jobs. They get ctx, which is cancelled on shutdown
+func (m *JobManager) Start(ctx context.Context, db *sqlx.DB) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ctx, m.db = ctx, db
+	m.cron = cron.New(cron.WithLocation(Location))
+	for _, j := range m.jobs {
+		m.schedule(j)
+	}
+	m.cron.Start()
+}
+
+// Stop stops scheduling jobs and waits up to timeout for running ones. It returns false if some are still running
+func (m *JobManager) Stop(timeout time.Duration) bool {
+	m.mu.Lock()
+	c := m.cron
+	m.mu.Unlock()
+	if c == nil {
+		return true
+	}
+	select {
+	case <-c.Stop().Done():
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Configure sets the jobs to run. Jobs whose expression or state changed are rescheduled, jobs
+// no longer defined are removed and the history of the others is kept
+func (m *JobManager) Configure(defs []JobDefinition) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defined := make(map[string]bool, len(defs))
+	for _, def := range defs {
+		defined[def.Name] = true
+		j, ok := m.jobs[def.Name]
+		if !ok {
+			j = &job{status: JobStatus{Name: def.Name}}
+			m.jobs[def.Name] = j
+		} else if j.def.Spec == def.Spec && j.def.Enabled == def.Enabled {
+			j.def.Run = def.Run
+			continue
+		}
+		if ok {
+			log.WithFields(log.Fields{"job": def.Name, "spec": def.Spec, "enabled": def.Enabled}).Info("Job reconfigured")
+		}
+		m.unschedule(j)
+		j.def = def
+		j.status.Spec, j.status.Enabled, j.status.Error = def.Spec, def.Enabled, ""
+		m.schedule(j)
+	}
+	for name, j := range m.jobs {
+		if !defined[name] {
+			m.unschedule(j)
+			delete(m.jobs, name)
+		}
+	}
+}
+
+// schedule adds the job to cron when the manager is started. m.mu is held
+func (m *JobManager) schedule(j *job) {
+	if m.cron == nil || !j.def.Enabled {
+		return
+	}
+	name := j.def.Name
+	id, err := m.cron.AddFunc(j.def.Spec, func() { m.run(name) })
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"job": name, "spec": j.def.Spec}).Error("Failed to schedule job")
+		j.status.Error = err.Error()
+		return
+	}
+	j.entryID = id
+}
+
+// unschedule removes the job from cron. m.mu is held
+func (m *JobManager) unschedule(j *job) {
+	if m.cron != nil && j.entryID != 0 {
+		m.cron.Remove(j.entryID)
+	}
+	j.entryID = 0
+}
+
+func (m *JobManager) run(name string) {
+	m.mu.Lock()
+	j, ok := m.jobs[name]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	logger := log.WithField("job", name)
+	if j.status.Running {
+		j.status.Skipped++
+		m.mu.Unlock()
+		logger.Warn("Job skipped, previous run still running")
+		return
+	}
+	if m.db != nil && InMaintenance(m.db) {
+		j.status.Skipped++
+		m.mu.Unlock()
+		logger.Info("Job skipped in maintenance mode")
+		return
+	}
+	start := time.Now().In(Location)
+	j.status.Running = true
+	j.status.LastStart = &start
+	run, ctx := j.def.Run, m.ctx
+	m.mu.Unlock()
+
+	defer func() {
+		r := recover()
+		finish := time.Now().In(Location)
+		m.mu.Lock()
+		j.status.Running = false
+		j.status.Runs++
+		j.status.LastFinish = &finish
+		j.status.LastDuration = finish.Sub(start).String()
+		j.status.Error = ""
+		if r != nil {
+			j.status.Error = "job panicked"
+			logger.WithField("panic", r).Error("Job panicked")
+		}
+		m.mu.Unlock()
+		logger.WithField("duration", finish.Sub(start).String()).Info("Job finished")
+	}()
+	logger.Info("Job started")
+	run(ctx)
+}
+
+// Status returns the jobs sorted by name with their last and next runs
+func (m *JobManager) Status() []JobStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := make([]JobStatus, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		status := j.status
+		if m.cron != nil && j.entryID != 0 {
+			if next := m.cron.Entry(j.entryID).Next; !next.IsZero() {
+				status.NextRun = &next
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+	return statuses
+}
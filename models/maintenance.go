@@ -0,0 +1,46 @@
+package models
+
+import (
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// MaintenanceMode pauses every schedule and the request producer, e.g. while DHIS2 is upgraded.
+// Runs and sends already in progress are allowed to finish
+type MaintenanceMode struct {
+	Enabled bool      `db:"enabled" json:"enabled"`
+	Reason  string    `db:"reason" json:"reason,omitempty"`
+	Updated time.Time `db:"updated" json:"updated"`
+}
+
+// GetMaintenanceMode returns the maintenance mode shared by the integrators using the database
+func GetMaintenanceMode(db sqlx.Queryer) (MaintenanceMode, error) {
+	var mode MaintenanceMode
+	err := sqlx.Get(db, &mode, "SELECT enabled, reason, updated FROM maintenance_mode WHERE id")
+	return mode, err
+}
+
+// InMaintenance returns whether maintenance mode is enabled. Should the mode fail to
+// load the integrator keeps working since the same failure stops it anyway
+func InMaintenance(db sqlx.Queryer) bool {
+	mode, err := GetMaintenanceMode(db)
+	if err != nil {
+		log.WithError(err).Error("Failed to read maintenance mode")
+		return false
+	}
+	return mode.Enabled
+}
+
+// SetMaintenanceMode enables or disables maintenance mode
+func SetMaintenanceMode(db *sqlx.DB, enabled bool, reason string) (MaintenanceMode, error) {
+	var mode MaintenanceMode
+	err := db.Get(&mode, `
+		INSERT INTO maintenance_mode (id, enabled, reason, updated) VALUES (TRUE, $1, $2, NOW())
+		ON CONFLICT (id) DO UPDATE SET (enabled, reason, updated) = (EXCLUDED.enabled, EXCLUDED.reason, EXCLUDED.updated)
+		RETURNING enabled, reason, updated`, enabled, reason)
+	if err == nil {
+		log.WithFields(log.Fields{"enabled": enabled, "reason": reason}).Warn("Maintenance mode changed")
+	}
+	return mode, err
+}
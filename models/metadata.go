@@ -109,31 +109,19 @@ func SendMetadata(server Server, data interface{}) []byte {
 	serverName := server.Name()
 
 	var rBody []byte
-	switch server.AuthMethod() {
-	case "Basic":
-		resp, err := utils.PostWithBasicAuth(mURL, data, server.Username(), server.Password())
-		rBody = resp
-		if err != nil {
-			ouList := data.(map[string][]MetadataOu)["organisationUnits"]
-			troubleOus := lo.Map(ouList, func(item MetadataOu, index int) string {
-				return item.ID
-			})
-			log.WithFields(log.Fields{"Server": serverName, "TroubleOus": troubleOus}).WithError(err).Error(
-				"Failed to import metadata in server")
-		}
-	case "Token":
-		resp, err := utils.PostWithToken(mURL, data, server.AuthToken())
-		rBody = resp
-		if err != nil {
-			ouList := data.(map[string][]MetadataOu)["organisationUnits"]
-			troubleOus := lo.Map(ouList, func(item MetadataOu, index int) string {
-				return item.ID
-			})
-			log.WithFields(log.Fields{"Server": serverName, "TroubleOus": troubleOus}).WithError(err).Error(
-				"Failed to import metadata in server")
-		}
-	default:
-		//
+	auth, err := server.AuthProvider()
+	if err != nil {
+		log.WithError(err).WithField("Server", serverName).Error("Cannot authenticate to server")
+		return rBody
+	}
+	rBody, err = utils.PostWithAuth(mURL, data, auth)
+	if err != nil {
+		ouList := data.(map[string][]MetadataOu)["organisationUnits"]
+		troubleOus := lo.Map(ouList, func(item MetadataOu, index int) string {
+			return item.ID
+		})
+		log.WithFields(log.Fields{"Server": serverName, "TroubleOus": troubleOus}).WithError(err).Error(
+			"Failed to import metadata in server")
 	}
 	if rBody != nil {
 		log.WithFields(log.Fields{"Server": serverName, "Response": string(rBody)}).Info("Metadata Import")
@@ -0,0 +1,349 @@
+package models
+
+import (
+	"airqo-integrator/config"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RetentionPolicy decides how long requests are kept before they are archived
+type RetentionPolicy struct {
+	CompletedDays int    `json:"completedDays"` // completed and partial requests. 0 keeps them
+	FailedDays    int    `json:"failedDays"`    // failed, error, expired and canceled requests. 0 keeps them
+	ArchiveDir    string `json:"archiveDir"`    // gzip JSONL files are written here. Empty archives to the database
+	BatchSize     int    `json:"batchSize"`     // requests archived per transaction
+}
+
+// RetentionPolicyFromConfig returns the retention policy in the configuration
+func RetentionPolicyFromConfig() RetentionPolicy {
+	conf := config.AirQoIntegratorConf.Server
+	return RetentionPolicy{
+		CompletedDays: conf.RequestRetentionDays,
+		FailedDays:    conf.FailedRequestRetentionDays,
+		ArchiveDir:    conf.RequestArchiveDir,
+		BatchSize:     conf.RequestPurgeBatchSize,
+	}
+}
+
+// Enabled returns whether the policy archives any requests
+func (p RetentionPolicy) Enabled() bool {
+	return p.CompletedDays > 0 || p.FailedDays > 0
+}
+
+// expiredRequestsSQL selects requests past retention. Requests with children still to be sent
+// or with an async job still being checked are kept until those are done. The archived row includes
+// the request's conflicts and dependencies since deleting the request deletes them
+const expiredRequestsSQL = `
+SELECT r.id, r.uid, r.batchid, r.source, r.destination, r.status, r.object_type, r.district,
+    r.created, r.updated,
+    (TO_JSONB(r) || JSONB_BUILD_OBJECT(
+        'conflicts', COALESCE((SELECT JSONB_AGG(TO_JSONB(c) ORDER BY c.id)
+            FROM request_conflicts c WHERE c.request_id = r.id), '[]'::JSONB),
+        'dependencies', COALESCE((SELECT JSONB_AGG(d.depends_on ORDER BY d.depends_on)
+            FROM request_dependencies d WHERE d.request_id = r.id), '[]'::JSONB)))::TEXT AS row
+FROM requests r
+WHERE ((r.status IN ('completed', 'partial') AND $1 > 0 AND r.updated < NOW() - make_interval(days => $1))
+    OR (r.status IN ('failed', 'error', 'expired', 'canceled') AND $2 > 0
+        AND r.updated < NOW() - make_interval(days => $2)))
+  AND NOT EXISTS (
+    SELECT 1 FROM request_dependencies d JOIN requests c ON c.id = d.request_id
+    WHERE d.depends_on = r.id AND c.status IN ('ready', 'failed', 'unknown'))
+  AND NOT EXISTS (SELECT 1 FROM schedules s WHERE s.request_id = r.id AND s.is_active AND s.status = 'ready')
+ORDER BY r.id
+LIMIT $3
+FOR UPDATE OF r SKIP LOCKED`
+
+const insertArchivedRequestSQL = `
+INSERT INTO requests_archive (id, uid, batchid, source, destination, status, object_type, district,
+    archive_file, payload, created, updated)
+VALUES (:id, :uid, :batchid, :source, :destination, :status, :object_type, :district,
+    :archive_file, :payload, :created, :updated)
+ON CONFLICT (id) DO NOTHING`
+
+// ArchivedRequest is a request moved out of the requests table by the purge
+type ArchivedRequest struct {
+	ID          RequestID       `db:"id" json:"id"`
+	UID         string          `db:"uid" json:"uid"`
+	BatchID     string          `db:"batchid" json:"batchId,omitempty"`
+	Source      *int            `db:"source" json:"source,omitempty"`
+	Destination *int            `db:"destination" json:"destination,omitempty"`
+	Status      string          `db:"status" json:"status"`
+	ObjectType  string          `db:"object_type" json:"objectType,omitempty"`
+	District    string          `db:"district" json:"district,omitempty"`
+	ArchiveFile string          `db:"archive_file" json:"archiveFile,omitempty"`
+	Payload     []byte          `db:"payload" json:"-"`
+	Created     time.Time       `db:"created" json:"created"`
+	Updated     time.Time       `db:"updated" json:"updated"`
+	Archived    time.Time       `db:"archived" json:"archived"`
+	Row         string          `db:"row" json:"-"`               // the request as JSON when read for archiving
+	Request     json.RawMessage `db:"-" json:"request,omitempty"` // the full request, body and response included
+}
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = zr.Close() }()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(zr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// archiveFile is a gzip JSONL file a purge run appends archived requests to
+type archiveFile struct {
+	path string
+	file *os.File
+	zw   *gzip.Writer
+}
+
+func openArchiveFile(dir string) (*archiveFile, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("requests-%s.jsonl.gz", time.Now().Format("20060102-150405")))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFile{path: path, file: file, zw: gzip.NewWriter(file)}, nil
+}
+
+// write appends the requests and flushes them so they are on disk before the requests are deleted
+func (a *archiveFile) write(requests []ArchivedRequest) error {
+	for _, r := range requests {
+		if _, err := a.zw.Write(append([]byte(r.Row), '\n')); err != nil {
+			return err
+		}
+	}
+	if err := a.zw.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *archiveFile) close() error {
+	if err := a.zw.Close(); err != nil {
+		_ = a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// PurgeRequests moves the requests past retention to the archive and returns how many were archived
+func PurgeRequests(db *sqlx.DB, policy RetentionPolicy) (int, error) {
+	if !policy.Enabled() {
+		return 0, nil
+	}
+	if policy.BatchSize <= 0 {
+		policy.BatchSize = 1000
+	}
+	var file *archiveFile
+	if policy.ArchiveDir != "" {
+		var err error
+		if file, err = openArchiveFile(policy.ArchiveDir); err != nil {
+			return 0, err
+		}
+		defer func() {
+			if err := file.close(); err != nil {
+				log.WithError(err).WithField("file", file.path).Error("Failed to close request archive")
+			}
+		}()
+	}
+
+	archived := 0
+	for {
+		n, err := purgeRequestsBatch(db, policy, file)
+		archived += n
+		if err != nil {
+			return archived, err
+		}
+		if n < policy.BatchSize {
+			break
+		}
+	}
+	log.WithFields(log.Fields{
+		"archived": archived, "completedDays": policy.CompletedDays, "failedDays": policy.FailedDays,
+	}).Info("Purged requests past retention")
+	return archived, nil
+}
+
+func purgeRequestsBatch(db *sqlx.DB, policy RetentionPolicy, file *archiveFile) (int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var requests []ArchivedRequest
+	if err := tx.Select(&requests, expiredRequestsSQL, policy.CompletedDays, policy.FailedDays, policy.BatchSize); err != nil {
+		return 0, err
+	}
+	if len(requests) == 0 {
+		return 0, nil
+	}
+	if file != nil {
+		// a request written to the file whose delete then fails is archived again by the next run
+		if err := file.write(requests); err != nil {
+			return 0, err
+		}
+	}
+	ids := make(pq.Int64Array, 0, len(requests))
+	for i := range requests {
+		if file != nil {
+			requests[i].ArchiveFile = file.path
+		} else if requests[i].Payload, err = gzipBytes([]byte(requests[i].Row)); err != nil {
+			return 0, err
+		}
+		if _, err := tx.NamedExec(insertArchivedRequestSQL, requests[i]); err != nil {
+			return 0, err
+		}
+		ids = append(ids, int64(requests[i].ID))
+	}
+	if _, err := tx.Exec("DELETE FROM requests WHERE id = ANY($1)", ids); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(requests), nil
+}
+
+const searchArchivedRequestsSQL = `
+SELECT id, uid, batchid, source, destination, status, object_type, district, archive_file, payload,
+    created, updated, archived, '' AS row
+FROM requests_archive
+WHERE ($1 = '' OR uid = $1) AND ($2 = '' OR batchid = $2)
+ORDER BY id
+LIMIT $3`
+
+// SearchArchivedRequests returns the archived requests with the given uid and/or batch, including the full
+// request when withRequest is set
+func SearchArchivedRequests(db *sqlx.DB, uid, batch string, withRequest bool, limit int) ([]ArchivedRequest, error) {
+	if uid == "" && batch == "" {
+		return nil, errors.New("uid or batch is required")
+	}
+	requests := []ArchivedRequest{}
+	if err := db.Select(&requests, searchArchivedRequestsSQL, uid, batch, limit); err != nil {
+		return nil, err
+	}
+	if !withRequest {
+		return requests, nil
+	}
+	fromFiles := make(map[string]map[RequestID]bool)
+	for i := range requests {
+		if requests[i].ArchiveFile != "" {
+			if fromFiles[requests[i].ArchiveFile] == nil {
+				fromFiles[requests[i].ArchiveFile] = make(map[RequestID]bool)
+			}
+			fromFiles[requests[i].ArchiveFile][requests[i].ID] = true
+			continue
+		}
+		row, err := gunzipBytes(requests[i].Payload)
+		if err != nil {
+			return nil, err
+		}
+		requests[i].Request = row
+	}
+	for path, ids := range fromFiles {
+		// rows read before an error, e.g. a file truncated by a crash, are still returned
+		rows, err := readArchivedRows(path, ids)
+		if err != nil {
+			log.WithError(err).WithField("file", path).Error("Failed to read request archive")
+		}
+		for i := range requests {
+			if row, ok := rows[requests[i].ID]; ok && requests[i].ArchiveFile == path {
+				requests[i].Request = row
+			}
+		}
+	}
+	return requests, nil
+}
+
+// readArchivedRows returns the requests with the given ids from a gzip JSONL archive file
+func readArchivedRows(path string, ids map[RequestID]bool) (map[RequestID]json.RawMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = zr.Close() }()
+
+	rows := make(map[RequestID]json.RawMessage, len(ids))
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024) // bodies can be large
+	for scanner.Scan() && len(rows) < len(ids) {
+		var row struct {
+			ID RequestID `json:"id"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil || !ids[row.ID] {
+			continue
+		}
+		rows[row.ID] = append(json.RawMessage{}, scanner.Bytes()...)
+	}
+	return rows, scanner.Err()
+}
+
+// PurgeRequestsCommand is the command of the schedule running the request purge
+const PurgeRequestsCommand = "purge_requests"
+
+// EnsureRequestPurgeSchedule creates a daily schedule running the request purge when
+// a retention period is configured and there is no purge schedule yet
+func EnsureRequestPurgeSchedule(db *sqlx.DB) error {
+	if !RetentionPolicyFromConfig().Enabled() {
+		return nil
+	}
+	exists := false
+	if err := db.Get(&exists, "SELECT EXISTS (SELECT 1 FROM schedules WHERE sched_type = 'command' AND command = $1)",
+		PurgeRequestsCommand); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	now := time.Now().In(Location)
+	id, err := CreateSchedule(db, Schedule{
+		ScheduleType: "command",
+		Params:       []byte("{}"),
+		Command:      PurgeRequestsCommand,
+		Repeat:       "daily",
+		NextRunAt:    now,
+		Status:       "ready",
+		IsActive:     true,
+		Created:      now,
+		Updated:      now,
+	})
+	if err != nil {
+		return err
+	}
+	log.WithField("scheduleID", id).Info("Created request purge schedule")
+	return nil
+}
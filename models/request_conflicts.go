@@ -0,0 +1,139 @@
+package models
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// RequestConflict is a single conflict reported by DHIS2 when importing a request
+type RequestConflict struct {
+	ID                  int64     `db:"id" json:"id"`
+	RequestID           RequestID `db:"request_id" json:"requestId"`
+	ServerID            ServerID  `db:"server_id" json:"serverId"`
+	DataElement         string    `db:"data_element" json:"dataElement,omitempty"`
+	OrgUnit             string    `db:"org_unit" json:"orgUnit,omitempty"`
+	Period              string    `db:"period" json:"period,omitempty"`
+	CategoryOptionCombo string    `db:"category_option_combo" json:"categoryOptionCombo,omitempty"`
+	Object              string    `db:"object" json:"object,omitempty"`
+	Property            string    `db:"property" json:"property,omitempty"`
+	Message             string    `db:"message" json:"message"`
+	ErrorCode           string    `db:"error_code" json:"errorCode,omitempty"`
+	Created             time.Time `db:"created" json:"created"`
+}
+
+// RequestConflictFields are the fields of the request_conflicts table exposed through the API
+var RequestConflictFields = []string{
+	"id", "request_id", "server_id", "data_element", "org_unit", "period", "category_option_combo",
+	"object", "property", "message", "error_code", "created", "*"}
+
+// ToRequestConflict converts a conflict in the DHIS2 import summary to a RequestConflict.
+// Older DHIS2 versions only report the object and value, newer ones the objects involved
+func (c ConflictObject) ToRequestConflict() RequestConflict {
+	conflict := RequestConflict{
+		Object:    c.Object,
+		Property:  c.Property,
+		Message:   c.Value,
+		ErrorCode: c.ErrorCode,
+	}
+	for k, v := range c.Objects {
+		switch strings.ToLower(k) {
+		case "dataelement":
+			conflict.DataElement = v
+		case "orgunit", "organisationunit":
+			conflict.OrgUnit = v
+		case "period":
+			conflict.Period = v
+		case "categoryoptioncombo":
+			conflict.CategoryOptionCombo = v
+		}
+	}
+	if conflict.DataElement == "" && strings.EqualFold(c.Property, "dataElement") {
+		conflict.DataElement = c.Object
+	}
+	if conflict.OrgUnit == "" && strings.EqualFold(c.Property, "orgUnit") {
+		conflict.OrgUnit = c.Object
+	}
+	if conflict.Period == "" && strings.EqualFold(c.Property, "period") {
+		conflict.Period = c.Object
+	}
+	return conflict
+}
+
+// ImportStatus returns the request status for a DHIS2 import summary. Imports where DHIS2
+// ignored some of the values are partial, those where nothing was imported are failed
+func ImportStatus(status ResponseStatus, count ImportCount) RequestStatus {
+	imported := count.Imported + count.Updated + count.Deleted + count.Created
+	if strings.EqualFold(string(status), "ERROR") || count.Ignored > 0 {
+		if imported > 0 {
+			return RequestStatusPartial
+		}
+		return RequestStatusFailed
+	}
+	if strings.EqualFold(string(status), "WARNING") {
+		return RequestStatusPartial
+	}
+	return RequestStatusCompleted
+}
+
+// ImportCountSummary returns the summary of the import counts saved in the request errors
+func ImportCountSummary(count ImportCount) string {
+	summary := fmt.Sprintf(
+		"Imported: %d, Updated: %d, Ignored: %d, Deleted: %d", count.Imported, count.Updated, count.Ignored, count.Deleted)
+	if count.Created > 0 {
+		// metadata imports report created objects in the stats
+		summary = fmt.Sprintf("Created: %d, %s", count.Created, summary)
+	}
+	return summary
+}
+
+const insertRequestConflictSQL = `
+INSERT INTO request_conflicts (request_id, server_id, data_element, org_unit, period, category_option_combo,
+	object, property, message, error_code)
+VALUES (:request_id, :server_id, :data_element, :org_unit, :period, :category_option_combo,
+	:object, :property, :message, :error_code)
+`
+
+// SaveRequestConflicts replaces the conflicts recorded for a request on a server. It runs in a savepoint
+// so a failure leaves tx usable for recording the request's status
+func SaveRequestConflicts(tx *sqlx.Tx, requestID RequestID, serverID ServerID, conflicts []ConflictObject) error {
+	if _, err := tx.Exec("SAVEPOINT request_conflicts"); err != nil {
+		return err
+	}
+	if err := saveRequestConflicts(tx, requestID, serverID, conflicts); err != nil {
+		_, _ = tx.Exec("ROLLBACK TO SAVEPOINT request_conflicts")
+		return err
+	}
+	_, err := tx.Exec("RELEASE SAVEPOINT request_conflicts")
+	return err
+}
+
+func saveRequestConflicts(tx *sqlx.Tx, requestID RequestID, serverID ServerID, conflicts []ConflictObject) error {
+	_, err := tx.Exec(`DELETE FROM request_conflicts WHERE request_id = $1 AND server_id = $2`, requestID, serverID)
+	if err != nil {
+		log.WithError(err).Error("Failed to clear previous request conflicts")
+		return err
+	}
+	for _, c := range conflicts {
+		conflict := c.ToRequestConflict()
+		conflict.RequestID = requestID
+		conflict.ServerID = serverID
+		if _, err := tx.NamedExec(insertRequestConflictSQL, conflict); err != nil {
+			log.WithError(err).WithField("requestID", requestID).Error("Failed to save request conflict")
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRequestConflicts returns the conflicts recorded for a request
+func GetRequestConflicts(db *sqlx.DB, requestID RequestID) ([]RequestConflict, error) {
+	conflicts := []RequestConflict{}
+	err := db.Select(&conflicts, `
+		SELECT id, request_id, COALESCE(server_id, 0) AS server_id, data_element, org_unit, period,
+			category_option_combo, object, property, message, error_code, created
+		FROM request_conflicts WHERE request_id = $1 ORDER BY id`, requestID)
+	return conflicts, err
+}
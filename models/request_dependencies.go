@@ -0,0 +1,235 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// DependencyPolicy decides what happens to a request when a request it depends on fails for good
+type DependencyPolicy string
+
+// constants for the dependency policy
+const (
+	DependencyPolicyCancel  = DependencyPolicy("cancel")  // cancel the request and the requests depending on it
+	DependencyPolicyWait    = DependencyPolicy("wait")    // keep waiting in case the dependency is fixed and re-queued
+	DependencyPolicyProceed = DependencyPolicy("proceed") // send the request once all dependencies are done
+)
+
+// Valid returns whether p is a known policy. The empty policy defaults to wait
+func (p DependencyPolicy) Valid() bool {
+	switch p {
+	case "", DependencyPolicyCancel, DependencyPolicyWait, DependencyPolicyProceed:
+		return true
+	}
+	return false
+}
+
+// ErrDependencyCycle is returned when adding a dependency would make a request depend on itself
+var ErrDependencyCycle = errors.New("dependency would create a cycle")
+
+// ErrInvalidDependencyPolicy is returned for policies other than cancel, wait and proceed
+var ErrInvalidDependencyPolicy = errors.New("dependency policy must be one of cancel, wait or proceed")
+
+// ErrRequestNotFound is returned when a request referenced by uid does not exist
+var ErrRequestNotFound = errors.New("request not found")
+
+// dependsOnSQL checks whether $1 already depends, directly or indirectly, on $2
+const dependsOnSQL = `
+WITH RECURSIVE ancestors AS (
+    SELECT depends_on FROM request_dependencies WHERE request_id = $1
+    UNION
+    SELECT d.depends_on FROM request_dependencies d JOIN ancestors a ON d.request_id = a.depends_on
+)
+SELECT EXISTS (SELECT 1 FROM ancestors WHERE depends_on = $2)`
+
+// cancelIfDependencyCanceledSQL cancels a ready request added under a dependency that already failed
+const cancelIfDependencyCanceledSQL = `
+UPDATE requests SET status = 'canceled', statuscode = 'ERROR05', errors = 'Dependency failed', updated = current_timestamp
+WHERE id = $1 AND status = 'ready' AND status_of_dependence(id) = 'canceled'`
+
+// AddRequestDependencies makes request id depend on the parents. It fails with ErrDependencyCycle
+// when a parent already depends on the request
+func AddRequestDependencies(tx *sqlx.Tx, id RequestID, parents []RequestID) error {
+	for _, parent := range parents {
+		if parent == id {
+			return fmt.Errorf("%w: request %d depends on itself", ErrDependencyCycle, id)
+		}
+		cycle := false
+		if err := tx.Get(&cycle, dependsOnSQL, parent, id); err != nil {
+			return err
+		}
+		if cycle {
+			return fmt.Errorf("%w: request %d already depends on request %d", ErrDependencyCycle, parent, id)
+		}
+		if _, err := tx.Exec(`INSERT INTO request_dependencies (request_id, depends_on) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING`, id, parent); err != nil {
+			return err
+		}
+	}
+	if len(parents) == 0 {
+		return nil
+	}
+	// depends_on keeps the first dependency for the lanes and reports using it
+	if _, err := tx.Exec("UPDATE requests SET depends_on = $2 WHERE id = $1 AND depends_on IS NULL",
+		id, parents[0]); err != nil {
+		return err
+	}
+	_, err := tx.Exec(cancelIfDependencyCanceledSQL, id)
+	return err
+}
+
+// GetRequestIDsByUID returns the ids of the requests with the given uids. Unknown uids are an error
+func GetRequestIDsByUID(db sqlx.Queryer, uids []string) ([]RequestID, error) {
+	var rows []struct {
+		ID  RequestID `db:"id"`
+		UID string    `db:"uid"`
+	}
+	if err := sqlx.Select(db, &rows, "SELECT id, uid FROM requests WHERE uid = ANY($1)", pq.StringArray(uids)); err != nil {
+		return nil, err
+	}
+	ids := make(map[string]RequestID, len(rows))
+	for _, row := range rows {
+		ids[row.UID] = row.ID
+	}
+	var ret []RequestID
+	for _, uid := range uids {
+		id, ok := ids[uid]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrRequestNotFound, uid)
+		}
+		ret = append(ret, id)
+	}
+	return ret, nil
+}
+
+// AddDependenciesToRequest makes the request with the given uid depend on the requests with the parent
+// uids and, when policy is not empty, changes its dependency policy
+func AddDependenciesToRequest(db *sqlx.DB, uid string, parentUIDs []string, policy DependencyPolicy) error {
+	if !policy.Valid() {
+		return ErrInvalidDependencyPolicy
+	}
+	ids, err := GetRequestIDsByUID(db, []string{uid})
+	if err != nil {
+		return err
+	}
+	parents, err := GetRequestIDsByUID(db, parentUIDs)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if policy != "" {
+		if _, err := tx.Exec("UPDATE requests SET dependency_policy = $2 WHERE id = $1", ids[0], policy); err != nil {
+			return err
+		}
+	}
+	if err := AddRequestDependencies(tx, ids[0], parents); err != nil {
+		return err
+	}
+	// a new cancel policy applies to dependencies that already failed
+	if _, err := tx.Exec(cancelIfDependencyCanceledSQL, ids[0]); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DependencyNode is a request in a dependency tree. A request depending on several
+// requests appears under each of them
+type DependencyNode struct {
+	ID               RequestID         `db:"id" json:"-"`
+	UID              string            `db:"uid" json:"uid"`
+	BatchID          string            `db:"batchid" json:"batchId,omitempty"`
+	Status           RequestStatus     `db:"status" json:"status"`
+	ObjectType       string            `db:"object_type" json:"objectType,omitempty"`
+	Destination      string            `db:"destination" json:"destination"`
+	DependencyPolicy DependencyPolicy  `db:"dependency_policy" json:"dependencyPolicy"`
+	DependencyStatus string            `db:"dependency_status" json:"dependencyStatus,omitempty"`
+	Children         []*DependencyNode `db:"-" json:"children,omitempty"`
+}
+
+// DependencyEdge is a dependency between two requests identified by uid
+type DependencyEdge struct {
+	Request   string `db:"request" json:"request"`
+	DependsOn string `db:"depends_on" json:"dependsOn"`
+}
+
+// DependencyTree is the dependency graph of the requests in a batch. Requests from other
+// batches are included when requests in the batch depend on them or they depend on requests in the batch
+type DependencyTree struct {
+	Batch string            `json:"batch"`
+	Roots []*DependencyNode `json:"roots"`
+	Edges []DependencyEdge  `json:"edges"`
+}
+
+const batchDependencyEdgesSQL = `
+SELECT c.uid AS request, p.uid AS depends_on
+FROM request_dependencies d
+    JOIN requests c ON c.id = d.request_id
+    JOIN requests p ON p.id = d.depends_on
+WHERE c.batchid = $1 OR p.batchid = $1
+ORDER BY c.id, p.id`
+
+const dependencyNodesSQL = `
+SELECT r.id, r.uid, COALESCE(r.batchid, '') AS batchid, r.status, COALESCE(r.object_type, '') AS object_type,
+    COALESCE(s.name, '') AS destination, r.dependency_policy, status_of_dependence(r.id) AS dependency_status
+FROM requests r LEFT JOIN servers s ON s.id = r.destination
+WHERE r.batchid = $1 OR r.uid = ANY($2)
+ORDER BY r.id`
+
+// GetBatchDependencyTree returns the dependency tree for the requests in a batch
+func GetBatchDependencyTree(db *sqlx.DB, batch string) (DependencyTree, error) {
+	tree := DependencyTree{Batch: batch, Roots: []*DependencyNode{}, Edges: []DependencyEdge{}}
+	if err := db.Select(&tree.Edges, batchDependencyEdgesSQL, batch); err != nil {
+		return tree, err
+	}
+	var uids pq.StringArray
+	for _, e := range tree.Edges {
+		uids = append(uids, e.Request, e.DependsOn)
+	}
+	var nodes []DependencyNode
+	if err := db.Select(&nodes, dependencyNodesSQL, batch, uids); err != nil {
+		return tree, err
+	}
+	if len(nodes) == 0 {
+		return tree, sql.ErrNoRows
+	}
+
+	byUID := make(map[string]DependencyNode, len(nodes))
+	for _, n := range nodes {
+		byUID[n.UID] = n
+	}
+	children := make(map[string][]string)
+	hasParent := make(map[string]bool)
+	for _, e := range tree.Edges {
+		children[e.DependsOn] = append(children[e.DependsOn], e.Request)
+		hasParent[e.Request] = true
+	}
+	var build func(uid string, path map[string]bool) *DependencyNode
+	build = func(uid string, path map[string]bool) *DependencyNode {
+		n := byUID[uid]
+		node := &n
+		path[uid] = true
+		for _, child := range children[uid] {
+			if path[child] { // only possible with dependencies added outside the API
+				log.WithFields(log.Fields{"request": uid, "child": child}).Warn("Dependency cycle in request graph")
+				continue
+			}
+			node.Children = append(node.Children, build(child, path))
+		}
+		delete(path, uid)
+		return node
+	}
+	for _, n := range nodes {
+		if !hasParent[n.UID] {
+			tree.Roots = append(tree.Roots, build(n.UID, map[string]bool{}))
+		}
+	}
+	return tree, nil
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -33,8 +34,30 @@ const (
 	RequestStatusCompleted = RequestStatus("completed")
 	RequestStatusFailed    = RequestStatus("failed")
 	RequestStatusCanceled  = RequestStatus("canceled")
+	RequestStatusUnknown   = RequestStatus("unknown") // send interrupted, outcome to be reconciled
+	RequestStatusPartial   = RequestStatus("partial") // imported but with some values ignored
+	RequestStatusError     = RequestStatus("error")   // rejected by the server, not retried
 )
 
+// constants for the request priority. Higher priorities are sent first within a lane
+const (
+	RequestPriorityLow    = -10 // e.g. historical backfills
+	RequestPriorityNormal = 0
+	RequestPriorityHigh   = 10 // e.g. urgent metadata fixes
+)
+
+// ErrInvalidPriority is returned for a priority that is not a whole number
+var ErrInvalidPriority = errors.New("priority must be a whole number")
+
+// ParsePriority reads a request priority, clamping it to RequestPriorityLow..RequestPriorityHigh
+func ParsePriority(value string) (int, error) {
+	priority, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidPriority, value)
+	}
+	return min(max(priority, RequestPriorityLow), RequestPriorityHigh), nil
+}
+
 // Request represents our requests queue in the database
 type Request struct {
 	r struct {
@@ -42,6 +65,7 @@ type Request struct {
 		UID                string        `db:"uid" json:"uid"`
 		BatchID            string        `db:"batchid" json:"batchId,omitempty"`
 		DependsOn          dbutils.Int   `db:"depends_on" json:"dependsOn,omitempty"`
+		DependencyPolicy   string        `db:"dependency_policy" json:"dependencyPolicy,omitempty"`
 		Source             int           `db:"source" json:"source" validate:"required"`
 		Destination        int           `db:"destination" json:"destination" validate:"required"`
 		CCServers          pq.Int64Array `db:"cc_servers" json:"CCServers,omitempty"`
@@ -71,6 +95,7 @@ type Request struct {
 		BodyIsQueryParams  bool          `db:"body_is_query_param" json:"bodyIsQueryParams,omitempty"` // whether body is to be used a query parameters
 		SubmissionID       string        `db:"submissionid" json:"submissionId,omitempty"`             // a reference ID is source system
 		URLSuffix          string        `db:"url_suffix" json:"urlSuffix,omitempty"`
+		Priority           int           `db:"priority" json:"priority,omitempty"`
 		AsyncJobID         string        `db:"async_jobid" json:"AsyncJobID,omitempty"`
 		AsyncResponse      string        `db:"async_response" json:"AsyncResponse,omitempty"`
 		AsyncStatus        string        `db:"async_status" json:"AsyncStatus,omitempty"`
@@ -114,6 +139,9 @@ func (r *Request) RawMsg() string { return r.r.RawMsg }
 // URLSurffix returns the url surffix used when submitting request
 func (r *Request) URLSurffix() string { return r.r.URLSuffix }
 
+// Priority returns the priority of the request within its lane
+func (r *Request) Priority() int { return r.r.Priority }
+
 // Source return id of source app
 func (r *Request) Source() int { return r.r.Source }
 
@@ -153,6 +181,11 @@ func NewRequest(c *gin.Context, db *sqlx.DB) (Request, error) {
 	}
 	r.ReportType = c.Query("reportType")
 	r.ObjectType = c.Query("objectType")
+	priority, err := ParsePriority(c.DefaultQuery("priority", "0"))
+	if err != nil {
+		return *req, err
+	}
+	r.Priority = priority
 	r.Errors = c.Query("extras")
 	r.District = c.Query("district")
 	ccList := c.DefaultQuery("cc", config.AirQoIntegratorConf.API.AIRQOCCDHIS2Servers)
@@ -165,6 +198,11 @@ func NewRequest(c *gin.Context, db *sqlx.DB) (Request, error) {
 	r.CCServers = validServerIDs
 
 	r.Status = RequestStatusReady
+	if err := checkAllowedSource(db, r.Source, r.Destination); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"source": c.Query("source"), "destination": c.Query("destination")}).Warn("Request rejected")
+		return *req, err
+	}
 
 	switch r.ContentType {
 	case "application/json", "application/json-patch+json", "application/geo+json":
@@ -191,7 +229,7 @@ func NewRequest(c *gin.Context, db *sqlx.DB) (Request, error) {
 		r.Body = string(body)
 	}
 
-	_, err := db.NamedExec(insertRequestSQL, r)
+	_, err = db.NamedExec(insertRequestSQL, r)
 	if err != nil {
 		log.WithError(err).Error("Error INSERTING Request")
 	}
@@ -227,9 +265,24 @@ func NewRequestFromPOST(c *gin.Context, db *sqlx.DB) (Request, error) {
 		SubmissionID: c.DefaultQuery("submission_id", ""),
 		District:     c.DefaultQuery("district", ""),
 		CCServers:    strings.Split(c.DefaultQuery("cc_servers", ""), ","),
+		ObjectType:   c.DefaultQuery("object_type", ""),
 		// Body:      string(reqBody), ObjectType: "ORGANISATION_UNIT", ReportType: "OU",
 	}
 
+	priority, err := ParsePriority(c.DefaultQuery("priority", "0"))
+	if err != nil {
+		return *req, err
+	}
+	reqF.Priority = priority
+	reqF.DependencyPolicy = c.DefaultQuery("dependency_policy", "")
+	if dependsOn := c.DefaultQuery("depends_on", ""); dependsOn != "" { // comma separated request uids
+		dependencies, err := GetRequestIDsByUID(db, strings.Split(dependsOn, ","))
+		if err != nil {
+			return *req, err
+		}
+		reqF.Dependencies = dependencies
+	}
+
 	// sourceName :=
 	switch contentType {
 	case "application/json", "application/json-patch+json", "application/geo+json":
@@ -240,7 +293,11 @@ func NewRequestFromPOST(c *gin.Context, db *sqlx.DB) (Request, error) {
 		b, _ := json.Marshal(body)
 		// fmt.Println(string(b))
 		reqF.Body = string(b)
-		*req, _ = reqF.Save(db)
+		saved, err := reqF.Save(db)
+		if err != nil {
+			return *req, err
+		}
+		*req = saved
 		// log.WithField("New Server", s).Info("Going to create new server")
 	default:
 		//
@@ -317,10 +374,11 @@ const insertRequestSQL = `
 INSERT INTO 
 requests (source, destination, depends_on, uid, batchid, ctype, body, body_is_query_param, period, week, month, year,
 			raw_msg, msisdn, facility, district, report_type, object_type, extras, url_suffix, cc_servers,
-			created, updated) 
+			priority, dependency_policy, created, updated) 
 	VALUES(:source, :destination, :depends_on, :uid, :batchid, :ctype, :body, :body_is_query_param, :period,
 			:week, :month, :year, :raw_msg, :msisdn, :facility, :district, :report_type, :object_type,
-			:extras, :url_suffix, :cc_servers, now(), now()) RETURNING id`
+			:extras, :url_suffix, :cc_servers, :priority, COALESCE(NULLIF(:dependency_policy, ''), 'wait'),
+			now(), now()) RETURNING id`
 
 type RequestForm struct {
 	ID                RequestID   `db:"id" json:"-"`
@@ -329,6 +387,8 @@ type RequestForm struct {
 	Source            string      `uri:"source" db:"source" json:"source" validate:"required"`
 	Destination       string      `uri:"destination" db:"destination" json:"destination" validate:"required"`
 	DependsOn         dbutils.Int `db:"depends_on" json:"dependsOn,omitempty"`
+	Dependencies      []RequestID `db:"-" json:"dependencies,omitempty"`                     // further requests this request depends on
+	DependencyPolicy  string      `db:"dependency_policy" json:"dependencyPolicy,omitempty"` // cancel, wait (default) or proceed
 	CCServers         []string    `db:"cc_servers" json:"CCServers,omitempty"`
 	ContentType       string      `db:"ctype" json:"contentType,omitempty" validate:"required"`
 	Body              string      `db:"body" json:"body" validate:"required"`
@@ -349,6 +409,7 @@ type RequestForm struct {
 	BodyIsQueryParams bool        `db:"body_is_query_param" json:"bodyIsQueryParams,omitempty"` // whether body is to be used a query parameters
 	SubmissionID      string      `db:"submissionid" json:"submissionId,omitempty"`             // a reference ID is source system
 	URLSuffix         string      `db:"url_suffix" json:"urlSuffix,omitempty"`
+	Priority          int         `db:"priority" json:"priority,omitempty"`
 }
 
 func (rq *RequestForm) Save(db *sqlx.DB) (Request, error) {
@@ -356,11 +417,15 @@ func (rq *RequestForm) Save(db *sqlx.DB) (Request, error) {
 	r := &req.r
 
 	r.DependsOn = rq.DependsOn
+	if !DependencyPolicy(rq.DependencyPolicy).Valid() {
+		return *req, ErrInvalidDependencyPolicy
+	}
+	r.DependencyPolicy = rq.DependencyPolicy
 	// r.Source = int(GetServerIDByName(rq.Source))
 	// r.Destination = int(GetServerIDByName(rq.Destination))
-	source := ServerMapByName[rq.Source]
+	source, _ := LookupServerByName(rq.Source)
 	r.Source = int(source.ID())
-	destination := ServerMapByName[rq.Destination]
+	destination, _ := LookupServerByName(rq.Destination)
 	r.Destination = int(destination.ID())
 	if r.Source == 0 {
 		return *req, errors.New(fmt.Sprintf("Source server %s not found!", rq.Source))
@@ -369,6 +434,11 @@ func (rq *RequestForm) Save(db *sqlx.DB) (Request, error) {
 		return *req, errors.New(fmt.Sprintf("Destination server %s not found!", rq.Destination))
 
 	}
+	if err := checkAllowedSource(db, r.Source, r.Destination); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"source": rq.Source, "destination": rq.Destination}).Warn("Request rejected")
+		return *req, err
+	}
 
 	if len(rq.CCServers) > 0 && rq.CCServers[0] == "" {
 		r.CCServers = []int64{}
@@ -395,13 +465,20 @@ func (rq *RequestForm) Save(db *sqlx.DB) (Request, error) {
 	}
 	r.ReportType = rq.ReportType
 	r.ObjectType = rq.ObjectType
+	r.Priority = rq.Priority
 	r.Errors = rq.Extras
 	r.District = rq.District
 	r.Body = rq.Body
 
-	rows, err := db.NamedQuery(insertRequestSQL, r)
+	tx, err := db.Beginx()
+	if err != nil {
+		return *req, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	rows, err := tx.NamedQuery(insertRequestSQL, r)
 	if err != nil {
 		log.WithError(err).Error("Error INSERTING Request")
+		return *req, err
 	}
 
 	for rows.Next() {
@@ -410,7 +487,15 @@ func (rq *RequestForm) Save(db *sqlx.DB) (Request, error) {
 		r.ID = RequestID(reqId.Int64)
 	}
 	_ = rows.Close()
+	// depends_on is added to the graph by the insert trigger, the rest here
+	if err := AddRequestDependencies(tx, r.ID, rq.Dependencies); err != nil {
+		log.WithError(err).WithField("uid", r.UID).Warn("Request dependencies rejected")
+		return *req, err
+	}
 	// commit the request
+	if err := tx.Commit(); err != nil {
+		return *req, err
+	}
 
 	return *req, nil
 }
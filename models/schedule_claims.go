@@ -0,0 +1,114 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"time"
+)
+
+// claimDueSchedulesSQL sets due schedules, and those asked to run now, running and returns them.
+// Rows being claimed by another integrator are skipped so each schedule is dispatched once
+const claimDueSchedulesSQL = `
+UPDATE schedules SET status = 'running', claimed_at = NOW(), run_requested_at = NULL
+WHERE id IN (
+    SELECT id FROM schedules
+    WHERE status = 'ready' AND ((next_run_at <= NOW() AND is_active = TRUE) OR run_requested_at IS NOT NULL)
+    ORDER BY run_requested_at NULLS LAST, next_run_at, id
+    LIMIT $1
+    FOR UPDATE SKIP LOCKED)
+RETURNING id`
+
+// ClaimDueSchedules claims up to limit due schedules for this integrator to run
+func ClaimDueSchedules(ctx context.Context, db *sqlx.DB, limit int) ([]int64, error) {
+	var ids []int64
+	err := db.SelectContext(ctx, &ids, claimDueSchedulesSQL, limit)
+	return ids, err
+}
+
+// ReleaseSchedules makes claimed schedules that were not run, or whose run did not
+// record a new status, ready again
+func ReleaseSchedules(db *sqlx.DB, ids []int64) error {
+	_, err := db.Exec(`UPDATE schedules SET status = 'ready', claimed_at = NULL
+		WHERE id = ANY($1) AND status = 'running'`, pq.Int64Array(ids))
+	return err
+}
+
+// RenewScheduleClaim keeps a running schedule's claim fresh so the run is not taken as abandoned
+func RenewScheduleClaim(db *sqlx.DB, id int64) error {
+	_, err := db.Exec(`UPDATE schedules SET claimed_at = NOW() WHERE id = $1 AND status = 'running'`, id)
+	return err
+}
+
+// ReapStaleSchedules makes running schedules whose claim was not renewed within timeout ready again, e.g.
+// after the integrator running them crashed, and ends their open runs as errors. It returns the schedules recovered
+func ReapStaleSchedules(db *sqlx.DB, timeout time.Duration) ([]int64, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var ids []int64
+	if err := tx.Select(&ids, `UPDATE schedules SET status = 'ready', claimed_at = NULL
+		WHERE status = 'running' AND claimed_at < NOW() - make_interval(secs => $1)
+		RETURNING id`, timeout.Seconds()); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if _, err := tx.Exec(`UPDATE schedule_runs SET (finished, outcome, message) = (NOW(), $1, $2)
+		WHERE schedule_id = ANY($3) AND outcome = $4`, ScheduleRunError, "Run abandoned after the schedule run timeout",
+		pq.Int64Array(ids), ScheduleRunRunning); err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+// ErrScheduleRunning is returned when asking a schedule that is running to run now
+var ErrScheduleRunning = errors.New("schedule is running")
+
+// PauseSchedule stops a schedule from running until it is resumed
+func PauseSchedule(db *sqlx.DB, id int64) error {
+	return setScheduleActive(db, id, false)
+}
+
+// ResumeSchedule lets a paused schedule run again. Runs missed while paused are handled by its misfire policy
+func ResumeSchedule(db *sqlx.DB, id int64) error {
+	return setScheduleActive(db, id, true)
+}
+
+func setScheduleActive(db *sqlx.DB, id int64, active bool) error {
+	res, err := db.Exec(`UPDATE schedules SET is_active = $1, updated = NOW() WHERE id = $2`, active, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RunScheduleNow has the schedule run as soon as a consumer is free, paused or not. Its next_run_at, and
+// so its recurrence, is kept. A schedule that has finished, e.g. one that ran once, is made ready again
+func RunScheduleNow(db *sqlx.DB, id int64) error {
+	res, err := db.Exec(`UPDATE schedules SET run_requested_at = NOW(), status = 'ready', updated = NOW()
+		WHERE id = $1 AND status <> 'running'`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	exists := false
+	if err := db.Get(&exists, "SELECT EXISTS (SELECT 1 FROM schedules WHERE id = $1)", id); err != nil {
+		return err
+	}
+	if exists {
+		return ErrScheduleRunning
+	}
+	return sql.ErrNoRows
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// constants for what happens to the runs a schedule missed, e.g. while the integrator was down
+const (
+	MisfirePolicySkip    = "skip"     // run once and continue from the next occurrence after now
+	MisfirePolicyCatchUp = "catch_up" // run once for every missed occurrence
+)
+
+// maxCatchUpRuns bounds the runs a catch up schedule makes before skipping what remains
+const maxCatchUpRuns = 100
+
+// cronSpec parses the schedule's cron expression. Expressions have the standard five fields
+// or a descriptor such as @daily
+func (s *Schedule) cronSpec() (cron.Schedule, error) {
+	return cron.ParseStandard(s.CronExpression)
+}
+
+// ValidateRecurrence checks the recurrence settings of the schedule
+func (s *Schedule) ValidateRecurrence() error {
+	switch s.Repeat {
+	case "", "never", "hourly", "daily", "weekly", "monthly", "yearly":
+	case "interval":
+		if s.RepeatInterval <= 0 {
+			return errors.New("repeat_interval must be a positive number of seconds for interval schedules")
+		}
+	case "cron":
+		if _, err := s.cronSpec(); err != nil {
+			return fmt.Errorf("invalid cron expression '%s': %w", s.CronExpression, err)
+		}
+	default:
+		return fmt.Errorf("unknown repeat '%s'", s.Repeat)
+	}
+	switch s.MisfirePolicy {
+	case "", MisfirePolicySkip, MisfirePolicyCatchUp:
+	default:
+		return fmt.Errorf("misfire policy must be %s or %s", MisfirePolicySkip, MisfirePolicyCatchUp)
+	}
+	return nil
+}
+
+// Validate checks the schedule before it is saved
+func (s *Schedule) Validate() error {
+	if err := s.ValidateParams(); err != nil {
+		return err
+	}
+	if err := s.ValidateRecurrence(); err != nil {
+		return err
+	}
+	return s.ValidateCommand()
+}
+
+// NextOccurrence returns the occurrence of a repeating schedule following t, in the deployment's
+// time zone so that daily schedules keep their local time across daylight saving changes
+func (s *Schedule) NextOccurrence(t time.Time) (time.Time, bool) {
+	t = t.In(Location)
+	switch s.Repeat {
+	case "hourly":
+		return t.Add(time.Hour), true
+	case "daily":
+		return t.AddDate(0, 0, 1), true
+	case "weekly":
+		return t.AddDate(0, 0, 7), true
+	case "monthly":
+		return t.AddDate(0, 1, 0), true
+	case "yearly":
+		return t.AddDate(1, 0, 0), true
+	case "interval":
+		if s.RepeatInterval > 0 {
+			return t.Add(time.Duration(s.RepeatInterval) * time.Second), true
+		}
+	case "cron":
+		spec, err := s.cronSpec()
+		if err == nil {
+			return spec.Next(t), true
+		}
+		log.WithError(err).WithField("scheduleID", s.ID).Error("Invalid schedule cron expression")
+	}
+	return time.Time{}, false
+}
+
+// FirstRun returns when a new schedule runs first: its first_run_at when set, otherwise now
+// or, for cron schedules, the first occurrence of the expression
+func (s *Schedule) FirstRun(now time.Time) time.Time {
+	if s.FirstRunAt.Valid {
+		return s.FirstRunAt.Time
+	}
+	if s.Repeat == "cron" {
+		if next, ok := s.NextOccurrence(now); ok {
+			return next
+		}
+	}
+	return now
+}
+
+// NextRun returns when the schedule runs after the run that was due at its next_run_at. With the
+// skip policy missed occurrences are dropped, with catch up the schedule runs for each of them
+func (s *Schedule) NextRun(now time.Time) (time.Time, bool) {
+	due := s.NextRunAt
+	if due.IsZero() || due.After(now) {
+		due = now
+	}
+	next, ok := s.NextOccurrence(due)
+	if !ok {
+		return time.Time{}, false
+	}
+	if !next.After(now) && s.MisfirePolicy == MisfirePolicyCatchUp {
+		if s.occurrencesUntil(next, now) <= maxCatchUpRuns {
+			return next, true // due again straight away
+		}
+		log.WithField("scheduleID", s.ID).Warn("Too many missed schedule runs to catch up")
+	}
+	missed := 0
+	for !next.After(now) {
+		if next, ok = s.NextOccurrence(next); !ok {
+			return time.Time{}, false
+		}
+		missed++
+	}
+	if missed > 0 {
+		log.WithFields(log.Fields{
+			"scheduleID": s.ID, "missedRuns": missed, "nextRun": next}).Info("Skipped missed schedule runs")
+	}
+	return next, true
+}
+
+// occurrencesUntil counts the occurrences from next until now, stopping past maxCatchUpRuns
+func (s *Schedule) occurrencesUntil(next, now time.Time) int {
+	count := 0
+	for ok := true; ok && !next.After(now) && count <= maxCatchUpRuns; next, ok = s.NextOccurrence(next) {
+		count++
+	}
+	return count
+}
+
+// FinishRun records a run of the schedule. Repeating schedules become ready for their next run
+// while schedules that run once keep the status of their run and are deactivated. A run made
+// before the schedule was due, i.e. asked for with run-now, leaves the recurrence unchanged
+func (s *Schedule) FinishRun(tx *sqlx.Tx, status string) error {
+	now := time.Now().In(Location)
+	s.LastRunAt = NullTime{sql.NullTime{Time: now, Valid: true}}
+	s.Updated = now
+	s.advance(now, status)
+	// is_active is only ever cleared here so a schedule paused while running stays paused
+	_, err := tx.NamedExec(`UPDATE schedules SET (status, next_run_at, last_run_at, is_active, updated)
+		= (:status, :next_run_at, :last_run_at, is_active AND :is_active, :updated) WHERE id = :id`, s)
+	return err
+}
+
+// advance sets the status and next run of the schedule once a run ending at now had the status given
+func (s *Schedule) advance(now time.Time, status string) {
+	if s.NextRunAt.After(now) {
+		s.Status = "ready"
+	} else if next, ok := s.NextRun(now); ok {
+		s.Status = "ready"
+		s.NextRunAt = next
+	} else {
+		s.Status = status
+		s.IsActive = false
+	}
+}
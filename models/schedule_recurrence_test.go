@@ -0,0 +1,109 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNextRun(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	hourly := func(policy string, nextRunAt time.Time) Schedule {
+		return Schedule{Repeat: "interval", RepeatInterval: 3600, MisfirePolicy: policy, NextRunAt: nextRunAt}
+	}
+	daily6am := func(policy string, nextRunAt time.Time) Schedule {
+		return Schedule{Repeat: "cron", CronExpression: "0 6 * * *", MisfirePolicy: policy, NextRunAt: nextRunAt}
+	}
+	tests := []struct {
+		name     string
+		schedule Schedule
+		want     time.Time
+		wantOK   bool
+	}{
+		{"interval on time", hourly(MisfirePolicySkip, now.Add(-time.Minute)), now.Add(59 * time.Minute), true},
+		{"interval without a next run", hourly(MisfirePolicySkip, time.Time{}), now.Add(time.Hour), true},
+		{"interval run before it was due", hourly(MisfirePolicySkip, now.Add(30*time.Minute)), now.Add(time.Hour), true},
+		{"skip drops missed runs", hourly(MisfirePolicySkip, now.Add(-5*time.Hour-30*time.Minute)),
+			now.Add(30 * time.Minute), true},
+		{"default policy skips", hourly("", now.Add(-5*time.Hour-30*time.Minute)), now.Add(30 * time.Minute), true},
+		{"catch_up runs the next missed run", hourly(MisfirePolicyCatchUp, now.Add(-5*time.Hour-30*time.Minute)),
+			now.Add(-4*time.Hour - 30*time.Minute), true},
+		{"catch_up up to maxCatchUpRuns missed runs",
+			hourly(MisfirePolicyCatchUp, now.Add(-maxCatchUpRuns*time.Hour-30*time.Minute)),
+			now.Add(-(maxCatchUpRuns-1)*time.Hour - 30*time.Minute), true},
+		{"catch_up skips more than maxCatchUpRuns missed runs",
+			hourly(MisfirePolicyCatchUp, now.Add(-(maxCatchUpRuns+1)*time.Hour-30*time.Minute)),
+			now.Add(30 * time.Minute), true},
+		{"cron on time", daily6am(MisfirePolicySkip, time.Date(2024, 1, 10, 6, 0, 0, 0, time.UTC)),
+			time.Date(2024, 1, 11, 6, 0, 0, 0, time.UTC), true},
+		{"cron skip", daily6am(MisfirePolicySkip, time.Date(2024, 1, 5, 6, 0, 0, 0, time.UTC)),
+			time.Date(2024, 1, 11, 6, 0, 0, 0, time.UTC), true},
+		{"cron catch_up", daily6am(MisfirePolicyCatchUp, time.Date(2024, 1, 5, 6, 0, 0, 0, time.UTC)),
+			time.Date(2024, 1, 6, 6, 0, 0, 0, time.UTC), true},
+		{"invalid cron", Schedule{Repeat: "cron", CronExpression: "not cron", NextRunAt: now}, time.Time{}, false},
+		{"never repeats", Schedule{Repeat: "never", NextRunAt: now}, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.schedule.NextRun(now)
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("got %s, %t, want %s, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestScheduleNextOccurrenceKeepsLocalTimeAcrossDST(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+	saved := Location
+	Location = london
+	defer func() { Location = saved }()
+
+	// the clocks go forward on 31 March 2024
+	s := Schedule{Repeat: "daily"}
+	got, _ := s.NextOccurrence(time.Date(2024, 3, 30, 9, 0, 0, 0, london))
+	if want := time.Date(2024, 3, 31, 9, 0, 0, 0, london); !got.Equal(want) {
+		t.Errorf("daily: got %s, want %s", got, want)
+	}
+	s = Schedule{Repeat: "cron", CronExpression: "0 9 * * *"}
+	got, _ = s.NextOccurrence(time.Date(2024, 3, 30, 9, 0, 0, 0, london))
+	if want := time.Date(2024, 3, 31, 9, 0, 0, 0, london); !got.Equal(want) {
+		t.Errorf("cron: got %s, want %s", got, want)
+	}
+}
+
+func TestScheduleAdvance(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		schedule      Schedule
+		wantStatus    string
+		wantNextRunAt time.Time
+		wantActive    bool
+	}{
+		{"run-now keeps the recurrence",
+			Schedule{Repeat: "daily", NextRunAt: now.Add(3 * time.Hour), IsActive: true},
+			"ready", now.Add(3 * time.Hour), true},
+		{"run-now of a schedule that runs once keeps it",
+			Schedule{Repeat: "never", NextRunAt: now.Add(3 * time.Hour), IsActive: true},
+			"ready", now.Add(3 * time.Hour), true},
+		{"repeating schedule moves to its next run",
+			Schedule{Repeat: "daily", NextRunAt: now.Add(-time.Minute), IsActive: true},
+			"ready", now.Add(-time.Minute).AddDate(0, 0, 1), true},
+		{"schedule that runs once keeps its run's status and is deactivated",
+			Schedule{Repeat: "never", NextRunAt: now.Add(-time.Minute), IsActive: true},
+			ScheduleRunFailed, now.Add(-time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.schedule
+			s.advance(now, ScheduleRunFailed)
+			if s.Status != tt.wantStatus || !s.NextRunAt.Equal(tt.wantNextRunAt) || s.IsActive != tt.wantActive {
+				t.Errorf("got %s, %s, %t, want %s, %s, %t",
+					s.Status, s.NextRunAt, s.IsActive, tt.wantStatus, tt.wantNextRunAt, tt.wantActive)
+			}
+		})
+	}
+}
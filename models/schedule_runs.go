@@ -0,0 +1,113 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+// outcomes of a schedule run
+const (
+	ScheduleRunRunning   = "running"
+	ScheduleRunCompleted = "completed"
+	ScheduleRunFailed    = "failed"
+	ScheduleRunError     = "error"
+	ScheduleRunPending   = "pending" // an async job still being processed by the destination
+	ScheduleRunExpired   = "expired"
+	ScheduleRunSkipped   = "skipped"
+)
+
+// ScheduleRun is a single run of a schedule
+type ScheduleRun struct {
+	ID         int64         `db:"id" json:"id"`
+	ScheduleID int64         `db:"schedule_id" json:"scheduleId"`
+	Started    time.Time     `db:"started" json:"started"`
+	Finished   NullTime      `db:"finished" json:"finished"`
+	Outcome    string        `db:"outcome" json:"outcome"`
+	Message    string        `db:"message" json:"message"`
+	RequestIDs pq.Int64Array `db:"request_ids" json:"requestIds"`
+	mu         sync.Mutex
+}
+
+// StartScheduleRun records the start of a run of the schedule
+func StartScheduleRun(db *sqlx.DB, scheduleID int64) (*ScheduleRun, error) {
+	run := &ScheduleRun{
+		ScheduleID: scheduleID, Started: time.Now().In(Location), Outcome: ScheduleRunRunning, RequestIDs: pq.Int64Array{}}
+	err := db.Get(&run.ID, `INSERT INTO schedule_runs (schedule_id, started, outcome)
+		VALUES ($1, $2, $3) RETURNING id`, scheduleID, run.Started, run.Outcome)
+	return run, err
+}
+
+// AddRequests links requests to the run. It can be called on a nil run
+func (r *ScheduleRun) AddRequests(ids ...RequestID) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range ids {
+		r.RequestIDs = append(r.RequestIDs, int64(id))
+	}
+}
+
+// SetOutcome sets the outcome of the run and its message
+func (r *ScheduleRun) SetOutcome(outcome, message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Outcome, r.Message = outcome, message
+}
+
+// Finish records the end of the run. A run whose outcome was never set ends as an error
+func (r *ScheduleRun) Finish(db *sqlx.DB) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Outcome == ScheduleRunRunning {
+		r.Outcome = ScheduleRunError
+		if r.Message == "" {
+			r.Message = "Run ended without an outcome"
+		}
+	}
+	r.Finished = NullTime{sql.NullTime{Time: time.Now().In(Location), Valid: true}}
+	_, err := db.Exec(`UPDATE schedule_runs SET (finished, outcome, message, request_ids) = ($1, $2, $3, $4)
+		WHERE id = $5`, r.Finished, r.Outcome, r.Message, r.RequestIDs, r.ID)
+	return err
+}
+
+type scheduleRunKey struct{}
+
+// WithScheduleRun returns a context carrying the run so the tasks it runs can link their requests to it
+func WithScheduleRun(ctx context.Context, run *ScheduleRun) context.Context {
+	return context.WithValue(ctx, scheduleRunKey{}, run)
+}
+
+// ScheduleRunFromContext returns the run carried by ctx or nil
+func ScheduleRunFromContext(ctx context.Context) *ScheduleRun {
+	run, _ := ctx.Value(scheduleRunKey{}).(*ScheduleRun)
+	return run
+}
+
+// CountScheduleRuns returns the number of runs of the schedule
+func CountScheduleRuns(db *sqlx.DB, scheduleID int64) (int64, error) {
+	var count int64
+	err := db.Get(&count, "SELECT COUNT(*) FROM schedule_runs WHERE schedule_id = $1", scheduleID)
+	return count, err
+}
+
+// ListScheduleRuns returns the runs of the schedule, latest first
+func ListScheduleRuns(db *sqlx.DB, scheduleID, limit, offset int64) ([]*ScheduleRun, error) {
+	runs := []*ScheduleRun{}
+	err := db.Select(&runs, `SELECT id, schedule_id, started, finished, outcome, message, request_ids
+		FROM schedule_runs WHERE schedule_id = $1 ORDER BY started DESC, id DESC LIMIT $2 OFFSET $3`,
+		scheduleID, limit, offset)
+	return runs, err
+}
+
+// GetRequestIDsByBatch returns the ids of the requests in a batch
+func GetRequestIDsByBatch(db sqlx.Queryer, batchID string) ([]RequestID, error) {
+	var ids []RequestID
+	err := sqlx.Select(db, &ids, "SELECT id FROM requests WHERE batchid = $1 ORDER BY id", batchID)
+	return ids, err
+}
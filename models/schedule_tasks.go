@@ -0,0 +1,61 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"sort"
+	"sync"
+)
+
+// ScheduleTask is an internal task run by command schedules. ctx is cancelled when the integrator
+// stops taking new work and sendCtx when in-flight sends must be aborted. args are the schedule's
+// command args. The returned message is recorded as the outcome of the run
+type ScheduleTask func(ctx, sendCtx context.Context, db *sqlx.DB, args json.RawMessage) (string, error)
+
+var (
+	scheduleTasks      = map[string]ScheduleTask{}
+	scheduleTasksMutex sync.RWMutex
+)
+
+// RegisterScheduleTask makes a task available to command schedules under name
+func RegisterScheduleTask(name string, task ScheduleTask) {
+	scheduleTasksMutex.Lock()
+	defer scheduleTasksMutex.Unlock()
+	scheduleTasks[name] = task
+}
+
+// GetScheduleTask returns the task registered under name
+func GetScheduleTask(name string) (ScheduleTask, bool) {
+	scheduleTasksMutex.RLock()
+	defer scheduleTasksMutex.RUnlock()
+	task, ok := scheduleTasks[name]
+	return task, ok
+}
+
+// ScheduleTaskNames returns the names of the registered tasks
+func ScheduleTaskNames() []string {
+	scheduleTasksMutex.RLock()
+	defer scheduleTasksMutex.RUnlock()
+	names := make([]string, 0, len(scheduleTasks))
+	for name := range scheduleTasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateCommand checks that a command schedule runs a registered task with JSON args
+func (s *Schedule) ValidateCommand() error {
+	if s.ScheduleType != "command" {
+		return nil
+	}
+	if _, ok := GetScheduleTask(s.Command); !ok {
+		return fmt.Errorf("unknown command '%s'. Available commands: %v", s.Command, ScheduleTaskNames())
+	}
+	if s.CommandArgs != "" && !json.Valid([]byte(s.CommandArgs)) {
+		return fmt.Errorf("command args of '%s' are not valid JSON", s.Command)
+	}
+	return nil
+}
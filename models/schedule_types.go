@@ -0,0 +1,231 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ParamSchema is the subset of JSON Schema describing the params of a schedule type
+type ParamSchema struct {
+	Type                 string                  `json:"type,omitempty"` // object, array, string, integer, number or boolean
+	Description          string                  `json:"description,omitempty"`
+	Properties           map[string]*ParamSchema `json:"properties,omitempty"`
+	Required             []string                `json:"required,omitempty"`
+	AdditionalProperties *ParamSchema            `json:"additionalProperties,omitempty"` // schema of properties not listed
+	Items                *ParamSchema            `json:"items,omitempty"`
+	Enum                 []any                   `json:"enum,omitempty"`
+	Minimum              *float64                `json:"minimum,omitempty"`
+	Maximum              *float64                `json:"maximum,omitempty"`
+	MinLength            int                     `json:"minLength,omitempty"`
+	Pattern              string                  `json:"pattern,omitempty"`
+	Default              any                     `json:"default,omitempty"`
+}
+
+// FieldError is a problem with one field of the schedule params
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ParamsError lists the fields of the schedule params that do not match the schema of the schedule type
+type ParamsError struct {
+	ScheduleType string
+	Fields       []FieldError
+}
+
+func (e *ParamsError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		messages = append(messages, f.Field+": "+f.Message)
+	}
+	return fmt.Sprintf("invalid params for %s schedule: %s", e.ScheduleType, strings.Join(messages, "; "))
+}
+
+// Validate checks value, decoded from JSON, against the schema and returns the field errors found under path
+func (p *ParamSchema) Validate(path string, value any) []FieldError {
+	if p == nil {
+		return nil
+	}
+	fail := func(format string, args ...any) []FieldError {
+		return []FieldError{{Field: path, Message: fmt.Sprintf(format, args...)}}
+	}
+	if len(p.Enum) > 0 {
+		found := false
+		for _, e := range p.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("must be one of %v", p.Enum)
+		}
+	}
+	switch p.Type {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return fail("must be an object")
+		}
+		var errs []FieldError
+		for _, name := range p.Required {
+			if _, ok := obj[name]; !ok {
+				errs = append(errs, FieldError{Field: joinParamPath(path, name), Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			schema, ok := p.Properties[name]
+			if !ok {
+				schema = p.AdditionalProperties
+				if schema == nil && p.Properties != nil {
+					errs = append(errs, FieldError{Field: joinParamPath(path, name), Message: "is not a known parameter"})
+					continue
+				}
+			}
+			errs = append(errs, schema.Validate(joinParamPath(path, name), obj[name])...)
+		}
+		return errs
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			return fail("must be an array")
+		}
+		var errs []FieldError
+		for i, item := range items {
+			errs = append(errs, p.Items.Validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+		}
+		return errs
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		if len(s) < p.MinLength {
+			return fail("must have at least %d characters", p.MinLength)
+		}
+		if p.Pattern != "" {
+			if re, err := regexp.Compile(p.Pattern); err == nil && !re.MatchString(s) {
+				return fail("must match %s", p.Pattern)
+			}
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok {
+			return fail("must be a number")
+		}
+		if p.Type == "integer" && n != math.Trunc(n) {
+			return fail("must be an integer")
+		}
+		if p.Minimum != nil && n < *p.Minimum {
+			return fail("must be at least %v", *p.Minimum)
+		}
+		if p.Maximum != nil && n > *p.Maximum {
+			return fail("must be at most %v", *p.Maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fail("must be a boolean")
+		}
+	}
+	return nil
+}
+
+func joinParamPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// ScheduleType describes a type of schedule and its params
+type ScheduleType struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Params      *ParamSchema `json:"params"`
+	Internal    bool         `json:"internal,omitempty"` // created by the integrator, not through the API
+}
+
+var (
+	scheduleTypes      = map[string]ScheduleType{}
+	scheduleTypesMutex sync.RWMutex
+)
+
+// RegisterScheduleType makes a schedule type and the schema of its params known
+func RegisterScheduleType(t ScheduleType) {
+	scheduleTypesMutex.Lock()
+	defer scheduleTypesMutex.Unlock()
+	scheduleTypes[t.Name] = t
+}
+
+// GetScheduleType returns the schedule type registered under name
+func GetScheduleType(name string) (ScheduleType, bool) {
+	scheduleTypesMutex.RLock()
+	defer scheduleTypesMutex.RUnlock()
+	t, ok := scheduleTypes[name]
+	return t, ok
+}
+
+// ScheduleTypes returns the registered schedule types sorted by name
+func ScheduleTypes() []ScheduleType {
+	scheduleTypesMutex.RLock()
+	defer scheduleTypesMutex.RUnlock()
+	types := make([]ScheduleType, 0, len(scheduleTypes))
+	for _, t := range scheduleTypes {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types
+}
+
+// ValidateParams checks the schedule's params against the schema of its type. Field problems are returned as a *ParamsError
+func (s *Schedule) ValidateParams() error {
+	t, ok := GetScheduleType(s.ScheduleType)
+	if !ok || t.Internal {
+		names := make([]string, 0)
+		for _, t := range ScheduleTypes() {
+			if !t.Internal {
+				names = append(names, t.Name)
+			}
+		}
+		return &ParamsError{ScheduleType: s.ScheduleType, Fields: []FieldError{
+			{Field: "scheduleType", Message: fmt.Sprintf("must be one of %v", names)}}}
+	}
+	var params any = map[string]any{}
+	if len(s.Params) > 0 && string(s.Params) != "null" {
+		if err := json.Unmarshal(s.Params, &params); err != nil {
+			return &ParamsError{ScheduleType: s.ScheduleType, Fields: []FieldError{
+				{Field: "params", Message: "must be valid JSON: " + err.Error()}}}
+		}
+	}
+	if errs := t.Params.Validate("", params); len(errs) > 0 {
+		for i := range errs {
+			errs[i].Field = joinParamPath("params", errs[i].Field)
+		}
+		return &ParamsError{ScheduleType: s.ScheduleType, Fields: errs}
+	}
+	return nil
+}
+
+func init() {
+	RegisterScheduleType(ScheduleType{
+		Name:        "command",
+		Description: "Runs an internal task named by command with the JSON command args",
+		Params:      &ParamSchema{Type: "object", Properties: map[string]*ParamSchema{}},
+	})
+	RegisterScheduleType(ScheduleType{
+		Name:        "dhis2_async_job_check",
+		Description: "Polls a DHIS2 async import job until the outcome of its request is known",
+		Params:      &ParamSchema{Type: "object"},
+		Internal:    true,
+	})
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParamSchemaValidate(t *testing.T) {
+	one, ten := 1.0, 10.0
+	schema := &ParamSchema{Type: "object", Required: []string{"method", "url"}, Properties: map[string]*ParamSchema{
+		"method":  {Type: "string", Enum: []any{"GET", "POST"}},
+		"url":     {Type: "string", MinLength: 1, Pattern: "^https?://"},
+		"retries": {Type: "integer", Minimum: &one, Maximum: &ten},
+		"ratio":   {Type: "number"},
+		"verbose": {Type: "boolean"},
+		"auth": {Type: "object", Required: []string{"method"}, Properties: map[string]*ParamSchema{
+			"method": {Type: "string", Enum: []any{"Basic", "Token"}},
+		}},
+		"headers": {Type: "object", AdditionalProperties: &ParamSchema{Type: "string"}},
+		"ids":     {Type: "array", Items: &ParamSchema{Type: "string", MinLength: 1}},
+	}}
+	tests := []struct {
+		name   string
+		params string
+		want   []FieldError
+	}{
+		{"valid", `{"method":"GET","url":"https://example.org","retries":3,"ratio":0.5,"verbose":true,
+			"auth":{"method":"Token"},"headers":{"X-Key":"v"},"ids":["a","b"]}`, nil},
+		{"not an object", `[]`, []FieldError{{"", "must be an object"}}},
+		{"required", `{"method":"GET"}`, []FieldError{{"url", "is required"}}},
+		{"enum", `{"method":"PUT","url":"https://example.org"}`,
+			[]FieldError{{"method", "must be one of [GET POST]"}}},
+		{"unknown property", `{"method":"GET","url":"https://example.org","extra":1}`,
+			[]FieldError{{"extra", "is not a known parameter"}}},
+		{"additional properties follow their schema", `{"method":"GET","url":"https://example.org","headers":{"X-Key":1}}`,
+			[]FieldError{{"headers.X-Key", "must be a string"}}},
+		{"integer", `{"method":"GET","url":"https://example.org","retries":1.5}`,
+			[]FieldError{{"retries", "must be an integer"}}},
+		{"number type", `{"method":"GET","url":"https://example.org","ratio":"half"}`,
+			[]FieldError{{"ratio", "must be a number"}}},
+		{"minimum", `{"method":"GET","url":"https://example.org","retries":0}`,
+			[]FieldError{{"retries", "must be at least 1"}}},
+		{"maximum", `{"method":"GET","url":"https://example.org","retries":11}`,
+			[]FieldError{{"retries", "must be at most 10"}}},
+		{"min length", `{"method":"GET","url":""}`, []FieldError{{"url", "must have at least 1 characters"}}},
+		{"pattern", `{"method":"GET","url":"ftp://example.org"}`, []FieldError{{"url", "must match ^https?://"}}},
+		{"boolean", `{"method":"GET","url":"https://example.org","verbose":"yes"}`,
+			[]FieldError{{"verbose", "must be a boolean"}}},
+		{"nested required and enum", `{"method":"GET","url":"https://example.org","auth":{}}`,
+			[]FieldError{{"auth.method", "is required"}}},
+		{"nested field path", `{"method":"GET","url":"https://example.org","auth":{"method":"Digest"}}`,
+			[]FieldError{{"auth.method", "must be one of [Basic Token]"}}},
+		{"array items", `{"method":"GET","url":"https://example.org","ids":["a",""]}`,
+			[]FieldError{{"ids[1]", "must have at least 1 characters"}}},
+		{"errors sorted by field", `{"verbose":1,"extra":true}`, []FieldError{
+			{"method", "is required"}, {"url", "is required"},
+			{"extra", "is not a known parameter"}, {"verbose", "must be a boolean"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params any
+			if err := json.Unmarshal([]byte(tt.params), &params); err != nil {
+				t.Fatal(err)
+			}
+			if got := schema.Validate("", params); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,6 @@
 package models
 
 import (
-	"airqo-integrator/clients"
 	"airqo-integrator/config"
 	"database/sql"
 	"encoding/json"
@@ -13,17 +12,11 @@ import (
 )
 
 var (
-	err      error
-	Location *time.Location
+	err error
+	// Location is the deployment's time zone, set by Init. UTC until then
+	Location = time.UTC
 )
 
-func init() {
-	Location, err = time.LoadLocation(config.AirQoIntegratorConf.Server.TimeZone)
-	if err != nil {
-		log.Errorln(err)
-	}
-}
-
 type NullTime struct {
 	sql.NullTime
 }
@@ -59,8 +52,11 @@ type Schedule struct {
 	Repeat          string          `db:"repeat" json:"repeat,omitempty"`
 	RepeatInterval  int             `db:"repeat_interval" json:"repeat_interval,"`
 	CronExpression  string          `db:"cron_expression" json:"cronExpression,omitempty"`
+	MisfirePolicy   string          `db:"misfire_policy" json:"misfirePolicy,omitempty"`
 	LastRunAt       NullTime        `db:"last_run_at" json:"lastRunAt,omitempty"` // Use pointer for nullable fields
 	NextRunAt       time.Time       `db:"next_run_at" json:"nextRunAt,omitempty"`
+	ClaimedAt       NullTime        `db:"claimed_at" json:"claimedAt,omitempty"`
+	RunRequestedAt  NullTime        `db:"run_requested_at" json:"runRequestedAt,omitempty"`
 	Status          string          `db:"status" json:"status,omitempty"`
 	IsActive        bool            `db:"is_active" json:"isActive,omitempty"`
 	RequestID       *RequestID      `db:"request_id" json:"request_id,omitempty"`
@@ -68,25 +64,32 @@ type Schedule struct {
 	ServerInCC      *bool           `db:"server_in_cc" json:"ServerInCC,omitempty"`
 	AsyncJobType    string          `db:"async_job_type" json:"asyncJobType,omitempty"`
 	AsyncJobID      string          `db:"async_jobid" json:"asyncJobID,omitempty"`
-	CreatedBy       *int64          `db:"created_by" json:"createdBy,omitempty"` // Use pointer for nullable fields
+	LastStatusCode  int             `db:"last_status_code" json:"lastStatusCode,omitempty"` // HTTP status of the latest url schedule run
+	LastResponse    string          `db:"last_response" json:"lastResponse,omitempty"`      // excerpt of the latest response
+	LastMessage     string          `db:"last_message" json:"lastMessage,omitempty"`        // outcome of the latest run
+	CreatedBy       *int64          `db:"created_by" json:"createdBy,omitempty"`            // Use pointer for nullable fields
 	Created         time.Time       `db:"created" json:"created,omitempty"`
 	Updated         time.Time       `db:"updated" json:"updated,omitempty"`
 }
 
 const createScheduleSQL = `INSERT INTO 
 	schedules (sched_type, params, sched_url, sched_content, command, command_args,
-		repeat, repeat_interval, cron_expression, next_run_at, status, is_active,
+		repeat, repeat_interval, cron_expression, misfire_policy, next_run_at, status, is_active,
 		async_job_type, async_jobid, request_id, server_id, server_in_cc,
 		created_by, created, updated) 
 	VALUES (
 		:sched_type, :params, :sched_url, :sched_content, :command, :command_args,
-		:repeat, :repeat_interval, :cron_expression, :next_run_at, :status, :is_active,
+		:repeat, :repeat_interval, :cron_expression, COALESCE(NULLIF(:misfire_policy, ''), 'skip'),
+		:next_run_at, :status, :is_active,
 		:async_job_type, :async_jobid, :request_id, :server_id, :server_in_cc,
 		:created_by, :created, :updated
 	) RETURNING id`
 
 // CreateSchedule inserts a new schedule into the database
 func CreateSchedule(db *sqlx.DB, schedule Schedule) (int64, error) {
+	if schedule.NextRunAt.IsZero() {
+		schedule.NextRunAt = schedule.FirstRun(time.Now().In(Location))
+	}
 	rows, err := db.NamedQuery(createScheduleSQL, schedule)
 	if err != nil {
 		log.WithFields(
@@ -149,6 +152,7 @@ const updateScheduleSQL = `UPDATE schedules SET
 		sched_type = :sched_type, params = :params, sched_content = :sched_content, sched_url = :sched_url, 
 		command = :command, command_args = :command_args, first_run_at = :first_run_at, repeat = :repeat,
 		repeat_interval = :repeat_interval, cron_expression = :cron_expression,
+		misfire_policy = COALESCE(NULLIF(:misfire_policy, ''), 'skip'),
         next_run_at = :next_run_at, last_run_at = :last_run_at,
 		status = :status, is_active = :is_active, updated = :updated
 	WHERE id = :id`
@@ -207,6 +211,14 @@ func (s *Schedule) UpdateRunDetails(tx *sqlx.Tx, status string, nextRun time.Tim
 	return err
 }
 
+// RecordRunResult saves the outcome of the latest run
+func (s *Schedule) RecordRunResult(tx *sqlx.Tx, statusCode int, response, message string) error {
+	s.LastStatusCode, s.LastResponse, s.LastMessage = statusCode, response, message
+	_, err := tx.NamedExec(`UPDATE schedules SET (last_status_code, last_response, last_message)
+		= (:last_status_code, :last_response, :last_message) WHERE id = :id`, s)
+	return err
+}
+
 // DeleteSchedule deletes a schedule from the database by ID
 func DeleteSchedule(db *sqlx.DB, id int64) error {
 	query := `DELETE FROM schedules WHERE id = $1`
@@ -249,35 +261,16 @@ func CreateAsyncJobSchedule(
 
 }
 
-func CheckDhis2AsyncJobTaskSummary(tx *sqlx.Tx, schedule Schedule) (*AsyncJobImportSummary, error) {
-	//if server, ok := ServerMap[fmt.Sprintf("%d", schedule.ServerID)]; ok {
-	//
-	//}
+func CheckDhis2AsyncJobTaskSummary(schedule Schedule) (*AsyncJobImportSummary, error) {
 	var taskSummary *AsyncJobImportSummary
 	if *schedule.ServerID > 0 {
 		server := GetServerByID(int64(*schedule.ServerID))
-		srv := clients.Server{
-			BaseUrl:    server.URL(),
-			Username:   server.Username(),
-			Password:   server.Password(),
-			AuthToken:  server.AuthToken(),
-			AuthMethod: server.AuthMethod(),
-		}
-		client, err := srv.NewDhis2Client()
-		if err != nil {
-			log.WithFields(log.Fields{
-				"server_id": *schedule.ServerID,
-				"error":     err,
-			}).Error("Could not get client for server!")
-			return taskSummary, err
-		}
 		resource := fmt.Sprintf(
 			"system/taskSummaries/%s/%s",
 			schedule.AsyncJobType,
 			schedule.AsyncJobID,
 		)
-		params := map[string]string{}
-		resp, err := client.GetResource(resource, params)
+		resp, err := server.GetDHIS2Resource(resource, nil)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"server_id":   *schedule.ServerID,
@@ -287,14 +280,11 @@ func CheckDhis2AsyncJobTaskSummary(tx *sqlx.Tx, schedule Schedule) (*AsyncJobImp
 			}).Error("Could not get task summary for async job!")
 			return taskSummary, err
 		}
-		// var taskSummary AsyncJobImportSummary
-		err = json.Unmarshal(resp.Body(), &taskSummary)
+		err = json.Unmarshal(resp, &taskSummary)
 		if err != nil {
 			log.WithError(err).Error("Failed to unmarshall response taskSummary!")
 			return taskSummary, err
 		}
-		//  log.WithField("TaskSummary", taskSummary).Info("TaskSummary")
-
 	}
 	return taskSummary, nil
 }
@@ -303,28 +293,12 @@ func CheckDhis2AsyncJobTaskSummary(tx *sqlx.Tx, schedule Schedule) (*AsyncJobImp
 func CheckDhis2AsyncJobStatus(schedule Schedule) (bool, bool, error) {
 	if *schedule.ServerID > 0 {
 		server := GetServerByID(int64(*schedule.ServerID))
-		srv := clients.Server{
-			BaseUrl:    server.URL(),
-			Username:   server.Username(),
-			Password:   server.Password(),
-			AuthToken:  server.AuthToken(),
-			AuthMethod: server.AuthMethod(),
-		}
-		client, err := srv.NewDhis2Client()
-		if err != nil {
-			log.WithFields(log.Fields{
-				"server_id": *schedule.ServerID,
-				"error":     err,
-			}).Error("Could not get client for server!")
-			return false, false, err
-		}
 		resource := fmt.Sprintf(
 			"system/tasks/%s/%s",
 			schedule.AsyncJobType,
 			schedule.AsyncJobID,
 		)
-		params := map[string]string{}
-		resp, err := client.GetResource(resource, params)
+		resp, err := server.GetDHIS2Resource(resource, nil)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"server_id":   *schedule.ServerID,
@@ -335,7 +309,7 @@ func CheckDhis2AsyncJobStatus(schedule Schedule) (bool, bool, error) {
 			return false, false, err
 		}
 		var taskStatus []AsyncJobStatus
-		err = json.Unmarshal(resp.Body(), &taskStatus)
+		err = json.Unmarshal(resp, &taskStatus)
 		if err != nil {
 			log.WithError(err).Error("Failed to unmarshall response taskStatus!")
 			return false, false, err
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"context"
+	"github.com/buger/jsonparser"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ServerConnectionResult is the result of testing the connection to a server
+type ServerConnectionResult struct {
+	Server     string `json:"server"`
+	URL        string `json:"url"`
+	OK         bool   `json:"ok"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	LatencyMS  int64  `json:"latencyMs"`
+	Version    string `json:"version,omitempty"` // DHIS2 version reported by /api/system/info
+	Error      string `json:"error,omitempty"`
+}
+
+// TestConnection calls the server's health URL with the server's transport and credentials
+func (s *Server) TestConnection(ctx context.Context) ServerConnectionResult {
+	result := ServerConnectionResult{Server: s.Name(), URL: s.HealthURL()}
+	if result.URL == "" {
+		result.Error = "server has no URL"
+		return result
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", result.URL, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Header.Set("Accept", "application/json")
+	auth, err := s.AuthProvider()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if err := auth.Authenticate(req); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	client, err := s.HTTPClient()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	result.StatusCode = resp.StatusCode
+	result.OK = resp.StatusCode/100 == 2
+	if !result.OK {
+		result.Error = http.StatusText(resp.StatusCode)
+		return result
+	}
+	if version, err := jsonparser.GetString(body, "version"); err == nil {
+		result.Version = version
+	}
+	return result
+}
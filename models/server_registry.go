@@ -0,0 +1,170 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/jmoiron/sqlx"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// serverView is an immutable snapshot of the known servers. Readers load the current
+// view without locking while changes build a new view and swap it in
+type serverView struct {
+	byID   map[string]Server
+	byName map[string]Server
+}
+
+var (
+	serverRegistry  atomic.Pointer[serverView]
+	serversMutex    = &sync.Mutex{} // serialises writers
+	emptyServerView = &serverView{byID: map[string]Server{}, byName: map[string]Server{}}
+)
+
+func currentServers() *serverView {
+	if view := serverRegistry.Load(); view != nil {
+		return view
+	}
+	return emptyServerView
+}
+
+// LookupServer returns the server with the given id from the registry
+func LookupServer(id string) (Server, bool) {
+	srv, ok := currentServers().byID[id]
+	return srv, ok
+}
+
+// LookupServerByID returns the server with the given id from the registry
+func LookupServerByID(id ServerID) (Server, bool) {
+	return LookupServer(strconv.FormatInt(int64(id), 10))
+}
+
+// LookupServerByName returns the server with the given name from the registry
+func LookupServerByName(name string) (Server, bool) {
+	srv, ok := currentServers().byName[name]
+	return srv, ok
+}
+
+// RegisteredServers returns the servers in the registry ordered by id
+func RegisteredServers() []Server {
+	list := lo.Values(currentServers().byID)
+	sort.Slice(list, func(i, j int) bool { return list[i].ID() < list[j].ID() })
+	return list
+}
+
+func newServerView(list []Server) *serverView {
+	view := &serverView{
+		byID:   make(map[string]Server, len(list)),
+		byName: make(map[string]Server, len(list)),
+	}
+	for _, srv := range list {
+		view.byID[strconv.FormatInt(int64(srv.ID()), 10)] = srv
+		view.byName[srv.Name()] = srv
+	}
+	return view
+}
+
+// changedServerFields returns the JSON names of the fields that differ between two versions of a server
+func changedServerFields(old, new Server) []string {
+	var oldFields, newFields map[string]any
+	oldJSON, _ := json.Marshal(old.s)
+	newJSON, _ := json.Marshal(new.s)
+	_ = json.Unmarshal(oldJSON, &oldFields)
+	_ = json.Unmarshal(newJSON, &newFields)
+	var changed []string
+	for k := range lo.Assign(oldFields, newFields) {
+		if k == "updated" {
+			continue
+		}
+		if !reflect.DeepEqual(oldFields[k], newFields[k]) {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// logServerChanges logs the servers added, changed and removed between two views
+func logServerChanges(old, new *serverView) {
+	for id, srv := range new.byID {
+		prev, ok := old.byID[id]
+		if !ok {
+			log.WithFields(log.Fields{"serverID": id, "server": srv.Name()}).Info("Server added to registry")
+			continue
+		}
+		if changed := changedServerFields(prev, srv); len(changed) > 0 {
+			// secrets are encrypted so only the names of changed fields are logged
+			log.WithFields(log.Fields{
+				"serverID": id, "server": srv.Name(), "changed": changed}).Info("Server updated in registry")
+		}
+	}
+	for id, srv := range old.byID {
+		if _, ok := new.byID[id]; !ok {
+			log.WithFields(log.Fields{"serverID": id, "server": srv.Name()}).Info("Server removed from registry")
+		}
+	}
+}
+
+// swapServers replaces the registry view with one built by change from the current servers
+func swapServers(change func(current []Server) []Server) {
+	serversMutex.Lock()
+	defer serversMutex.Unlock()
+	old := currentServers()
+	view := newServerView(change(lo.Values(old.byID)))
+	serverRegistry.Store(view)
+	logServerChanges(old, view)
+}
+
+// loadServers reads all servers from the database
+func loadServers(db *sqlx.DB) ([]Server, error) {
+	var list []Server
+	rows, err := db.Queryx("SELECT * FROM servers")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+	for rows.Next() {
+		srv := Server{}
+		if err := rows.StructScan(&srv.s); err != nil {
+			return nil, err
+		}
+		list = append(list, srv)
+	}
+	return list, rows.Err()
+}
+
+// ReloadServers replaces the registry with the servers in the database
+func ReloadServers(db *sqlx.DB) error {
+	list, err := loadServers(db)
+	if err != nil {
+		log.WithError(err).Error("Failed to reload servers")
+		return err
+	}
+	swapServers(func([]Server) []Server { return list })
+	log.WithField("servers", len(list)).Info("Servers reloaded")
+	return nil
+}
+
+// CacheServer adds or replaces a server in the registry
+func CacheServer(srv Server) {
+	if srv.ID() == 0 {
+		log.WithField("server", srv.Name()).Warn("Server without id not added to registry")
+		return
+	}
+	swapServers(func(current []Server) []Server {
+		// the old entry is dropped by id in case the server was renamed
+		return append(lo.Filter(current, func(s Server, _ int) bool { return s.ID() != srv.ID() }), srv)
+	})
+}
+
+// UncacheServer removes a server from the registry
+func UncacheServer(id ServerID) {
+	swapServers(func(current []Server) []Server {
+		return lo.Filter(current, func(s Server, _ int) bool { return s.ID() != id })
+	})
+	dropServerClient(id)
+}
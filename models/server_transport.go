@@ -0,0 +1,234 @@
+package models
+
+import (
+	"airqo-integrator/clients"
+	"airqo-integrator/config"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transportSettings are the server settings a pooled client is built from
+type transportSettings struct {
+	requireTLS     bool
+	caFile         string
+	certKeyFile    string
+	skipTLSVerify  bool
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	requestTimeout time.Duration
+}
+
+// serverClient is the pooled HTTP client used for all requests to one server
+type serverClient struct {
+	settings transportSettings
+	client   *http.Client
+}
+
+var (
+	serverClients      = make(map[ServerID]*serverClient)
+	serverClientsMutex = &sync.Mutex{}
+)
+
+// timeoutOrDefault returns seconds as a duration, falling back to the global default when not set
+func timeoutOrDefault(seconds, defaultSeconds int) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(defaultSeconds) * time.Second
+}
+
+func serverTransportSettings(server Server) transportSettings {
+	conf := config.AirQoIntegratorConf.Server
+	settings := transportSettings{
+		requireTLS:     server.UseSSL(),
+		caFile:         server.SSLTrustedCAFile(),
+		certKeyFile:    server.SSLClientCertKeyFile(),
+		skipTLSVerify:  server.SkipTLSVerify(),
+		connectTimeout: timeoutOrDefault(server.ConnectTimeout(), conf.OutboundConnectTimeout),
+		readTimeout:    timeoutOrDefault(server.ReadTimeout(), conf.OutboundReadTimeout),
+		requestTimeout: timeoutOrDefault(server.RequestTimeout(), conf.OutboundRequestTimeout),
+	}
+	// the global CA bundle and client certificate apply to servers without their own unless use_ssl is off
+	if useSSL, err := strconv.ParseBool(conf.UseSSL); err != nil || useSSL {
+		if settings.caFile == "" {
+			settings.caFile = conf.SSLTrustedCAFile
+		}
+		if settings.certKeyFile == "" {
+			settings.certKeyFile = conf.SSLClientCertKeyFile
+		}
+	}
+	return settings
+}
+
+// httpsOnlyTransport refuses requests, redirects included, that are not over https
+type httpsOnlyTransport struct {
+	next http.RoundTripper
+}
+
+func (t httpsOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("server requires SSL, refusing %s request to %s", req.URL.Scheme, req.URL.Host)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// newTLSConfig builds the TLS configuration. The system roots are extended with the CA bundle
+// and the client certificate is read from a single PEM file holding both certificate and key
+func newTLSConfig(settings transportSettings) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: settings.skipTLSVerify,
+	}
+	if settings.caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		caPEM, err := os.ReadFile(settings.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle %s: %w", settings.caFile, err)
+		}
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", settings.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if settings.certKeyFile != "" {
+		certKeyPEM, err := os.ReadFile(settings.certKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client certificate %s: %w", settings.certKeyFile, err)
+		}
+		cert, err := tls.X509KeyPair(certKeyPEM, certKeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s: %w", settings.certKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func newServerClient(settings transportSettings) (*serverClient, error) {
+	tlsConfig, err := newTLSConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: settings.connectTimeout, KeepAlive: 30 * time.Second}
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   settings.connectTimeout,
+		ResponseHeaderTimeout: settings.readTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		ForceAttemptHTTP2:     true,
+	}
+	var transport http.RoundTripper = tr
+	if settings.requireTLS {
+		transport = httpsOnlyTransport{next: tr}
+	}
+	return &serverClient{
+		settings: settings,
+		client:   &http.Client{Transport: transport, Timeout: settings.requestTimeout},
+	}, nil
+}
+
+// HTTPClient returns the pooled client for the server, which refuses plain http when the server uses SSL.
+// The client is rebuilt whenever the server's TLS or timeout settings change
+func (s *Server) HTTPClient() (*http.Client, error) {
+	server := *s
+	settings := serverTransportSettings(server)
+	serverClientsMutex.Lock()
+	defer serverClientsMutex.Unlock()
+	if c, ok := serverClients[server.ID()]; ok && c.settings == settings {
+		return c.client, nil
+	}
+	c, err := newServerClient(settings)
+	if err != nil {
+		return nil, err
+	}
+	if old, ok := serverClients[server.ID()]; ok {
+		old.client.CloseIdleConnections()
+	}
+	serverClients[server.ID()] = c
+	fields := log.Fields{
+		"server":         server.Name(),
+		"requireTLS":     settings.requireTLS,
+		"caFile":         settings.caFile,
+		"clientCert":     settings.certKeyFile != "",
+		"connectTimeout": settings.connectTimeout,
+		"readTimeout":    settings.readTimeout,
+		"requestTimeout": settings.requestTimeout,
+	}
+	if settings.skipTLSVerify {
+		log.WithFields(fields).Warn("Server transport configured without certificate verification")
+	} else {
+		log.WithFields(fields).Info("Server transport configured")
+	}
+	return c.client, nil
+}
+
+// dropServerClient closes the idle connections of a deleted server's client and forgets it
+func dropServerClient(id ServerID) {
+	serverClientsMutex.Lock()
+	defer serverClientsMutex.Unlock()
+	if c, ok := serverClients[id]; ok {
+		c.client.CloseIdleConnections()
+		delete(serverClients, id)
+	}
+}
+
+// GetDHIS2Resource gets a resource of the DHIS2 API of the server, e.g. system/tasks/DATAVALUE_IMPORT/id,
+// with the server's client and credentials and returns the body of a successful response
+func (s *Server) GetDHIS2Resource(resource string, params url.Values) ([]byte, error) {
+	baseURL, err := clients.GetDHIS2BaseURL(s.URL())
+	if err != nil {
+		return nil, err
+	}
+	target := baseURL + "/api/" + strings.TrimPrefix(resource, "/")
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	auth, err := s.AuthProvider()
+	if err != nil {
+		return nil, err
+	}
+	if err := auth.Authenticate(req); err != nil {
+		return nil, err
+	}
+	client, err := s.HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s failed with status %s", resource, resp.Status)
+	}
+	return body, nil
+}
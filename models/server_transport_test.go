@@ -0,0 +1,31 @@
+package models
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerClientRequiresTLS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer backend.Close()
+
+	plain, err := newServerClient(transportSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := plain.client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("request without useSSL failed: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	tlsOnly, err := newServerClient(transportSettings{requireTLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tlsOnly.client.Get(backend.URL); err == nil || !strings.Contains(err.Error(), "requires SSL") {
+		t.Errorf("got %v, want the http request refused", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"airqo-integrator/db"
 	"airqo-integrator/utils"
 	"airqo-integrator/utils/dbutils"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,14 +21,19 @@ import (
 	"reflect"
 	"regexp"
 	"runtime"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/lib/pq"
 )
 
-func init() {
+// Init loads the deployment's time zone, migrates the database and loads the servers. main calls it
+// once the configuration is loaded and the database connected
+func Init() {
+	var err error
+	if Location, err = time.LoadLocation(config.AirQoIntegratorConf.Server.TimeZone); err != nil {
+		log.Errorln(err)
+	}
 	var migrationsDir string
 	currentOS := runtime.GOOS
 	switch currentOS {
@@ -53,34 +59,13 @@ func init() {
 		log.Fatalln(err)
 	}
 	CreateBaseDHIS2Server()
-	rows, err := db.GetDB().Queryx("SELECT * FROM servers")
-
+	list, err := loadServers(db.GetDB())
 	if err != nil {
-		log.WithError(err).Info("Failed to load servers")
-	}
-	ServerMap = make(map[string]Server)
-	ServerMapByName = make(map[string]Server)
-	for rows.Next() {
-		srv := Server{}
-
-		err := rows.StructScan(&srv.s)
-		if err != nil {
-			log.Fatalln("Server Loading ==>", err)
-		}
-
-		ServerMap[strconv.Itoa(int(srv.s.ID))] = srv
-		ServerMapByName[srv.s.Name] = srv
-		// log.WithField("SERVER", srv.s).Info("=====>")
-
+		log.Fatalln("Server Loading ==>", err)
 	}
-	// log.WithField("ServerMapByName", ServerMapByName).Info("========>")
-	_ = rows.Close()
+	serverRegistry.Store(newServerView(list))
 }
 
-// ServerMap is the List of Servers
-var ServerMap map[string]Server
-var ServerMapByName map[string]Server
-
 // ServerID is the id for the server
 type ServerID int64
 
@@ -102,24 +87,62 @@ type Server struct {
 		CallbackURL             string              `db:"callback_url" json:"callbackURL,omitempty"`         // receives response on success call to url
 		HTTPMethod              string              `db:"http_method" json:"HTTPMethod" validate:"required"` // the HTTP Method used when calling the url
 		AuthMethod              string              `db:"auth_method" json:"AuthMethod" validate:"required"` // the Authentication Method used
+		AuthConfig              utils.AuthConfig    `db:"auth_config" json:"authConfig,omitempty"`           // settings for OAuth2, Bearer, Header and HMAC
 		AllowCallbacks          bool                `db:"allow_callbacks" json:"allowCallbacks,omitempty"`   // Whether to allow calling sending callbacks
 		AllowCopies             bool                `db:"allow_copies" json:"allowCopies,omitempty"`         // Whether to allow copying similar request to CCURLs
 		UseAsync                bool                `db:"use_async" json:"useAsync,omitempty"`
 		UseSSL                  bool                `db:"use_ssl" json:"useSSL,omitempty"`
 		ParseResponses          bool                `db:"parse_responses" json:"parseResponses,omitempty"`
+		HealthURL               string              `db:"health_url" json:"healthURL,omitempty"` // called to test the connection to the server
 		SSLClientCertKeyFile    string              `db:"ssl_client_certkey_file" json:"sslClientCertkeyFile"`
+		SSLTrustedCAFile        string              `db:"ssl_trusted_cafile" json:"sslTrustedCAFile,omitempty"`
+		SkipTLSVerify           bool                `db:"skip_tls_verify" json:"skipTLSVerify,omitempty"`    // don't verify the server certificate
+		ConnectTimeout          int                 `db:"connect_timeout" json:"connectTimeout,omitempty"`   // seconds, 0 = global default
+		ReadTimeout             int                 `db:"read_timeout" json:"readTimeout,omitempty"`         // seconds, 0 = global default
+		RequestTimeout          int                 `db:"request_timeout" json:"requestTimeout,omitempty"`   // seconds, 0 = global default
+		AsyncJobMaxAge          int                 `db:"async_job_max_age" json:"asyncJobMaxAge,omitempty"` // seconds, 0 = global default
 		StartOfSubmissionPeriod int                 `db:"start_submission_period" json:"startSubmissionPeriod"`
 		EndOfSubmissionPeriod   int                 `db:"end_submission_period" json:"endSubmissionPeriod"`
+		Timezone                string              `db:"timezone" json:"timezone,omitempty"` // time zone of the submission windows, database time zone when empty
+		SubmissionWindows       SubmissionWindows   `db:"submission_windows" json:"submissionWindows,omitempty"`
+		BlackoutDates           pq.StringArray      `db:"blackout_dates" json:"blackoutDates,omitempty"`   // YYYY-MM-DD dates nothing is sent
+		BodyTransforms          BodyTransforms      `db:"body_transforms" json:"bodyTransforms,omitempty"` // rules rewriting bodies sent to the server
 		XMLResponseXPATH        string              `db:"xml_response_xpath"  json:"XMLResponseXPATH"`
 		JSONResponseXPATH       string              `db:"json_response_xpath" json:"JSONResponseXPATH"`
+		ResponseRules           ResponseRules       `db:"response_rules" json:"responseRules,omitempty"`
 		Suspended               bool                `db:"suspended" json:"suspended,omitempty"`
 		URLParams               dbutils.MapAnything `db:"url_params" json:"URLParams,omitempty"`
+		MaxConcurrent           int                 `db:"max_concurrent" json:"maxConcurrent,omitempty"`          // max in-flight requests, 0 = unlimited
+		RequestsPerSecond       float64             `db:"requests_per_second" json:"requestsPerSecond,omitempty"` // max request rate, 0 = unlimited
 		Created                 time.Time           `db:"created" json:"created,omitempty"`
 		Updated                 time.Time           `db:"updated" json:"updated,omitempty"`
 		AllowedSources          []string            `json:"allowedSources,omitempty"`
 	}
 }
 
+// ResponseRules decide the outcome of a request from the value found at the server's
+// JSONResponseXPATH or XMLResponseXPATH in the response body
+type ResponseRules struct {
+	SuccessValues []string `json:"successValues,omitempty"`
+	RetryValues   []string `json:"retryValues,omitempty"`
+	FailureValues []string `json:"failureValues,omitempty"`
+	ReferencePath string   `json:"referencePath,omitempty"` // JSONPath or XPath of the external reference
+}
+
+// Value implements the driver.Valuer interface
+func (r ResponseRules) Value() (driver.Value, error) {
+	return json.Marshal(r)
+}
+
+// Scan implements the sql.Scanner interface
+func (r *ResponseRules) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, r)
+}
+
 // ServerAllowedApps hold servers and servers they allow to communicate with
 type ServerAllowedApps struct {
 	ID             int64         `db:"id" json:"id"`
@@ -130,7 +153,8 @@ type ServerAllowedApps struct {
 func (sa *ServerAllowedApps) Save() {
 	dbConn := db.GetDB()
 	_, err := dbConn.NamedExec(`INSERT INTO server_allowed_sources (server_id, allowed_sources)
-			VALUES(:server_id, :allowed_sources)`, sa)
+			VALUES(:server_id, :allowed_sources)
+			ON CONFLICT (server_id) DO UPDATE SET allowed_sources = EXCLUDED.allowed_sources, updated = now()`, sa)
 	if err != nil {
 		log.WithError(err).Error("Failed to save server allowed sources")
 	}
@@ -148,14 +172,17 @@ func (s *Server) Name() string { return s.s.Name }
 // Username ...
 func (s *Server) Username() string { return s.s.Username }
 
-// Password ...
-func (s *Server) Password() string { return s.s.Password }
+// Password returns the decrypted password
+func (s *Server) Password() string { return utils.RevealSecret(s.s.Password) }
 
 // SystemType return the type of system/app it is
 func (s *Server) SystemType() string { return s.s.SystemType }
 
 // AuthToken return the Authentication token for this server
-func (s *Server) AuthToken() string { return s.s.AuthToken }
+func (s *Server) AuthToken() string { return utils.RevealSecret(s.s.AuthToken) }
+
+// HasAuthToken returns whether the server has an auth token, without decrypting it
+func (s *Server) HasAuthToken() bool { return s.s.AuthToken != "" }
 
 // URL returns the URL for the server
 func (s *Server) URL() string { return s.s.URL }
@@ -166,6 +193,28 @@ func (s *Server) HTTPMethod() string { return s.s.HTTPMethod }
 // AuthMethod ...
 func (s *Server) AuthMethod() string { return s.s.AuthMethod }
 
+// AuthConfig returns the settings of the server's auth method
+func (s *Server) AuthConfig() utils.AuthConfig { return s.s.AuthConfig.Revealed() }
+
+// AuthProvider returns the provider authenticating requests to the server
+func (s *Server) AuthProvider() (utils.AuthProvider, error) {
+	return utils.NewAuthProvider(s.s.AuthMethod, s.s.Username, s.Password(), s.AuthToken(), s.AuthConfig())
+}
+
+// HealthURL returns the URL called to test the connection to the server. DHIS2 servers
+// without one use /api/system/info and other servers their URL
+func (s *Server) HealthURL() string {
+	if s.s.HealthURL != "" {
+		return s.s.HealthURL
+	}
+	if strings.EqualFold(s.s.SystemType, "DHIS2") || s.s.SystemType == "" {
+		if i := strings.Index(s.s.URL, "/api/"); i >= 0 {
+			return s.s.URL[:i] + "/api/system/info"
+		}
+	}
+	return s.s.URL
+}
+
 // AllowCallbacks returns whether server allows callbacks
 func (s *Server) AllowCallbacks() bool { return s.s.AllowCallbacks }
 
@@ -184,9 +233,77 @@ func (s *Server) EndOfSubmissionPeriod() int { return s.s.EndOfSubmissionPeriod
 // StartOfSubmissionPeriod returns the start of the submission period for the server
 func (s *Server) StartOfSubmissionPeriod() int { return s.s.StartOfSubmissionPeriod }
 
+// Timezone returns the time zone of the server's submission windows
+func (s *Server) Timezone() string { return s.s.Timezone }
+
+// SubmissionWindows returns the windows during which requests are sent to the server
+func (s *Server) SubmissionWindows() SubmissionWindows { return s.s.SubmissionWindows }
+
+// BlackoutDates returns the dates on which no requests are sent to the server
+func (s *Server) BlackoutDates() []string { return s.s.BlackoutDates }
+
+// BodyTransforms returns the rules applied to request bodies before they are sent to the server
+func (s *Server) BodyTransforms() BodyTransforms { return s.s.BodyTransforms }
+
 // Suspended returns whether the server is suspended
 func (s *Server) Suspended() bool { return s.s.Suspended }
 
+// MaxConcurrent returns the maximum number of in-flight requests allowed to the server
+func (s *Server) MaxConcurrent() int { return s.s.MaxConcurrent }
+
+// RequestsPerSecond returns the maximum number of requests per second allowed to the server
+func (s *Server) RequestsPerSecond() float64 { return s.s.RequestsPerSecond }
+
+// SSLClientCertKeyFile returns the PEM file holding the client certificate and key used for mutual TLS
+func (s *Server) SSLClientCertKeyFile() string { return s.s.SSLClientCertKeyFile }
+
+// SSLTrustedCAFile returns the CA bundle used to verify the server certificate
+func (s *Server) SSLTrustedCAFile() string { return s.s.SSLTrustedCAFile }
+
+// UseSSL returns whether requests to the server must go over https
+func (s *Server) UseSSL() bool { return s.s.UseSSL }
+
+// SkipTLSVerify returns whether verification of the server certificate is turned off
+func (s *Server) SkipTLSVerify() bool { return s.s.SkipTLSVerify }
+
+// ConnectTimeout returns the connect timeout in seconds for the server
+func (s *Server) ConnectTimeout() int { return s.s.ConnectTimeout }
+
+// ReadTimeout returns the seconds to wait for the server's response headers
+func (s *Server) ReadTimeout() int { return s.s.ReadTimeout }
+
+// RequestTimeout returns the overall timeout in seconds for a request to the server
+func (s *Server) RequestTimeout() int { return s.s.RequestTimeout }
+
+// AsyncJobMaxAge returns how long async jobs on the server are polled before the outcome of their request is reconciled
+func (s *Server) AsyncJobMaxAge() time.Duration {
+	if s.s.AsyncJobMaxAge > 0 {
+		return time.Duration(s.s.AsyncJobMaxAge) * time.Second
+	}
+	if config.AirQoIntegratorConf.Server.Dhis2AsyncJobMaxAge > 0 {
+		return time.Duration(config.AirQoIntegratorConf.Server.Dhis2AsyncJobMaxAge) * time.Second
+	}
+	return 24 * time.Hour
+}
+
+// JSONResponseXPATH returns the JSONPath of the value deciding the outcome of a request
+func (s *Server) JSONResponseXPATH() string { return s.s.JSONResponseXPATH }
+
+// XMLResponseXPATH returns the XPath of the value deciding the outcome of a request
+func (s *Server) XMLResponseXPATH() string { return s.s.XMLResponseXPATH }
+
+// ResponseRules returns the rules used to evaluate the server's responses
+func (s *Server) ResponseRules() ResponseRules { return s.s.ResponseRules }
+
+// UsesResponseRules returns whether responses are evaluated with the server's response rules
+// instead of being read as DHIS2 import summaries
+func (s *Server) UsesResponseRules() bool {
+	if s.s.JSONResponseXPATH != "" || s.s.XMLResponseXPATH != "" {
+		return true
+	}
+	return s.s.SystemType != "" && !strings.EqualFold(s.s.SystemType, "DHIS2")
+}
+
 // CreatedOn return time when Server/App was created
 func (s *Server) CreatedOn() time.Time { return s.s.Created }
 
@@ -241,9 +358,38 @@ func GetServerByName(name string) (Server, error) {
 
 }
 
-// Self returns server map
+// beforeSave validates the server and encrypts its secrets
+func (s *Server) beforeSave() error {
+	if err := s.validateSubmissionSettings(); err != nil {
+		return err
+	}
+	if err := s.s.BodyTransforms.Validate(); err != nil {
+		return err
+	}
+	return s.encryptSecrets()
+}
+
+// encryptSecrets encrypts the password, auth token and auth config secrets before the server is saved.
+// Values that are already encrypted, e.g. those in conf.d files, are kept as they are
+func (s *Server) encryptSecrets() error {
+	var err error
+	if s.s.Password, err = utils.EncryptSecret(s.s.Password); err != nil {
+		return err
+	}
+	if s.s.AuthToken, err = utils.EncryptSecret(s.s.AuthToken); err != nil {
+		return err
+	}
+	s.s.AuthConfig, err = s.s.AuthConfig.Encrypted()
+	return err
+}
+
+// Self returns server map with the secrets redacted
 func (s *Server) Self() map[string]any {
-	srvJSON, err := json.Marshal(s.s)
+	redacted := s.s
+	redacted.Password = utils.RedactSecret(redacted.Password)
+	redacted.AuthToken = utils.RedactSecret(redacted.AuthToken)
+	redacted.AuthConfig = redacted.AuthConfig.Redacted()
+	srvJSON, err := json.Marshal(redacted)
 	if err != nil {
 		log.WithError(err).Error("Could not marshal server struct to JSON")
 	}
@@ -299,7 +445,7 @@ func (s *Server) InSubmissionPeriod(tx *sqlx.Tx) bool {
 
 // ServerDBFields returns the fields in the servers table
 func (s *Server) ServerDBFields() []string {
-	e := reflect.ValueOf(s).Elem()
+	e := reflect.ValueOf(&s.s).Elem()
 	var ret []string
 	for i := 0; i < e.NumField(); i++ {
 		t := e.Type().Field(i).Tag.Get("db")
@@ -323,8 +469,9 @@ func (s *Server) SetUID(uid string) {
 
 var serversFields = new(Server).ServerDBFields()
 
-func GetServers(db *sqlx.DB, page string, pageSize string,
-	orderBy []string, fields string, filters []string) []dbutils.MapAnything {
+// GetServers returns a page of servers with their secrets redacted
+func GetServers(db *sqlx.DB, page string, pageSize string, paging bool,
+	orderBy []string, fields string, filters []string) ([]dbutils.MapAnything, dbutils.Paginator, error) {
 
 	filtered, _ := utils.GetFieldsAndRelationships(serversFields, fields)
 	serversTable := dbutils.Table{Name: "servers", Alias: "s"}
@@ -351,29 +498,55 @@ func GetServers(db *sqlx.DB, page string, pageSize string,
 	var count int64
 	err := db.Get(&count, countquery)
 	if err != nil {
-		return nil
+		return nil, dbutils.Paginator{}, err
 	}
-	pager := dbutils.GetPaginator(count, pageSize, page, true)
+	pager := dbutils.GetPaginator(count, pageSize, page, paging)
 	qbuild.Limit = pager.PageSize
 	qbuild.Offset = pager.FirstItem() - 1
 
-	jsonquery := fmt.Sprintf("SELECT ROW_TO_JSON(s) FROM (%s) s;", qbuild.ToSQL(true))
+	jsonquery := fmt.Sprintf("SELECT ROW_TO_JSON(s) FROM (%s) s;", qbuild.ToSQL(paging))
 	var results []dbutils.MapAnything
 
 	err = db.Select(&results, jsonquery)
 	if err != nil {
 		log.WithError(err).Error("Failed to get query results")
+		return nil, pager, err
+	}
+	for _, result := range results {
+		redactServerRow(result)
+	}
+	return results, pager, nil
+}
+
+// redactServerRow hides the secrets in a servers row read as JSON
+func redactServerRow(row dbutils.MapAnything) {
+	for _, k := range []string{"password", "auth_token"} {
+		if v, ok := row[k].(string); ok {
+			row[k] = utils.RedactSecret(v)
+		}
+	}
+	if authConfig, ok := row["auth_config"].(map[string]interface{}); ok {
+		for _, k := range []string{"clientSecret", "hmacSecret"} {
+			if v, ok := authConfig[k].(string); ok {
+				authConfig[k] = utils.RedactSecret(v)
+			}
+		}
 	}
-	return results
 }
 
 const insertServerSQL = `
 INSERT INTO servers(uid, name, username, password, url, ipaddress, http_method, auth_method, auth_token,
        callback_url, allow_callbacks, cc_urls, allow_copies, start_submission_period, end_submission_period,
-       parse_responses, use_async, use_ssl, suspended, ssl_client_certkey_file, json_response_xpath, xml_response_xpath, endpoint_type, url_params)
+       parse_responses, use_async, use_ssl, suspended, ssl_client_certkey_file, json_response_xpath, xml_response_xpath, endpoint_type, url_params,
+       max_concurrent, requests_per_second, ssl_trusted_cafile, skip_tls_verify, connect_timeout, read_timeout, request_timeout,
+       response_rules, auth_config, system_type, health_url, timezone, submission_windows, blackout_dates, body_transforms,
+       async_job_max_age)
        VALUES (:uid,:name,:username,:password,:url,:ipaddress,:http_method,:auth_method,:auth_token, :callback_url,:allow_callbacks, 
                :cc_urls,:allow_copies,:start_submission_period,:end_submission_period,:parse_responses,:use_async, :use_ssl,
-               :suspended,:ssl_client_certkey_file,:json_response_xpath,:xml_response_xpath, :endpoint_type, :url_params)
+               :suspended,:ssl_client_certkey_file,:json_response_xpath,:xml_response_xpath, :endpoint_type, :url_params,
+               :max_concurrent, :requests_per_second, :ssl_trusted_cafile, :skip_tls_verify, :connect_timeout, :read_timeout,
+               :request_timeout, :response_rules, :auth_config, :system_type, :health_url, :timezone,
+               :submission_windows, :blackout_dates, :body_transforms, :async_job_max_age)
 	RETURNING id
 `
 
@@ -396,6 +569,10 @@ func NewServer(c *gin.Context, db *sqlx.DB) (Server, error) {
 	if !srv.ValidateUID() {
 		srv.SetUID(utils.GetUID())
 	}
+	if err := srv.beforeSave(); err != nil {
+		log.WithError(err).Error("Failed to prepare server for saving")
+		return *srv, err
+	}
 	if srv.ExistsInDB() {
 		log.WithField("Server Name", srv.s.Name).Info("Server with same name already exists!")
 		srv.s.UID = GetServerUIDByName(srv.Name())
@@ -404,7 +581,7 @@ func NewServer(c *gin.Context, db *sqlx.DB) (Server, error) {
 			log.WithError(err).Error("Failed to update server!")
 			return *srv, err
 		}
-		return *srv, nil
+		return GetServerByName(srv.Name())
 	} else {
 		rows, err := db.NamedQuery(insertServerSQL, srv.s)
 		if err != nil {
@@ -414,9 +591,10 @@ func NewServer(c *gin.Context, db *sqlx.DB) (Server, error) {
 		for rows.Next() {
 			var serverId int64
 			_ = rows.Scan(&serverId)
+			srv.s.ID = ServerID(serverId)
 			if len(srv.s.AllowedSources) > 0 {
 				servers := lo.Map(srv.s.AllowedSources, func(name string, _ int) int64 {
-					iSrv := ServerMapByName[name]
+					iSrv, _ := LookupServerByName(name)
 					return int64(iSrv.ID())
 				})
 				allowedSources := ServerAllowedApps{ServerID: serverId, AllowedServers: servers}
@@ -438,18 +616,33 @@ func CreateServerFromJSON(db *sqlx.DB, serverJSON []byte) (Server, error) {
 		log.WithError(err).Error("Failed to Unmarshal serverJSON to Server object!")
 		return Server{}, err
 	}
+	if err := srv.beforeSave(); err != nil {
+		log.WithError(err).Error("Failed to prepare server for saving")
+		return Server{}, err
+	}
 
 	if srv.ExistsInDB() {
 		log.WithField("Server Name", srv.s.Name).Info("Server with same name already exists!")
 		// Update server
 		srv.s.UID = GetServerUIDByName(srv.Name())
-		_, err := db.NamedExec(updateServerSQL, srv.s)
+		_, err := db.NamedExec(updateServerFromConfSQL, srv.s)
 		if err != nil {
 			log.WithError(err).Error("Failed to update server!")
 			return *srv, err
 		}
 		log.WithField("ServerUID", srv.s.UID).Info("Updating server!")
-		return GetServerByName(srv.Name())
+		updated, err := GetServerByName(srv.Name())
+		if err != nil {
+			return updated, err
+		}
+		if len(srv.s.AllowedSources) > 0 {
+			servers := lo.Map(srv.s.AllowedSources, func(name string, _ int) int64 {
+				return GetServerIDByName(name)
+			})
+			allowedSources := ServerAllowedApps{ServerID: int64(updated.ID()), AllowedServers: servers}
+			allowedSources.Save()
+		}
+		return updated, nil
 	} else {
 		// create server
 		srv.SetUID(utils.GetUID())
@@ -461,6 +654,7 @@ func CreateServerFromJSON(db *sqlx.DB, serverJSON []byte) (Server, error) {
 		for rows.Next() {
 			var serverId int64
 			_ = rows.Scan(&serverId)
+			srv.s.ID = ServerID(serverId)
 			if len(srv.s.AllowedSources) > 0 {
 				servers := lo.Map(srv.s.AllowedSources, func(name string, _ int) int64 {
 					return GetServerIDByName(name)
@@ -480,10 +674,34 @@ func CreateServerFromJSON(db *sqlx.DB, serverJSON []byte) (Server, error) {
 const updateServerSQL = `
 UPDATE servers SET (name, username, password, url, ipaddress, http_method,auth_method, auth_token,
        callback_url, allow_callbacks, cc_urls, allow_copies, start_submission_period, end_submission_period,
-       parse_responses, use_async, use_ssl, suspended, ssl_client_certkey_file, json_response_xpath, xml_response_xpath, endpoint_type, url_params)
+       parse_responses, use_async, use_ssl, suspended, ssl_client_certkey_file, json_response_xpath, xml_response_xpath, endpoint_type, url_params,
+       max_concurrent, requests_per_second, ssl_trusted_cafile, skip_tls_verify, connect_timeout, read_timeout, request_timeout,
+       response_rules, auth_config, system_type, health_url, timezone, submission_windows, blackout_dates, body_transforms,
+       async_job_max_age, updated)
 	= (:name,:username,:password,:url,:ipaddress,:http_method,:auth_method,:auth_token, :callback_url,:allow_callbacks, 
                :cc_urls,:allow_copies,:start_submission_period,:end_submission_period,:parse_responses,:use_async, :use_ssl,
-               :suspended,:ssl_client_certkey_file,:json_response_xpath,:xml_response_xpath, :endpoint_type, :url_params)
+               :suspended,:ssl_client_certkey_file,:json_response_xpath,:xml_response_xpath, :endpoint_type, :url_params,
+               :max_concurrent, :requests_per_second, :ssl_trusted_cafile, :skip_tls_verify, :connect_timeout, :read_timeout,
+               :request_timeout, :response_rules, :auth_config, :system_type, :health_url, :timezone,
+               :submission_windows, :blackout_dates, :body_transforms, :async_job_max_age, now())
+	WHERE uid = :uid
+`
+
+// updateServerFromConfSQL updates a server from its conf.d file. Whether the server is suspended is
+// managed through the API and kept
+const updateServerFromConfSQL = `
+UPDATE servers SET (name, username, password, url, ipaddress, http_method,auth_method, auth_token,
+       callback_url, allow_callbacks, cc_urls, allow_copies, start_submission_period, end_submission_period,
+       parse_responses, use_async, use_ssl, ssl_client_certkey_file, json_response_xpath, xml_response_xpath, endpoint_type, url_params,
+       max_concurrent, requests_per_second, ssl_trusted_cafile, skip_tls_verify, connect_timeout, read_timeout, request_timeout,
+       response_rules, auth_config, system_type, health_url, timezone, submission_windows, blackout_dates, body_transforms,
+       async_job_max_age, updated)
+	= (:name,:username,:password,:url,:ipaddress,:http_method,:auth_method,:auth_token, :callback_url,:allow_callbacks,
+               :cc_urls,:allow_copies,:start_submission_period,:end_submission_period,:parse_responses,:use_async, :use_ssl,
+               :ssl_client_certkey_file,:json_response_xpath,:xml_response_xpath, :endpoint_type, :url_params,
+               :max_concurrent, :requests_per_second, :ssl_trusted_cafile, :skip_tls_verify, :connect_timeout, :read_timeout,
+               :request_timeout, :response_rules, :auth_config, :system_type, :health_url, :timezone,
+               :submission_windows, :blackout_dates, :body_transforms, :async_job_max_age, now())
 	WHERE uid = :uid
 `
 
@@ -495,6 +713,10 @@ func CreateServers(db *sqlx.DB, servers []Server) (dbutils.MapAnything, error) {
 		if !server.ValidateUID() {
 			server.SetUID(utils.GetUID())
 		}
+		if err := server.beforeSave(); err != nil {
+			log.WithError(err).Error("Failed to prepare server for saving")
+			return importSummary, err
+		}
 		if server.ExistsInDB() {
 			log.WithField("Server Name", server.s.Name).Info("Server with same name already exists!")
 			// return errors.New(fmt.Sprintf("Server with name %s already exists!", server.s.Name))
@@ -517,7 +739,7 @@ func CreateServers(db *sqlx.DB, servers []Server) (dbutils.MapAnything, error) {
 				_ = rows.Scan(&serverId)
 				if len(server.s.AllowedSources) > 0 {
 					servers := lo.Map(server.s.AllowedSources, func(name string, _ int) int64 {
-						iSrv := ServerMapByName[name]
+						iSrv, _ := LookupServerByName(name)
 						return int64(iSrv.ID())
 					})
 					allowedSources := ServerAllowedApps{ServerID: serverId, AllowedServers: servers}
@@ -608,25 +830,15 @@ func SyncLocationsToServer(serverName string) {
 	chekOusURL += p.Encode()
 	log.WithFields(log.Fields{"ServerURL": chekOusURL, "Name": server.Name()}).Info("Trying to send hierarchy to server")
 
-	var respBody []byte
-	switch server.AuthMethod() {
-	case "Basic":
-		resp, err := utils.GetWithBasicAuth(chekOusURL, server.Username(), server.Password())
-		respBody = resp
-		if err != nil {
-			log.WithError(err).Error("Failed to get ous from server")
-			return
-		}
-
-	case "Token":
-		resp, err := utils.GetWithToken(chekOusURL, server.AuthToken())
-		respBody = resp
-		if err != nil {
-			log.WithError(err).Error("Failed to get ous from server")
-			return
-		}
-	default:
-		// pass
+	auth, err := server.AuthProvider()
+	if err != nil {
+		log.WithError(err).WithField("Name", server.Name()).Error("Cannot authenticate to server")
+		return
+	}
+	respBody, err := utils.GetWithAuth(chekOusURL, auth)
+	if err != nil {
+		log.WithError(err).Error("Failed to get ous from server")
+		return
 	}
 	if respBody != nil {
 		v, _, _, err := jsonparser.Get(respBody, "pager", "total")
@@ -707,3 +919,178 @@ func SyncAttributesToServer(serverName string) {
 	attributesPayload["attributes"] = syncAttributes
 	SendMetadata(server, attributesPayload)
 }
+
+// serverSecrets are the secret columns of a server row
+type serverSecrets struct {
+	ID         ServerID         `db:"id"`
+	Name       string           `db:"name"`
+	Password   string           `db:"password"`
+	AuthToken  string           `db:"auth_token"`
+	AuthConfig utils.AuthConfig `db:"auth_config"`
+}
+
+// RotateServerSecrets re-encrypts the secrets of all servers with the current master key. Plaintext
+// secrets are encrypted and those encrypted with a previous master key are decrypted and encrypted again.
+// Nothing is saved unless all rows are rotated, so a missing previous key leaves the servers untouched
+func RotateServerSecrets(db *sqlx.DB) (int, error) {
+	if !utils.EncryptionEnabled() {
+		return 0, errors.New("no master key configured")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var rows []serverSecrets
+	err = tx.Select(&rows, `SELECT id, name, password, auth_token, auth_config FROM servers ORDER BY id FOR UPDATE`)
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for _, row := range rows {
+		password, passwordRotated, err := utils.RotateSecret(row.Password)
+		if err != nil {
+			return 0, fmt.Errorf("server %s password: %w", row.Name, err)
+		}
+		authToken, authTokenRotated, err := utils.RotateSecret(row.AuthToken)
+		if err != nil {
+			return 0, fmt.Errorf("server %s auth token: %w", row.Name, err)
+		}
+		authConfig, authConfigRotated, err := row.AuthConfig.Rotated()
+		if err != nil {
+			return 0, fmt.Errorf("server %s auth config: %w", row.Name, err)
+		}
+		if !passwordRotated && !authTokenRotated && !authConfigRotated {
+			continue
+		}
+		_, err = tx.Exec(`UPDATE servers SET password = $1, auth_token = $2, auth_config = $3, updated = now()
+			WHERE id = $4`, password, authToken, authConfig, row.ID)
+		if err != nil {
+			return 0, err
+		}
+		rotated++
+		log.WithField("server", row.Name).Info("Server secrets re-encrypted")
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return rotated, nil
+}
+
+// ErrServerInUse is returned when deleting a server still referenced by requests or schedules
+var ErrServerInUse = errors.New("server is referenced by requests or schedules, suspend it instead")
+
+// GetServerByIDOrUID returns the server with the given id or uid
+func GetServerByIDOrUID(db *sqlx.DB, key string) (Server, error) {
+	srv := Server{}
+	err := db.Get(&srv.s, "SELECT * FROM servers WHERE id::text = $1 OR uid = $1 LIMIT 1", key)
+	if err != nil {
+		return Server{}, fmt.Errorf("server '%s' not found", key)
+	}
+	return srv, nil
+}
+
+// keepSecret returns the current value when a secret was left out or sent back redacted
+func keepSecret(value, current string) string {
+	if value == "" || value == utils.RedactedSecret {
+		return current
+	}
+	return value
+}
+
+// clearedSecrets are the secrets an update body sets to null
+type clearedSecrets struct {
+	Password   json.RawMessage `json:"password"`
+	AuthToken  json.RawMessage `json:"AuthToken"`
+	AuthConfig struct {
+		ClientSecret json.RawMessage `json:"clientSecret"`
+		HMACSecret   json.RawMessage `json:"hmacSecret"`
+	} `json:"authConfig"`
+}
+
+// updateSecret returns the value a secret takes after an update. null clears it
+func updateSecret(value, current string, raw json.RawMessage) string {
+	if string(raw) == "null" {
+		return ""
+	}
+	return keepSecret(value, current)
+}
+
+// applyUpdate applies the fields in the JSON body to the server. Secrets left out or sent back
+// redacted keep their current values while secrets set to null are cleared
+func (srv *Server) applyUpdate(body []byte) error {
+	current := srv.s
+	var cleared clearedSecrets
+	if err := json.Unmarshal(body, &cleared); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &srv.s); err != nil {
+		return err
+	}
+	srv.s.ID, srv.s.UID, srv.s.Created = current.ID, current.UID, current.Created
+	srv.s.Password = updateSecret(srv.s.Password, current.Password, cleared.Password)
+	srv.s.AuthToken = updateSecret(srv.s.AuthToken, current.AuthToken, cleared.AuthToken)
+	srv.s.AuthConfig.ClientSecret = updateSecret(srv.s.AuthConfig.ClientSecret, current.AuthConfig.ClientSecret,
+		cleared.AuthConfig.ClientSecret)
+	srv.s.AuthConfig.HMACSecret = updateSecret(srv.s.AuthConfig.HMACSecret, current.AuthConfig.HMACSecret,
+		cleared.AuthConfig.HMACSecret)
+	return nil
+}
+
+// UpdateServer applies the fields in the JSON body to the server and saves it.
+// Secrets left out or sent back redacted keep their current values and secrets set to null are cleared
+func UpdateServer(db *sqlx.DB, srv Server, body []byte) (Server, error) {
+	current := srv.s
+	if err := srv.applyUpdate(body); err != nil {
+		return srv, err
+	}
+	if srv.s.Name == "" {
+		return srv, errors.New("server name is required")
+	}
+	if err := srv.beforeSave(); err != nil {
+		return srv, err
+	}
+	if _, err := db.NamedExec(updateServerSQL, srv.s); err != nil {
+		log.WithError(err).WithField("server", current.Name).Error("Failed to update server!")
+		return srv, err
+	}
+	if len(srv.s.AllowedSources) > 0 {
+		servers := lo.Map(srv.s.AllowedSources, func(name string, _ int) int64 {
+			return GetServerIDByName(name)
+		})
+		allowedSources := ServerAllowedApps{ServerID: int64(srv.s.ID), AllowedServers: servers}
+		allowedSources.Save()
+	}
+	return GetServerByIDOrUID(db, srv.UID())
+}
+
+// SetServerSuspended suspends or resumes sending requests to a server
+func SetServerSuspended(db *sqlx.DB, id ServerID, suspended bool) (Server, error) {
+	_, err := db.Exec("UPDATE servers SET suspended = $1, updated = now() WHERE id = $2", suspended, id)
+	if err != nil {
+		log.WithError(err).WithField("serverID", id).Error("Failed to change server suspension")
+		return Server{}, err
+	}
+	return GetServerByIDOrUID(db, fmt.Sprintf("%d", id))
+}
+
+// DeleteServer deletes a server. Servers with requests or schedules cannot be deleted
+func DeleteServer(db *sqlx.DB, id ServerID) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.Exec("DELETE FROM server_allowed_sources WHERE server_id = $1", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM servers WHERE id = $1", id); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+			return ErrServerInUse
+		}
+		return err
+	}
+	return tx.Commit()
+}
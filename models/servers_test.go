@@ -0,0 +1,34 @@
+package models
+
+import (
+	"airqo-integrator/utils"
+	"testing"
+)
+
+func TestServerUpdateSecrets(t *testing.T) {
+	srv := Server{}
+	srv.s.Name, srv.s.Password, srv.s.AuthToken = "dhis2", "secret", "token"
+	srv.s.AuthConfig.ClientSecret, srv.s.AuthConfig.HMACSecret = "client", "hmac"
+
+	body := `{"name":"dhis2","password":"` + utils.RedactedSecret + `","AuthToken":null,
+		"authConfig":{"clientSecret":"rotated","hmacSecret":null}}`
+	if err := srv.applyUpdate([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if srv.s.Password != "secret" {
+		t.Errorf("redacted password changed to %q", srv.s.Password)
+	}
+	if srv.s.AuthToken != "" || srv.s.AuthConfig.HMACSecret != "" {
+		t.Errorf("secrets set to null kept %q and %q", srv.s.AuthToken, srv.s.AuthConfig.HMACSecret)
+	}
+	if srv.s.AuthConfig.ClientSecret != "rotated" {
+		t.Errorf("client secret is %q, want rotated", srv.s.AuthConfig.ClientSecret)
+	}
+
+	if err := srv.applyUpdate([]byte(`{"name":"renamed","password":""}`)); err != nil {
+		t.Fatal(err)
+	}
+	if srv.s.Name != "renamed" || srv.s.Password != "secret" || srv.s.AuthConfig.ClientSecret != "rotated" {
+		t.Errorf("update without secrets changed them: %q, %q", srv.s.Password, srv.s.AuthConfig.ClientSecret)
+	}
+}
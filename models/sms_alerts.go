@@ -0,0 +1,207 @@
+package models
+
+import (
+	"airqo-integrator/config"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMSSubscriber receives the SMS alerts of an org unit, a district or a sub-county, and of the org units below it
+type SMSSubscriber struct {
+	ID        int64     `db:"id" json:"id"`
+	OrgUnitID int64     `db:"orgunit_id" json:"orgUnitID"`
+	OrgUnit   string    `db:"orgunit" json:"orgUnit,omitempty"` // the org unit's name
+	MSISDN    string    `db:"msisdn" json:"msisdn"`
+	Name      string    `db:"name" json:"name"`
+	IsActive  bool      `db:"is_active" json:"isActive"`
+	Created   time.Time `db:"created" json:"created"`
+	Updated   time.Time `db:"updated" json:"updated"`
+}
+
+// NormalizeMSISDN strips spaces, dashes, parentheses and a leading + so numbers match the blacklist however
+// they were entered. The normalize_msisdn SQL function does the same to blacklisted numbers
+func NormalizeMSISDN(msisdn string) string {
+	msisdn = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(strings.TrimSpace(msisdn))
+	return strings.TrimPrefix(msisdn, "+")
+}
+
+// SaveSMSSubscriber adds a subscriber to the list of an org unit or updates the subscriber already there
+func SaveSMSSubscriber(db *sqlx.DB, s *SMSSubscriber) error {
+	s.MSISDN = NormalizeMSISDN(s.MSISDN)
+	if _, err := strconv.ParseUint(s.MSISDN, 10, 64); err != nil || len(s.MSISDN) < 9 {
+		return fmt.Errorf("invalid msisdn %s", s.MSISDN)
+	}
+	return db.Get(s, `
+		INSERT INTO sms_subscribers (orgunit_id, msisdn, name, is_active) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (orgunit_id, msisdn) DO UPDATE SET (name, is_active, updated) = (EXCLUDED.name, EXCLUDED.is_active, NOW())
+		RETURNING id, orgunit_id, msisdn, name, is_active, created, updated`,
+		s.OrgUnitID, s.MSISDN, s.Name, s.IsActive)
+}
+
+// ListSMSSubscribers returns the subscribers of an org unit, or of all org units when orgUnitID is 0
+func ListSMSSubscribers(db *sqlx.DB, orgUnitID int64) ([]SMSSubscriber, error) {
+	subscribers := []SMSSubscriber{}
+	err := db.Select(&subscribers, `
+		SELECT s.id, s.orgunit_id, o.name AS orgunit, s.msisdn, s.name, s.is_active, s.created, s.updated
+		FROM sms_subscribers s JOIN organisationunit o ON o.id = s.orgunit_id
+		WHERE $1 = 0 OR s.orgunit_id = $1
+		ORDER BY o.name, s.msisdn`, orgUnitID)
+	return subscribers, err
+}
+
+// DeleteSMSSubscriber removes a subscriber from its list
+func DeleteSMSSubscriber(db *sqlx.DB, id int64) error {
+	res, err := db.Exec("DELETE FROM sms_subscribers WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SMSAlertRecipients returns the active subscribers of the org unit and its ancestors, leaving out blacklisted numbers
+func SMSAlertRecipients(db sqlx.Queryer, orgUnitID int64) ([]string, error) {
+	var recipients []string
+	err := sqlx.Select(db, &recipients, `
+		SELECT DISTINCT s.msisdn FROM sms_subscribers s
+		JOIN organisationunit a ON a.id = s.orgunit_id
+		JOIN organisationunit o ON o.id = $1 AND (o.path = a.path OR o.path LIKE a.path || '/%')
+		WHERE s.is_active
+		  AND NOT EXISTS (SELECT 1 FROM blacklist b WHERE normalize_msisdn(b.msisdn) = s.msisdn)
+		ORDER BY s.msisdn`, orgUnitID)
+	return recipients, err
+}
+
+// PM25Category is a band of daily PM2.5 starting at Min µg/m³
+type PM25Category struct {
+	Name string  `json:"name"`
+	Min  float64 `json:"min"`
+}
+
+// Label is the category name as written in alerts, e.g. "unhealthy for sensitive groups"
+func (c PM25Category) Label() string {
+	return strings.ReplaceAll(c.Name, "_", " ")
+}
+
+// DefaultPM25Categories are the PM2.5 categories used when sms_pm25_categories is not set
+const DefaultPM25Categories = "good:0,moderate:12.1,unhealthy_for_sensitive_groups:35.5,unhealthy:55.5," +
+	"very_unhealthy:150.5,hazardous:250.5"
+
+// PM25Categories returns the configured PM2.5 categories from the cleanest, or DefaultPM25Categories when none are set
+func PM25Categories() ([]PM25Category, error) {
+	setting := config.AirQoIntegratorConf.API.SMSPM25Categories
+	if strings.TrimSpace(setting) == "" {
+		setting = DefaultPM25Categories
+	}
+	var categories []PM25Category
+	for _, pair := range strings.Split(setting, ",") {
+		name, bound, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid PM2.5 category %q, expected name:lower_bound", pair)
+		}
+		lower, err := strconv.ParseFloat(strings.TrimSpace(bound), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lower bound of PM2.5 category %s: %w", name, err)
+		}
+		if n := len(categories); n > 0 && lower <= categories[n-1].Min {
+			return nil, fmt.Errorf("PM2.5 category %s must start above %s", name, categories[n-1].Name)
+		}
+		categories = append(categories, PM25Category{Name: strings.TrimSpace(name), Min: lower})
+	}
+	return categories, nil
+}
+
+// PM25CategoryIndex returns the index of the category the daily PM2.5 falls in
+func PM25CategoryIndex(categories []PM25Category, pm25 float64) int {
+	index := 0
+	for i, c := range categories {
+		if pm25 >= c.Min {
+			index = i
+		}
+	}
+	return index
+}
+
+// SMSAlert is an alert sent to the subscribers of a sub-county
+type SMSAlert struct {
+	ID         int64     `db:"id" json:"id"`
+	ScheduleID int64     `db:"schedule_id" json:"scheduleID"`
+	OrgUnitID  int64     `db:"orgunit_id" json:"orgUnitID"`
+	Period     string    `db:"period" json:"period"`
+	Category   string    `db:"category" json:"category"`
+	PM25       float64   `db:"pm25" json:"pm25"`
+	Message    string    `db:"message" json:"message"`
+	Recipients int       `db:"recipients" json:"recipients"`
+	Failed     int       `db:"failed" json:"failed"`
+	Created    time.Time `db:"created" json:"created"`
+}
+
+// GetSMSAlert returns the alert of the org unit for the category and day, or nil when it was not sent
+func GetSMSAlert(db sqlx.Queryer, orgUnitID int64, period, category string) (*SMSAlert, error) {
+	var alert SMSAlert
+	err := sqlx.Get(db, &alert, `
+		SELECT id, COALESCE(schedule_id, 0) AS schedule_id, orgunit_id, TO_CHAR(period, 'YYYY-MM-DD') AS period,
+		    category, pm25, message, recipients, failed, created
+		FROM sms_alerts WHERE orgunit_id = $1 AND period = $2 AND category = $3`, orgUnitID, period, category)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return &alert, err
+}
+
+// PendingSMSAlerts returns the alerts of the schedule sent since the time given that some recipients did not get
+func PendingSMSAlerts(db sqlx.Queryer, scheduleID int64, since time.Time) ([]SMSAlert, error) {
+	var alerts []SMSAlert
+	err := sqlx.Select(db, &alerts, `
+		SELECT id, COALESCE(schedule_id, 0) AS schedule_id, orgunit_id, TO_CHAR(period, 'YYYY-MM-DD') AS period,
+		    category, pm25, message, recipients, failed, created
+		FROM sms_alerts WHERE schedule_id = $1 AND failed > 0 AND created >= $2
+		ORDER BY id`, scheduleID, since)
+	return alerts, err
+}
+
+// SMSAlertDeliveries returns the numbers the alert was delivered to
+func SMSAlertDeliveries(db sqlx.Queryer, alertID int64) ([]string, error) {
+	var delivered []string
+	err := sqlx.Select(db, &delivered, "SELECT msisdn FROM sms_alert_deliveries WHERE alert_id = $1", alertID)
+	return delivered, err
+}
+
+// RecordSMSAlert saves an alert, or the recipient counts of one saved by an earlier run, with the
+// numbers delivered to by this run. The alert's ID is set once saved
+func RecordSMSAlert(db *sqlx.DB, alert *SMSAlert, delivered []string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	rows, err := tx.NamedQuery(`
+		INSERT INTO sms_alerts (schedule_id, orgunit_id, period, category, pm25, message, recipients, failed)
+		VALUES (NULLIF(:schedule_id, 0), :orgunit_id, :period, :category, :pm25, :message, :recipients, :failed)
+		ON CONFLICT (orgunit_id, period, category) DO UPDATE SET (recipients, failed) = (EXCLUDED.recipients, EXCLUDED.failed)
+		RETURNING id`, alert)
+	if err != nil {
+		return err
+	}
+	if rows.Next() {
+		err = rows.Scan(&alert.ID)
+	}
+	_ = rows.Close()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO sms_alert_deliveries (alert_id, msisdn) SELECT $1, UNNEST($2::TEXT[])
+		ON CONFLICT DO NOTHING`, alert.ID, pq.StringArray(delivered)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,24 @@
+package models
+
+import "testing"
+
+func TestNormalizeMSISDNMatchesBlacklist(t *testing.T) {
+	for _, entered := range []string{"256772123456", "+256772123456", "+256 (772) 123-456", " 256-772-123-456 "} {
+		if got := NormalizeMSISDN(entered); got != "256772123456" {
+			t.Errorf("NormalizeMSISDN(%q) = %s, want 256772123456", entered, got)
+		}
+	}
+}
+
+func TestPM25CategoriesDefault(t *testing.T) {
+	categories, err := PM25Categories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(categories) != 6 || categories[0].Name != "good" || categories[5].Name != "hazardous" {
+		t.Fatalf("got categories %v, want the defaults", categories)
+	}
+	if got := categories[PM25CategoryIndex(categories, 40)].Label(); got != "unhealthy for sensitive groups" {
+		t.Errorf("PM2.5 of 40 is %s, want unhealthy for sensitive groups", got)
+	}
+}
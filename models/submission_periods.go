@@ -0,0 +1,100 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+// SubmissionWindow is a time range on some days of the week, in the server's time zone, during
+// which requests are sent to the server. Windows ending before they start run past midnight
+type SubmissionWindow struct {
+	Days  []int  `json:"days,omitempty"` // ISO days of the week, 1 = Monday. Empty means every day
+	Start string `json:"start"`          // HH:MM
+	End   string `json:"end"`            // HH:MM
+}
+
+// SubmissionWindows are the windows a server accepts requests in. Servers without
+// windows use their start and end submission period hours
+type SubmissionWindows []SubmissionWindow
+
+// Value implements the driver.Valuer interface
+func (w SubmissionWindows) Value() (driver.Value, error) {
+	if w == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(w)
+}
+
+// Scan implements the sql.Scanner interface
+func (w *SubmissionWindows) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, w)
+}
+
+// Validate checks the days and times of the windows
+func (w SubmissionWindows) Validate() error {
+	for i, window := range w {
+		for _, day := range window.Days {
+			if day < 1 || day > 7 {
+				return fmt.Errorf("submission window %d: day %d is not an ISO day of the week (1-7)", i+1, day)
+			}
+		}
+		for _, t := range []string{window.Start, window.End} {
+			if t == "" {
+				continue
+			}
+			if _, err := time.Parse("15:04", t); err != nil {
+				return fmt.Errorf("submission window %d: time '%s' is not HH:MM", i+1, t)
+			}
+		}
+	}
+	return nil
+}
+
+// validateSubmissionSettings checks the server's time zone, submission windows and blackout dates
+func (s *Server) validateSubmissionSettings() error {
+	if s.s.Timezone != "" {
+		if _, err := time.LoadLocation(s.s.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone '%s'", s.s.Timezone)
+		}
+	}
+	if err := s.s.SubmissionWindows.Validate(); err != nil {
+		return err
+	}
+	for _, d := range s.s.BlackoutDates {
+		if _, err := time.Parse("2006-01-02", d); err != nil {
+			return fmt.Errorf("blackout date '%s' is not YYYY-MM-DD", d)
+		}
+	}
+	return nil
+}
+
+// ErrSourceNotAllowed is returned when queueing a request from a source the destination does not allow
+var ErrSourceNotAllowed = errors.New("source is not allowed to send requests to destination")
+
+// IsAllowedSource returns whether the destination accepts requests from the source.
+// Destinations without allowed sources accept requests from any source
+func IsAllowedSource(db *sqlx.DB, source, destination int) (bool, error) {
+	var allowed bool
+	err := db.Get(&allowed, "SELECT is_allowed_source($1, $2)", source, destination)
+	return allowed, err
+}
+
+// checkAllowedSource returns ErrSourceNotAllowed when the destination does not accept requests from the source
+func checkAllowedSource(db *sqlx.DB, source, destination int) error {
+	allowed, err := IsAllowedSource(db, source, destination)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%w: source %d, destination %d", ErrSourceNotAllowed, source, destination)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"airqo-integrator/config"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// requestLane holds the ready requests of one object_type, already ordered by priority
+type requestLane struct {
+	name          string
+	weight        int
+	currentWeight int
+	requests      []int
+}
+
+// readyRequestsSQL reads at most $1 ready requests per lane (object_type). Within a lane
+// requests are ordered by priority then by the original depends_on desc, created order
+const readyRequestsSQL = `
+SELECT id, object_type FROM (
+    SELECT id, object_type,
+        ROW_NUMBER() OVER (
+            PARTITION BY object_type ORDER BY priority DESC, depends_on DESC, created) AS lane_position
+    FROM requests
+    WHERE status = 'ready' AND status_of_dependence(id) IN ('completed', 'partial', '')
+) lanes
+WHERE lane_position <= $1
+ORDER BY object_type, lane_position
+`
+
+// laneWeights parses the request_lane_weights config e.g "ORGUNIT_GROUP_ADD:3,AGGREGATE_DATA:1"
+func laneWeights() map[string]int {
+	weights := make(map[string]int)
+	for _, pair := range strings.Split(config.AirQoIntegratorConf.Server.RequestLaneWeights, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || weight < 1 {
+			continue
+		}
+		weights[strings.TrimSpace(parts[0])] = weight
+	}
+	return weights
+}
+
+// laneBatchSize returns the maximum number of ready requests read per lane on each producer run
+func laneBatchSize() int {
+	if config.AirQoIntegratorConf.Server.RequestLaneBatchSize > 0 {
+		return config.AirQoIntegratorConf.Server.RequestLaneBatchSize
+	}
+	return 50
+}
+
+// scheduleLanes interleaves the requests of all lanes using smooth weighted round-robin,
+// so a lane with a large backlog cannot delay the requests in the other lanes
+func scheduleLanes(lanes map[string]*requestLane) []int {
+	var active []*requestLane
+	total := 0
+	for _, lane := range lanes {
+		active = append(active, lane)
+		total += len(lane.requests)
+	}
+	// keep the schedule stable between runs
+	sort.Slice(active, func(i, j int) bool { return active[i].name < active[j].name })
+
+	ordered := make([]int, 0, total)
+	for len(ordered) < total {
+		var picked *requestLane
+		totalWeight := 0
+		for _, lane := range active {
+			if len(lane.requests) == 0 {
+				continue
+			}
+			lane.currentWeight += lane.weight
+			totalWeight += lane.weight
+			if picked == nil || lane.currentWeight > picked.currentWeight {
+				picked = lane
+			}
+		}
+		picked.currentWeight -= totalWeight
+		ordered = append(ordered, picked.requests[0])
+		picked.requests = picked.requests[1:]
+	}
+	return ordered
+}
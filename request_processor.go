@@ -4,10 +4,9 @@ import (
 	"airqo-integrator/config"
 	"airqo-integrator/db"
 	"airqo-integrator/models"
+	"airqo-integrator/utils"
 	"airqo-integrator/utils/dbutils"
-	"bytes"
-	"crypto/tls"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,6 +16,7 @@ import (
 	"github.com/samber/lo"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"strings"
@@ -78,11 +78,12 @@ type RequestObject struct {
 	Status             models.RequestStatus `db:"status"`
 	StatusCode         string               `db:"statuscode"`
 	Errors             string               `db:"errors"`
+	ExternalRef        string               `db:"external_ref"`
 }
 
 const updateRequestSQL = `
-UPDATE requests SET (status, statuscode, errors, retries, response, updated)
-	= (:status, :statuscode, :errors, :retries, :response, current_timestamp) WHERE id = :id
+UPDATE requests SET (status, statuscode, errors, retries, response, external_ref, updated)
+	= (:status, :statuscode, :errors, :retries, :response, :external_ref, current_timestamp) WHERE id = :id
 `
 const updateStatusSQL = `
 	UPDATE requests SET (status,  updated) = (:status, current_timestamp)
@@ -91,7 +92,7 @@ const updateStatusSQL = `
 const selectRequestObjectSQL = `
 SELECT id, source, destination, depends_on, cc_servers, cc_servers_status, body, 
 	response, retries, ctype, object_type, body_is_query_param, submissionid, 
-	url_suffix, suspended, status, statuscode, errors
+	url_suffix, suspended, status, statuscode, errors, external_ref
 FROM requests WHERE id = $1;
 `
 
@@ -100,11 +101,12 @@ func (r *RequestObject) HasDependency() bool {
 	return r.DependsOn > 0
 }
 
-// DependencyCompleted returns true request's dependent request was completed
+// DependencyCompleted returns true when all the requests the request depends on were completed,
+// or when they are done and the request's dependency policy is to proceed
 func (r *RequestObject) DependencyCompleted(tx *sqlx.Tx) bool {
 	if r.HasDependency() {
 		completed := false
-		err := tx.Get(&completed, "SELECT status = 'completed' FROM requests WHERE id = $1", r.DependsOn)
+		err := tx.Get(&completed, "SELECT status_of_dependence($1) IN ('completed', 'partial', '')", r.ID)
 		if err != nil {
 			log.WithError(err).Info("Error reading dependent request status")
 			return false
@@ -151,6 +153,34 @@ func (r *RequestObject) updateRequestStatus(tx *sqlx.Tx) {
 	}
 }
 
+// markOutcomeUnknown records that the send to destination was interrupted before its outcome was known.
+// Such requests are not retried automatically but left for reconciliation against the destination
+func (r *RequestObject) markOutcomeUnknown(tx *sqlx.Tx, destination models.Server, serverInCC bool) {
+	summary := "Send interrupted by shutdown. Outcome unknown"
+	if serverInCC {
+		newServerStatus := make(map[string]interface{})
+		newServerStatus["errors"] = summary
+		newServerStatus["status"] = models.RequestStatusUnknown
+		newServerStatus["statusCode"] = "ERROR04"
+		newServerStatus["retries"] = 0
+		if serverStatus, ok := r.CCServersStatus[fmt.Sprintf("%d", destination.ID())].(map[string]interface{}); ok {
+			newServerStatus["retries"] = serverStatus["retries"]
+		}
+		r.CCServersStatus[fmt.Sprintf("%d", destination.ID())] = newServerStatus
+		r.updateCCServerStatus(tx)
+	} else {
+		r.Status = models.RequestStatusUnknown
+		r.StatusCode = "ERROR04"
+		r.Errors = summary
+		r.updateRequest(tx)
+	}
+	log.WithFields(log.Fields{
+		"requestID":  r.ID,
+		"server":     destination.Name(),
+		"serverInCC": serverInCC,
+	}).Warn("Request send interrupted. Marked with unknown outcome")
+}
+
 // WithStatus updates the RequestObj status with passed value
 func (r *RequestObject) WithStatus(s models.RequestStatus) *RequestObject { r.Status = s; return r }
 
@@ -201,8 +231,9 @@ func (r *RequestObject) canSendRequest(tx *sqlx.Tx, server models.Server, server
 		if !r.InSubmissionPeriod {
 			reason = "Destination server out of submission period."
 			log.WithFields(log.Fields{
-				"server": server.ID,
-				"name":   server.Name,
+				"server":   server.ID(),
+				"name":     server.Name(),
+				"timezone": server.Timezone(),
 			}).Info("Destination server out of submission period")
 			return false
 		}
@@ -244,7 +275,7 @@ func (r *RequestObject) canSendRequest(tx *sqlx.Tx, server models.Server, server
 		})
 		if len(ccServers) > 0 {
 			var ccServerStatus ServerStatus
-			if ccServerObject, ok := models.ServerMap[fmt.Sprintf("%d", ccServers[0])]; ok {
+			if ccServerObject, ok := models.LookupServer(fmt.Sprintf("%d", ccServers[0])); ok {
 				// get server status from request
 				if ccstatusObj, ok := r.CCServersStatus[fmt.Sprintf("%d", ccServerObject.ID())]; ok {
 
@@ -349,35 +380,149 @@ func (r *RequestObject) canSendRequest(tx *sqlx.Tx, server models.Server, server
 
 }
 
-func (r *RequestObject) unMarshalBody() (interface{}, error) {
-	var data interface{}
-	switch r.ObjectType {
-	case "ORGANISATION_UNITS":
-		//data = models.DataValuesRequest{}
-		//err := json.Unmarshal([]byte(r.Body), &data)
-		//if err != nil {
-		//	return nil, err
-		//}
+// mediaType returns the request content type without parameters such as charset
+func (r *RequestObject) mediaType() string {
+	mediaType, _, err := mime.ParseMediaType(r.ContentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(r.ContentType))
+	}
+	return mediaType
+}
+
+// unMarshalJSONObject decodes a JSON object body keeping numbers as they were written
+func (r *RequestObject) unMarshalJSONObject() (map[string]interface{}, error) {
+	var data map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(r.Body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// formValues flattens a JSON object into form values. Arrays become repeated keys
+// while nested objects are passed as JSON strings
+func formValues(data map[string]interface{}) url.Values {
+	values := url.Values{}
+	for k, v := range data {
+		switch val := v.(type) {
+		case nil:
+			values.Add(k, "")
+		case []interface{}:
+			for _, item := range val {
+				values.Add(k, formValue(item))
+			}
+		default:
+			values.Add(k, formValue(val))
+		}
+	}
+	return values
+}
+
+func formValue(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(val)
+		return string(b)
 	default:
-		data = map[string]interface{}{}
-		err := json.Unmarshal([]byte(r.Body), &data)
+		return fmt.Sprintf("%v", val)
+	}
+}
+
+// requestPayload returns the body to dispatch based on the request content type. When the body is
+// meant to be used as query parameters, no body is returned but the parameters to add to the URL
+func (r *RequestObject) requestPayload() (io.Reader, url.Values, error) {
+	if r.BodyIsQueryParams {
+		data, err := r.unMarshalJSONObject()
 		if err != nil {
-			return nil, err
+			return nil, nil, fmt.Errorf("request body is not a JSON object usable as query parameters: %w", err)
+		}
+		return nil, formValues(data), nil
+	}
+	switch r.mediaType() {
+	case "application/json", "application/json-patch+json", "application/geo+json", "application/fhir+json":
+		// sent as written so numbers keep their precision
+		if !json.Valid([]byte(r.Body)) {
+			return nil, nil, errors.New("request body is not valid JSON")
+		}
+		return strings.NewReader(r.Body), nil, nil
+	case "application/x-www-form-urlencoded":
+		// the body is either already form encoded or a JSON object to encode
+		if strings.HasPrefix(strings.TrimSpace(r.Body), "{") {
+			data, err := r.unMarshalJSONObject()
+			if err != nil {
+				return nil, nil, err
+			}
+			return strings.NewReader(formValues(data).Encode()), nil, nil
 		}
+		if _, err := url.ParseQuery(strings.TrimSpace(r.Body)); err != nil {
+			return nil, nil, fmt.Errorf("invalid form body: %w", err)
+		}
+		return strings.NewReader(strings.TrimSpace(r.Body)), nil, nil
+	default:
+		// XML and other raw bodies are passed through unchanged
+		return strings.NewReader(r.Body), nil, nil
+	}
+}
 
+// applySendFailure records a send that failed before the server answered, e.g. the server was unreachable or
+// the body could not be transformed for it. A CC server only fails its own copy of the request
+func (r *RequestObject) applySendFailure(serverID models.ServerID, serverInCC bool, err error) {
+	if !serverInCC {
+		r.Status = models.RequestStatusFailed
+		r.StatusCode = "ERROR02"
+		r.Errors = "Server possibly unreachable"
+		r.Retries += 1
+		return
 	}
-	return data, nil
+	// count the try so a CC server that keeps failing expires
+	key := fmt.Sprintf("%d", serverID)
+	serverStatus, ok := r.CCServersStatus[key].(map[string]interface{})
+	if !ok {
+		serverStatus = map[string]interface{}{}
+		if r.CCServersStatus == nil {
+			r.CCServersStatus = make(dbutils.MapAnything)
+		}
+		r.CCServersStatus[key] = serverStatus
+	}
+	switch retries := serverStatus["retries"].(type) {
+	case float64:
+		serverStatus["retries"] = int(retries) + 1
+	case int:
+		serverStatus["retries"] = retries + 1
+	default:
+		serverStatus["retries"] = 1
+	}
+	r.applyServerOutcome(serverID, true, models.RequestStatusFailed, "ERROR02", fmt.Sprintf("Failed to send request: %v", err))
 }
 
-// sendRequest sends request to destination server
-func (r *RequestObject) sendRequest(destination models.Server) (*http.Response, error) {
-	data, err := r.unMarshalBody()
+// transformedFor returns a copy of the request with the body rewritten by the transforms of a server.
+// Each server may need the body rewritten for its own metadata, so the request itself is left as is
+func (r *RequestObject) transformedFor(transforms models.BodyTransforms) (RequestObject, error) {
+	outgoing := *r
+	if len(transforms) > 0 {
+		body, err := transforms.Apply([]byte(r.Body), r.ObjectType)
+		if err != nil {
+			return outgoing, err
+		}
+		outgoing.Body = string(body)
+	}
+	return outgoing, nil
+}
+
+// sendRequest sends request to destination server. The send is aborted when ctx is cancelled
+func (r *RequestObject) sendRequest(ctx context.Context, destination models.Server) (*http.Response, error) {
+	outgoing, err := r.transformedFor(destination.BodyTransforms())
 	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"request": r.ID, "server": destination.Name()}).Error("Failed to transform request body")
 		return nil, err
 	}
-	marshalled, err := json.Marshal(data)
+	payload, queryParams, err := outgoing.requestPayload()
 	if err != nil {
-		fmt.Printf("Failed to marshal request body")
+		log.WithError(err).WithField("request", r.ID).Error("Failed to build request body")
 		return nil, err
 	}
 	destURL := destination.URL()
@@ -385,122 +530,154 @@ func (r *RequestObject) sendRequest(destination models.Server) (*http.Response,
 		destURL += r.URLSurffix
 	}
 	completeURL := AddParamsToURL(destURL, destination.URLParams())
+	if len(queryParams) > 0 {
+		if !strings.HasSuffix(completeURL, "?") {
+			completeURL += "&"
+		}
+		completeURL += queryParams.Encode()
+	}
 	log.WithFields(log.Fields{
-		"request": r.ID,
-		"server":  destination.ID(),
-		"url":     completeURL,
+		"request":     r.ID,
+		"server":      destination.ID(),
+		"url":         completeURL,
+		"contentType": r.mediaType(),
 	}).Info("Sending request to destination server")
-	req, err := http.NewRequest(destination.HTTPMethod(), completeURL, bytes.NewReader(marshalled))
-
-	switch destination.AuthMethod() {
-	case "Token":
-		// Add API token
-		tokenAuth := "ApiToken " + destination.AuthToken()
-		req.Header.Set("Authorization", tokenAuth)
-		log.WithField("AuthToken", tokenAuth).Info("The authentication token:")
-	case "Basic", "Basic Auth":
-		auth := destination.Username() + ":" + destination.Password()
-		basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
-		req.Header.Set("Authorization", basicAuth)
-
-	default: // Basic Auth
-		// Add basic authentication
-		// auth := destination.Username() + ":" + destination.Password()
-		// basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
-		// req.Header.Set("Authorization", basicAuth)
-
+	req, err := http.NewRequestWithContext(ctx, destination.HTTPMethod(), completeURL, payload)
+	if err != nil {
+		return nil, err
 	}
 
-	req.Header.Set("Content-Type", r.ContentType)
-	// Create custom transport with TLS settings
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			// Set any necessary TLS settings here
-			// For example, to disable certificate validation:
-			InsecureSkipVerify: true,
-		},
+	if payload != nil {
+		req.Header.Set("Content-Type", r.ContentType)
+	}
+	// authenticate after the body and headers are set since HMAC signs the request
+	log.WithFields(log.Fields{
+		"server":     destination.Name(),
+		"authMethod": destination.AuthMethod(),
+		"hasToken":   destination.HasAuthToken(),
+	}).Debug("Authenticating request")
+	auth, err := destination.AuthProvider()
+	if err != nil {
+		log.WithError(err).WithField("server", destination.Name()).Error("Unsupported server auth method")
+		return nil, err
+	}
+	if err := auth.Authenticate(req); err != nil {
+		log.WithError(err).WithField("server", destination.Name()).Error("Failed to authenticate request")
+		return nil, err
+	}
+	client, err := destination.HTTPClient()
+	if err != nil {
+		log.WithError(err).WithField("server", destination.Name()).Error("Failed to configure server transport")
+		return nil, err
 	}
-
-	client := &http.Client{Transport: tr}
 
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// the cached token may have been revoked, the retry will fetch a new one
+		if oauth, ok := auth.(utils.OAuth2ClientCredentials); ok {
+			oauth.Invalidate()
+		}
+	}
 	return resp, nil
 }
 
 // var RequestsMap = make(map[string]int)
 
-// Produce gets all the ready requests in the queue
-func Produce(db *sqlx.DB, jobs chan<- int, wg *sync.WaitGroup, mutex *sync.Mutex, seenMap map[models.RequestID]bool) {
+// Produce gets all the ready requests in the queue. Requests are read per lane (object_type)
+// and interleaved by lane weight so that a large backlog in one lane does not starve the others.
+// The producer stops claiming requests once ctx is cancelled and closes jobs so the consumers can drain
+func Produce(ctx context.Context, db *sqlx.DB, jobs chan<- int, wg *sync.WaitGroup, mutex *sync.RWMutex, seenMap map[models.RequestID]bool) {
 	defer wg.Done()
+	defer close(jobs)
 	log.Println("Producer staring:!!!")
 
-	// RequestsMap[""] = 6
+	interval := time.Duration(config.AirQoIntegratorConf.Server.RequestProcessInterval) * time.Second
+	maintenance := &maintenanceGate{producer: "requests"}
 	for {
-
-		// log.Println("Going to read requests")
-		rows, err := db.Queryx(`
-                SELECT 
-                    id FROM requests 
-                WHERE status = $1  and status_of_dependence(id) IN ('completed', '') 
-                ORDER BY depends_on desc, created LIMIT 100000
-                `, "ready")
+		if maintenance.closed(db) {
+			if !sleepContext(ctx, interval) {
+				log.Info("Producer stopped")
+				return
+			}
+			continue
+		}
+		rows, err := db.QueryxContext(ctx, readyRequestsSQL, laneBatchSize())
 		if err != nil {
+			if ctx.Err() != nil {
+				log.Info("Producer stopped")
+				return
+			}
 			log.WithError(err).Error("ERROR READING READY REQUESTS!!!")
+			if !sleepContext(ctx, interval) {
+				log.Info("Producer stopped")
+				return
+			}
+			continue
 		}
+		weights := laneWeights()
+		lanes := make(map[string]*requestLane)
 		requestsCount := 0
 		for rows.Next() {
-
-			requestsCount += 1
 			var requestID int
-			err := rows.Scan(&requestID)
+			var objectType string
+			err := rows.Scan(&requestID, &objectType)
 			if err != nil {
-				// log.Fatalln("==>", err)
 				log.WithError(err).Error("Error reading request from queue:")
-			}
-			mutex.Lock()
-			if _, exists := seenMap[models.RequestID(requestID)]; exists {
-				log.WithField("requestID", requestID).Info("Request already in dynamic queue")
 				continue
 			}
-			mutex.Unlock()
-			go func(req int) {
-				// Let see if we can recover from panics XXX
-				defer func() {
-					if r := recover(); r != nil {
-						fmt.Println("Recovered in Produce", r)
-
-					}
-				}()
-				mutex.Lock()
-				defer mutex.Unlock()
-				//if _, exists := seenMap[models.RequestID(req)]; exists {
-				//	log.WithField("requestID", req).Info("Request already in dynamic queue")
-				//	return
-				//}
-				jobs <- req
-				seenMap[models.RequestID(req)] = true
-				log.Info(fmt.Sprintf("Added Request [id: %v]", req))
-			}(requestID)
-
+			lane, ok := lanes[objectType]
+			if !ok {
+				lane = &requestLane{name: objectType, weight: 1}
+				if w, ok := weights[objectType]; ok {
+					lane.weight = w
+				}
+				lanes[objectType] = lane
+			}
+			lane.requests = append(lane.requests, requestID)
+			requestsCount += 1
 		}
 		if err := rows.Err(); err != nil {
 			log.WithError(err).Error("Error reading requests")
 		}
 		_ = rows.Close()
 		if requestsCount > 0 {
-			log.WithField("requestsAdded", requestsCount).Info("Fetched Requests")
+			log.WithFields(log.Fields{"requestsAdded": requestsCount, "lanes": len(lanes)}).Info("Fetched Requests")
+		}
+
+		for _, requestID := range scheduleLanes(lanes) {
+			mutex.Lock()
+			if _, exists := seenMap[models.RequestID(requestID)]; exists {
+				mutex.Unlock()
+				log.WithField("requestID", requestID).Info("Request already in dynamic queue")
+				continue
+			}
+			seenMap[models.RequestID(requestID)] = true
+			mutex.Unlock()
+			// sending blocks until a consumer is free, which keeps the lane order
+			select {
+			case jobs <- requestID:
+				log.Info(fmt.Sprintf("Added Request [id: %v]", requestID))
+			case <-ctx.Done():
+				mutex.Lock()
+				delete(seenMap, models.RequestID(requestID))
+				mutex.Unlock()
+				log.Info("Producer stopped")
+				return
+			}
 		}
 		// Not good enough but let's bare with the sleep this initial version
-		time.Sleep(
-			time.Duration(config.AirQoIntegratorConf.Server.RequestProcessInterval) * time.Second)
+		if !sleepContext(ctx, interval) {
+			log.Info("Producer stopped")
+			return
+		}
 	}
 }
 
-// Consume is the consumer go routine
-func Consume(db *sqlx.DB, worker int, jobs <-chan int, wg *sync.WaitGroup, mutex *sync.RWMutex, seenMap map[models.RequestID]bool) {
+// Consume is the consumer go routine. It runs until jobs is closed, ctx only aborts in-flight sends
+func Consume(ctx context.Context, db *sqlx.DB, worker int, jobs <-chan int, wg *sync.WaitGroup, mutex *sync.RWMutex, seenMap map[models.RequestID]bool) {
 	defer wg.Done()
 	fmt.Println("Calling Consumer")
 
@@ -513,7 +690,7 @@ func Consume(db *sqlx.DB, worker int, jobs <-chan int, wg *sync.WaitGroup, mutex
                 SELECT
                         id, depends_on,source, destination, cc_servers, cc_servers_status, body, retries, in_submission_period(destination),
                         ctype, object_type, body_is_query_param, submissionid, url_suffix,suspended,
-                        statuscode, status, errors
+                        statuscode, status, errors, external_ref
                         
                 FROM requests
                 WHERE id = $1 FOR UPDATE NOWAIT`, req).StructScan(&reqObj)
@@ -526,19 +703,25 @@ func Consume(db *sqlx.DB, worker int, jobs <-chan int, wg *sync.WaitGroup, mutex
 		/* Work on the request */
 		// dest = utils.GetServer(reqObj.Destination)
 		// log.WithFields(log.Fields{"servers": models.ServerMap}).Info("Servers")
-		if reqDestination, ok := models.ServerMap[fmt.Sprintf("%d", reqObj.Destination)]; ok {
+		if reqDestination, ok := models.LookupServer(fmt.Sprintf("%d", reqObj.Destination)); ok {
 			if config.AirQoIntegratorConf.Server.FakeSyncToBaseDHIS2 {
 				reqObj.WithStatus(models.RequestStatusCompleted).updateRequestStatus(tx)
 				reqObj.StatusCode = "FAKED"
 				reqObj.updateRequest(tx)
-			} else {
-				_ = ProcessRequest(tx, reqObj, reqDestination, false, false)
+			} else if err := ProcessRequest(ctx, tx, reqObj, reqDestination, false, false); errors.Is(err, errNotSent) ||
+				errors.Is(err, errServerBusy) {
+				// release the request's lock without recording anything
+				_ = tx.Rollback()
+				mutex.Lock()
+				delete(seenMap, models.RequestID(req))
+				mutex.Unlock()
+				continue
 			}
 
 			lo.Map(reqObj.CCServers, func(item int32, index int) error {
-				if ccServer, ok := models.ServerMap[fmt.Sprintf("%d", item)]; ok {
+				if ccServer, ok := models.LookupServer(fmt.Sprintf("%d", item)); ok {
 					log.WithFields(log.Fields{"CCServerID": item, "ServerIndex=>": index}).Info("!CC Server:")
-					return ProcessRequest(tx, reqObj, ccServer, true, false)
+					return ProcessRequest(ctx, tx, reqObj, ccServer, true, false)
 				} else {
 					log.WithField("ServerID", item).Info("Sever not in Map")
 				}
@@ -548,8 +731,8 @@ func Consume(db *sqlx.DB, worker int, jobs <-chan int, wg *sync.WaitGroup, mutex
 			// Using Go lodash to process
 			lo.Map(reqObj.CCServers, func(item int32, index int) error {
 				log.WithFields(log.Fields{"CCServerID": item, "ServerIndex==>": index}).Info("!!CC Server:")
-				if ccServer, ok := models.ServerMap[fmt.Sprintf("%d", item)]; ok {
-					return ProcessRequest(tx, reqObj, ccServer, true, false)
+				if ccServer, ok := models.LookupServer(fmt.Sprintf("%d", item)); ok {
+					return ProcessRequest(ctx, tx, reqObj, ccServer, true, false)
 				} else {
 					log.WithField("ServerID", item).Info("Sever not in Map>")
 
@@ -576,27 +759,70 @@ func Consume(db *sqlx.DB, worker int, jobs <-chan int, wg *sync.WaitGroup, mutex
 
 }
 
-// ProcessRequest handles a ready request
-func ProcessRequest(tx *sqlx.Tx, reqObj RequestObject, destination models.Server, serverInCC, skipCheck bool) error {
+// ProcessRequest handles a ready request. Cancelling ctx aborts the send, in which case
+// the request is marked with an unknown outcome
+func ProcessRequest(ctx context.Context, tx *sqlx.Tx, reqObj RequestObject, destination models.Server, serverInCC, skipCheck bool) error {
 	if skipCheck || reqObj.canSendRequest(tx, destination, serverInCC) {
 		log.WithFields(log.Fields{"requestID": reqObj.ID}).Info("Request can be processed")
+		// honour the server's concurrency and rate limits. A busy server must not hold up the consumer
+		// and so the other servers' requests. A CC server's copy is left for RetryIncompleteRequests
+		// to pick up later while a request to a busy destination is left ready for the producer
+		throttle := getServerThrottle(destination)
+		if !throttle.tryAcquire() {
+			log.WithFields(log.Fields{
+				"requestID":  reqObj.ID,
+				"server":     destination.Name(),
+				"serverInCC": serverInCC,
+			}).Info("Server at its request limit. Request left for later")
+			if serverInCC {
+				return nil
+			}
+			return errServerBusy
+		}
+		defer throttle.release()
+		if ctx.Err() != nil {
+			log.WithField("requestID", reqObj.ID).Info("Shutting down. Request left for next run")
+			return errNotSent
+		}
 		// send request
-		resp, err := reqObj.sendRequest(destination)
+		resp, err := reqObj.sendRequest(ctx, destination)
 		if err != nil {
-			log.WithError(err).WithField("RequestID", reqObj.ID).Error(
+			if ctx.Err() != nil {
+				reqObj.markOutcomeUnknown(tx, destination, serverInCC)
+				return err
+			}
+			log.WithError(err).WithFields(log.Fields{"RequestID": reqObj.ID, "serverInCC": serverInCC}).Error(
 				"Failed to send request")
-			reqObj.Status = models.RequestStatusFailed
-			reqObj.StatusCode = "ERROR02"
-			reqObj.Errors = "Server possibly unreachable"
-			reqObj.Retries += 1
-			reqObj.updateRequest(tx)
+			reqObj.applySendFailure(destination.ID(), serverInCC, err)
+			if serverInCC {
+				reqObj.updateCCServerStatus(tx)
+			} else {
+				reqObj.updateRequest(tx)
+			}
 			return err
 		}
 
+		if destination.UsesResponseRules() {
+			respBody, err := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if err != nil && ctx.Err() != nil {
+				reqObj.markOutcomeUnknown(tx, destination, serverInCC)
+				return err
+			}
+			outcome := evaluateResponse(destination, resp, respBody)
+			reqObj.recordResponseOutcome(tx, destination, serverInCC, resp.StatusCode, outcome, respBody)
+			return nil
+		}
+
 		if !destination.UseAsync() {
 			result := models.ImportSummary{}
-			respBody, _ := io.ReadAll(resp.Body)
-			err := json.Unmarshal(respBody, &result)
+			respBody, err := io.ReadAll(resp.Body)
+			if err != nil && ctx.Err() != nil {
+				_ = resp.Body.Close()
+				reqObj.markOutcomeUnknown(tx, destination, serverInCC)
+				return err
+			}
+			err = json.Unmarshal(respBody, &result)
 			// err := json.NewDecoder(resp.Body).Decode(&result)
 			if err != nil {
 				if serverInCC {
@@ -620,14 +846,27 @@ func ProcessRequest(tx *sqlx.Tx, reqObj RequestObject, destination models.Server
 					return err
 				}
 			}
+			// data imports report importCount while metadata imports report stats
+			importCount := result.Response.ImportCount
+			if importCount == (models.ImportCount{}) {
+				importCount = result.Response.Stats
+			}
+			if len(result.Response.Conflicts) > 0 {
+				// the conflicts are rolled back on failure, the outcome below is still recorded
+				if err := models.SaveRequestConflicts(
+					tx, reqObj.ID, destination.ID(), result.Response.Conflicts); err != nil {
+					log.WithError(err).WithFields(log.Fields{
+						"requestID": reqObj.ID, "server": destination.Name()}).Error("Failed to save request conflicts")
+				}
+			}
 			if resp.StatusCode/100 == 2 {
-
+				importStatus := models.ImportStatus(result.Response.Status, importCount)
+				summary := models.ImportCountSummary(importCount)
 				if serverInCC {
 					serverStatus := reqObj.CCServersStatus[fmt.Sprintf("%d", destination.ID())].(map[string]interface{})
-					summary := fmt.Sprintf("Created: %d, Updated: %d", result.Response.Stats.Created, result.Response.Stats.Updated)
 					newServerStatus := make(map[string]interface{})
 					newServerStatus["errors"] = summary
-					newServerStatus["status"] = models.RequestStatusCompleted
+					newServerStatus["status"] = importStatus
 					newServerStatus["statusCode"] = fmt.Sprintf("%d", resp.StatusCode)
 					newServerStatus["retries"] = serverStatus["retries"]
 					reqObj.CCServersStatus[fmt.Sprintf("%d", destination.ID())] = newServerStatus
@@ -635,23 +874,24 @@ func ProcessRequest(tx *sqlx.Tx, reqObj RequestObject, destination models.Server
 					_, _ = tx.NamedExec(`UPDATE requests SET cc_servers_status = :cc_servers_status WHERE id = :id`, reqObj)
 
 				} else {
-					summary := fmt.Sprintf("Created: %d, Updated: %d", result.Response.Stats.Created, result.Response.Stats.Updated)
 					reqObj.StatusCode = fmt.Sprintf("%d", resp.StatusCode)
 					reqObj.Errors = summary
 					reqObj.Retries += 1
-					reqObj.Status = models.RequestStatusCompleted
+					reqObj.Status = importStatus
 					reqObj.updateRequest(tx)
-					reqObj.WithStatus(models.RequestStatusCompleted).updateRequestStatus(tx)
 				}
 				log.WithFields(log.Fields{
-					"status":     result.Response.Status,
-					"created":    result.Response.Stats.Created,
-					"updated":    result.Response.Stats.Updated,
-					"total":      result.Response.Stats.Total,
-					"serverDBId": destination.ID(),
-					"requestID":  reqObj.ID,
+					"status":       result.Response.Status,
+					"importStatus": importStatus,
+					"imported":     importCount.Imported,
+					"created":      importCount.Created,
+					"updated":      importCount.Updated,
+					"ignored":      importCount.Ignored,
+					"conflicts":    len(result.Response.Conflicts),
+					"serverDBId":   destination.ID(),
+					"requestID":    reqObj.ID,
 					// "response": string(respBody),
-				}).Info("Request completed successfully!")
+				}).Info("Request processed by destination server")
 				// reqObj.CCServersStatus.Scan()
 				return nil
 			} else {
@@ -680,6 +920,11 @@ func ProcessRequest(tx *sqlx.Tx, reqObj RequestObject, destination models.Server
 					reqObj.StatusCode = fmt.Sprintf("%d", resp.StatusCode)
 					reqObj.Status = models.RequestStatusFailed
 					reqObj.Errors = "request might have conflicts"
+					if len(result.Response.Conflicts) > 0 {
+						// e.g. DHIS2 answers 409 when some of the values were ignored
+						reqObj.Status = models.ImportStatus(result.Response.Status, importCount)
+						reqObj.Errors = models.ImportCountSummary(importCount)
+					}
 					reqObj.Retries += 1
 					reqObj.Response = string(respBody)
 					reqObj.updateRequest(tx)
@@ -689,6 +934,11 @@ func ProcessRequest(tx *sqlx.Tx, reqObj RequestObject, destination models.Server
 		} else {
 			// We are using Async
 			bodyBytes, err := io.ReadAll(resp.Body)
+			if err != nil && ctx.Err() != nil {
+				_ = resp.Body.Close()
+				reqObj.markOutcomeUnknown(tx, destination, serverInCC)
+				return err
+			}
 			if err != nil {
 				reqObj.WithStatus(models.RequestStatusFailed).updateRequestStatus(tx)
 				log.WithError(err).Error("Could not read response")
@@ -788,7 +1038,7 @@ func ProcessRequest(tx *sqlx.Tx, reqObj RequestObject, destination models.Server
 }
 
 // StartConsumers starts the consumer go routines
-func StartConsumers(jobs <-chan int, wg *sync.WaitGroup, mutex *sync.RWMutex, seedMap map[models.RequestID]bool) {
+func StartConsumers(ctx context.Context, jobs <-chan int, wg *sync.WaitGroup, mutex *sync.RWMutex, seedMap map[models.RequestID]bool) {
 	defer wg.Done()
 
 	dbURI := config.AirQoIntegratorConf.Database.URI
@@ -798,27 +1048,28 @@ func StartConsumers(jobs <-chan int, wg *sync.WaitGroup, mutex *sync.RWMutex, se
 
 		newConn, err := sqlx.Connect("postgres", dbURI)
 		if err != nil {
-			log.Fatalln("Request processor failed to connect to database: %v", err)
+			log.Fatalf("Request processor failed to connect to database: %v", err)
 		}
 		fmt.Printf("Adding Consumer: %d\n", i)
 		wg.Add(1)
-		go Consume(newConn, i, jobs, wg, mutex, seedMap)
+		go Consume(ctx, newConn, i, jobs, wg, mutex, seedMap)
 	}
 	log.WithFields(log.Fields{"MaxConsumers": config.AirQoIntegratorConf.Server.MaxConcurrent}).Info("Created Consumers: ")
 }
 
 const incompleteRequestsSQL = `
 	SELECT id, destination, status, retries, failed_cc_servers(cc_servers, cc_servers_status) AS cc_servers, body,
-	       url_suffix, cc_servers_status, object_type, ctype, body_is_query_param
+	       url_suffix, cc_servers_status, object_type, ctype, body_is_query_param, external_ref
 	FROM requests 
 	WHERE 
-	    ((status IN ('completed', 'failed') AND failed_cc_servers(cc_servers, cc_servers_status) <> '{}')  
+	    ((status IN ('completed', 'partial', 'failed') AND failed_cc_servers(cc_servers, cc_servers_status) <> '{}')  
 	   	OR status = 'failed') AND suspended = 0 AND status <> 'expired' ORDER by depends_on desc;
 `
 
 // RetryIncompleteRequests is intended to occasionally retry incomplete requests - there could be a success chance
-// this could be scheduled to run every so often
-func RetryIncompleteRequests() {
+// this could be scheduled to run every so often. No more requests are picked once ctx is cancelled
+// while sendCtx aborts the in-flight sends
+func RetryIncompleteRequests(ctx, sendCtx context.Context) {
 	log.Info("..::::::.. Starting to process Incomplete Requests ..::::::..")
 	dbConn := db.GetDB()
 	rows, err := dbConn.Queryx(incompleteRequestsSQL)
@@ -828,6 +1079,10 @@ func RetryIncompleteRequests() {
 	}
 
 	for rows.Next() {
+		if ctx.Err() != nil {
+			log.Info("Shutting down. Stopped retrying incomplete requests")
+			break
+		}
 		reqObj := RequestObject{}
 		err := rows.StructScan(&reqObj)
 		if err != nil {
@@ -838,25 +1093,29 @@ func RetryIncompleteRequests() {
 		tx := dbConn.MustBegin()
 
 		if reqObj.Status == "failed" { // destination server request had failed
-			if reqDestination, ok := models.ServerMap[fmt.Sprintf("%d", reqObj.Destination)]; ok {
+			if reqDestination, ok := models.LookupServer(fmt.Sprintf("%d", reqObj.Destination)); ok {
 				if reqObj.Retries <= config.AirQoIntegratorConf.Server.MaxRetries {
 					if config.AirQoIntegratorConf.Server.FakeSyncToBaseDHIS2 {
 						reqObj.StatusCode = "FAKED"
 						reqObj.WithStatus(models.RequestStatusCompleted).updateRequestStatus(tx)
 						reqObj.updateRequest(tx)
 
-					} else {
-						_ = ProcessRequest(tx, reqObj, reqDestination, false, true)
+					} else if err := ProcessRequest(sendCtx, tx, reqObj, reqDestination, false, true); errors.Is(err, errNotSent) {
+						_ = tx.Rollback()
+						break
+					} else if errors.Is(err, errServerBusy) {
+						_ = tx.Rollback()
+						continue
 					}
 				} else {
 					reqObj.WithStatus(models.RequestStatusExpired).updateRequestStatus(tx)
 				}
 
 				lo.Map(reqObj.CCServers, func(item int32, index int) error {
-					if ccServer, ok := models.ServerMap[fmt.Sprintf("%d", item)]; ok {
+					if ccServer, ok := models.LookupServer(fmt.Sprintf("%d", item)); ok {
 						log.WithFields(log.Fields{"CCServerID": item, "ServerIndex": index}).Info(
 							"- Incomplete Request Retry:")
-						return ProcessRequest(tx, reqObj, ccServer, true, true)
+						return ProcessRequest(sendCtx, tx, reqObj, ccServer, true, true)
 					} else {
 						log.WithField("ServerID", item).Info("Incomplete Request Retry: Sever not in Map")
 					}
@@ -865,7 +1124,7 @@ func RetryIncompleteRequests() {
 			}
 		} else {
 			lo.Map(reqObj.CCServers, func(item int32, index int) error {
-				if ccServer, ok := models.ServerMap[fmt.Sprintf("%d", item)]; ok {
+				if ccServer, ok := models.LookupServer(fmt.Sprintf("%d", item)); ok {
 
 					// get cc server's status
 					var ccServerStatus map[string]any
@@ -885,7 +1144,7 @@ func RetryIncompleteRequests() {
 								"Retries":     ccServerStatus["retries"],
 								"RequestID":   reqObj.ID,
 							}).Info("+ Incomplete Request Retry")
-						return ProcessRequest(tx, reqObj, ccServer, true, true)
+						return ProcessRequest(sendCtx, tx, reqObj, ccServer, true, true)
 					} else {
 						log.WithFields(
 							log.Fields{
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"airqo-integrator/models"
+	"airqo-integrator/utils/dbutils"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+func TestCCTransformFailureOnlyFailsCCServer(t *testing.T) {
+	reqObj := RequestObject{
+		ID: 1, Body: `{"period":"20240101"}`, ObjectType: "AGGREGATE_DATA",
+		Status: models.RequestStatusCompleted, StatusCode: "200", Errors: "Imported: 1", Retries: 1,
+		CCServersStatus: dbutils.MapAnything{"7": map[string]interface{}{"status": "ready", "retries": float64(1)}},
+	}
+	transforms := models.BodyTransforms{{Type: models.BodyTransformJSONPatch,
+		Patch: json.RawMessage(`[{"op":"remove","path":"/missing"}]`)}}
+
+	outgoing, err := reqObj.transformedFor(transforms)
+	if err == nil {
+		t.Fatalf("expected the transform to fail, got body %s", outgoing.Body)
+	}
+	reqObj.applySendFailure(7, true, err)
+
+	if reqObj.Status != models.RequestStatusCompleted || reqObj.StatusCode != "200" || reqObj.Retries != 1 {
+		t.Errorf("primary outcome changed to %s, %s, %d retries", reqObj.Status, reqObj.StatusCode, reqObj.Retries)
+	}
+	ccStatus, _ := reqObj.CCServersStatus["7"].(map[string]interface{})
+	if ccStatus["status"] != models.RequestStatusFailed || ccStatus["statusCode"] != "ERROR02" || ccStatus["retries"] != 2 {
+		t.Errorf("got CC server status %v, want failed with ERROR02 after 2 tries", ccStatus)
+	}
+}
+
+func TestPrimarySendFailure(t *testing.T) {
+	reqObj := RequestObject{ID: 1, Status: models.RequestStatusReady}
+	reqObj.applySendFailure(3, false, nil)
+	if reqObj.Status != models.RequestStatusFailed || reqObj.StatusCode != "ERROR02" || reqObj.Retries != 1 {
+		t.Errorf("got %s, %s, %d retries, want failed, ERROR02, 1", reqObj.Status, reqObj.StatusCode, reqObj.Retries)
+	}
+}
+
+func TestRequestPayloadSendsJSONAsWritten(t *testing.T) {
+	tests := []struct {
+		name       string
+		objectType string
+		body       string
+		wantErr    bool
+	}{
+		{"numbers keep their precision", "AGGREGATE_DATA", `{"value": 12345678901234567890.10, "period":"20240101"}`, false},
+		{"organisation units", "ORGANISATION_UNITS", `[{"id":"ou1","name":"Kampala"}]`, false},
+		{"invalid JSON", "AGGREGATE_DATA", `{"value":`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqObj := RequestObject{Body: tt.body, ObjectType: tt.objectType, ContentType: "application/json"}
+			payload, _, err := reqObj.requestPayload()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, _ := io.ReadAll(payload)
+			if string(got) != tt.body {
+				t.Errorf("got %s, want %s", got, tt.body)
+			}
+		})
+	}
+}
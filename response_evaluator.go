@@ -0,0 +1,256 @@
+package main
+
+import (
+	"airqo-integrator/models"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/buger/jsonparser"
+	"github.com/jmoiron/sqlx"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// responseOutcome is the result of evaluating a server's response with its response rules
+type responseOutcome struct {
+	Status      models.RequestStatus
+	Value       string // value found at the server's response path
+	ExternalRef string
+	Message     string
+}
+
+// jsonPathKeys converts a simple JSONPath such as $.entry[0].response.location to jsonparser keys
+func jsonPathKeys(path string) []string {
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+	path = strings.TrimPrefix(path, ".")
+	var keys []string
+	for _, part := range strings.Split(path, ".") {
+		for part != "" {
+			i := strings.Index(part, "[")
+			if i == -1 {
+				keys = append(keys, part)
+				break
+			}
+			if i > 0 {
+				keys = append(keys, part[:i])
+			}
+			j := strings.Index(part[i:], "]")
+			if j == -1 {
+				keys = append(keys, part[i:])
+				break
+			}
+			keys = append(keys, part[i:i+j+1])
+			part = part[i+j+1:]
+		}
+	}
+	return keys
+}
+
+// jsonPathValue returns the value at path in a JSON body
+func jsonPathValue(body []byte, path string) (string, bool) {
+	value, dataType, _, err := jsonparser.Get(body, jsonPathKeys(path)...)
+	if err != nil || dataType == jsonparser.NotExist {
+		return "", false
+	}
+	return string(value), true
+}
+
+// xmlPathSteps splits a simple XPath into element steps and an optional trailing attribute
+func xmlPathSteps(path string) (steps []string, attr string, descendant bool) {
+	path = strings.TrimSpace(path)
+	descendant = strings.HasPrefix(path, "//")
+	for _, step := range strings.Split(strings.Trim(path, "/"), "/") {
+		switch {
+		case step == "" || step == "text()":
+			continue
+		case strings.HasPrefix(step, "@"):
+			attr = strings.TrimPrefix(step, "@")
+		default:
+			// ignore namespace prefixes, elements are matched by local name
+			if i := strings.Index(step, ":"); i >= 0 {
+				step = step[i+1:]
+			}
+			steps = append(steps, step)
+		}
+	}
+	return steps, attr, descendant
+}
+
+func matchesXMLPath(stack, steps []string, descendant bool) bool {
+	if descendant {
+		if len(stack) < len(steps) {
+			return false
+		}
+		stack = stack[len(stack)-len(steps):]
+	} else if len(stack) != len(steps) {
+		return false
+	}
+	for i := range steps {
+		if steps[i] != "*" && steps[i] != stack[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// xmlPathValue returns the text or attribute of the first element matching a simple XPath.
+// Supported are absolute paths (/a/b), descendant paths (//b, //a/b) and a trailing attribute (/a/@id)
+func xmlPathValue(body []byte, path string) (string, bool) {
+	steps, attr, descendant := xmlPathSteps(path)
+	if len(steps) == 0 {
+		return "", false
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	var stack []string
+	capturedDepth := 0
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", false
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if capturedDepth > 0 || !matchesXMLPath(stack, steps, descendant) {
+				continue
+			}
+			if attr == "" {
+				capturedDepth = len(stack)
+				continue
+			}
+			for _, a := range t.Attr {
+				if a.Name.Local == attr {
+					return a.Value, true
+				}
+			}
+		case xml.CharData:
+			if capturedDepth > 0 {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if capturedDepth > 0 && len(stack) == capturedDepth {
+				return strings.TrimSpace(text.String()), true
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+// isXMLResponse returns whether the response is XML, going by the content type then the body
+func isXMLResponse(contentType string, body []byte) bool {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if strings.HasSuffix(mediaType, "xml") {
+			return true
+		}
+		if strings.HasSuffix(mediaType, "json") {
+			return false
+		}
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("<"))
+}
+
+func responseValue(body []byte, path string, xmlBody bool) (string, bool) {
+	if xmlBody {
+		return xmlPathValue(body, path)
+	}
+	return jsonPathValue(body, path)
+}
+
+func containsValue(values []string, value string) bool {
+	return lo.ContainsBy(values, func(v string) bool { return strings.EqualFold(v, value) })
+}
+
+// evaluateResponse decides the outcome of a request from the response status code and,
+// when the server parses responses, the value found at its JSONResponseXPATH or XMLResponseXPATH.
+// Failed requests are retried while requests in error are not
+func evaluateResponse(destination models.Server, resp *http.Response, body []byte) responseOutcome {
+	outcome := responseOutcome{}
+	switch {
+	case resp.StatusCode/100 == 2:
+		outcome.Status = models.RequestStatusCompleted
+		outcome.Message = "Accepted by server"
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode/100 == 5:
+		outcome.Status = models.RequestStatusFailed
+		outcome.Message = "Server busy or unavailable"
+	default:
+		outcome.Status = models.RequestStatusError
+		outcome.Message = "Rejected by server"
+	}
+
+	rules := destination.ResponseRules()
+	xmlBody := isXMLResponse(resp.Header.Get("Content-Type"), body)
+	expression := destination.JSONResponseXPATH()
+	if xmlBody {
+		expression = destination.XMLResponseXPATH()
+	}
+	if destination.ParseResponses() && expression != "" {
+		value, found := responseValue(body, expression, xmlBody)
+		outcome.Value = value
+		switch {
+		case found && containsValue(rules.RetryValues, value):
+			outcome.Status = models.RequestStatusFailed
+			outcome.Message = fmt.Sprintf("Retry on response value '%s'", value)
+		case found && containsValue(rules.FailureValues, value):
+			outcome.Status = models.RequestStatusError
+			outcome.Message = fmt.Sprintf("Failure on response value '%s'", value)
+		case found && containsValue(rules.SuccessValues, value):
+			outcome.Status = models.RequestStatusCompleted
+			outcome.Message = fmt.Sprintf("Success on response value '%s'", value)
+		case outcome.Status == models.RequestStatusCompleted && len(rules.SuccessValues) > 0:
+			outcome.Status = models.RequestStatusError
+			outcome.Message = fmt.Sprintf("Unexpected response value '%s' at %s", value, expression)
+		}
+	}
+	if rules.ReferencePath != "" {
+		if ref, found := responseValue(body, rules.ReferencePath, xmlBody); found {
+			outcome.ExternalRef = ref
+		}
+	}
+	return outcome
+}
+
+// recordResponseOutcome saves the outcome of a request evaluated with the server's response rules
+func (r *RequestObject) recordResponseOutcome(
+	tx *sqlx.Tx, destination models.Server, serverInCC bool, statusCode int, outcome responseOutcome, body []byte) {
+	if serverInCC {
+		newServerStatus := make(map[string]interface{})
+		newServerStatus["errors"] = outcome.Message
+		newServerStatus["status"] = outcome.Status
+		newServerStatus["statusCode"] = fmt.Sprintf("%d", statusCode)
+		newServerStatus["externalRef"] = outcome.ExternalRef
+		newServerStatus["retries"] = 1
+		if serverStatus, ok := r.CCServersStatus[fmt.Sprintf("%d", destination.ID())].(map[string]interface{}); ok {
+			switch retries := serverStatus["retries"].(type) {
+			case float64:
+				newServerStatus["retries"] = int(retries) + 1
+			case int:
+				newServerStatus["retries"] = retries + 1
+			}
+		}
+		r.CCServersStatus[fmt.Sprintf("%d", destination.ID())] = newServerStatus
+		r.updateCCServerStatus(tx)
+	} else {
+		r.Status = outcome.Status
+		r.StatusCode = fmt.Sprintf("%d", statusCode)
+		r.Errors = outcome.Message
+		r.Retries += 1
+		r.Response = string(body)
+		if outcome.ExternalRef != "" {
+			r.ExternalRef = outcome.ExternalRef
+		}
+		r.updateRequest(tx)
+	}
+	log.WithFields(log.Fields{
+		"requestID":   r.ID,
+		"server":      destination.Name(),
+		"statusCode":  statusCode,
+		"status":      outcome.Status,
+		"value":       outcome.Value,
+		"externalRef": outcome.ExternalRef,
+	}).Info("Response evaluated with server response rules")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"airqo-integrator/config"
 	"airqo-integrator/models"
+	"context"
 	"fmt"
 	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
@@ -10,217 +11,180 @@ import (
 	"time"
 )
 
-const dueSchedulesSQL = `
-SELECT id FROM schedules WHERE next_run_at <= NOW() AND is_active = true AND status = 'ready'
-ORDER by id ASC
-`
-
-func getDueSchedules(db *sqlx.DB) ([]int64, error) {
-	var ids []int64
-	err := db.Select(&ids, dueSchedulesSQL)
-	return ids, err
+// scheduleRunTimeout returns how long a running schedule may go without its claim being renewed
+// before the run is assumed abandoned
+func scheduleRunTimeout() time.Duration {
+	if config.AirQoIntegratorConf.Server.ScheduleRunTimeout > 0 {
+		return time.Duration(config.AirQoIntegratorConf.Server.ScheduleRunTimeout) * time.Second
+	}
+	return time.Hour
 }
 
-// ProduceSchedules a function that reads ready schedules by id from the database and sends the Id to a job channel for consumer to receive and process
-func ProduceSchedules(
-	db *sqlx.DB,
-	jobs chan<- int64,
-	wg *sync.WaitGroup,
-	workingOnMutex *sync.Mutex,
-	workingOn map[int64]bool,
-) {
+// ProduceSchedules claims due schedules and sends their ids to jobs for the consumers to run. Claiming sets a
+// schedule running so it is dispatched once, and schedules left running past the run timeout are made ready again.
+// Nothing is claimed in maintenance mode. It stops once ctx is cancelled, releasing the claimed schedules not
+// yet dispatched, and closes jobs
+func ProduceSchedules(ctx context.Context, db *sqlx.DB, jobs chan<- int64, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer close(jobs)
 	log.Info("..:::.. Starting to produce due schedules..:::..")
-	//dbConn, err := sqlx.Connect("postgres", config.AirQoIntegratorConf.Database.URI)
-	//if err != nil {
-	//	log.Fatalln("Schedule producer failed to connect to database: %v", err)
-	//}
+	interval := time.Duration(config.AirQoIntegratorConf.Server.RequestProcessInterval) * time.Second
+	// claim no more than the consumers can start on so other integrators can take the rest
+	claimLimit := max(config.AirQoIntegratorConf.Server.MaxConcurrent, 1)
+	maintenance := &maintenanceGate{producer: "schedules"}
 	for {
-		rows, err := db.Queryx(dueSchedulesSQL)
-		if err != nil {
-			log.WithError(err).Error("ERROR READING READY SCHEDULES!!!")
+		if reaped, err := models.ReapStaleSchedules(db, scheduleRunTimeout()); err != nil {
+			log.WithError(err).Error("Failed to recover stale running schedules")
+		} else if len(reaped) > 0 {
+			log.WithField("schedules", reaped).Warn("Made schedules running past the run timeout ready again")
 		}
 
-		var schedulesCount = 0
-		for rows.Next() {
-			schedulesCount += 1
-			var scheduleID int64
-			err = rows.Scan(&scheduleID)
-			if err != nil {
-				log.WithError(err).Error("Error reading schedule from queue:")
+		if maintenance.closed(db) {
+			if !sleepContext(ctx, interval) {
+				log.Info("Schedule producer stopped")
+				return
 			}
-			jobs <- scheduleID
-			workingOnMutex.Lock()
-			if _, exists := workingOn[scheduleID]; exists {
-				log.WithField("scheduleID", scheduleID).Info("Schedule already in dynamic queue")
-				continue
-			}
-			workingOnMutex.Unlock()
-			go func(sched int64) {
-				// Let see if we can recover from panics XXX
-				defer func() {
-					if r := recover(); r != nil {
-						fmt.Println("Recovered in Produce", r)
-
-					}
-				}()
-				workingOnMutex.Lock()
-				defer workingOnMutex.Unlock()
-
-				jobs <- sched
-				workingOn[sched] = true
-				log.Info(fmt.Sprintf("Added Schedule [id: %v]", sched))
-			}(scheduleID)
+			continue
 		}
-		if err := rows.Err(); err != nil {
-			log.WithError(err).Error("Error reading schedules")
+		ids, err := models.ClaimDueSchedules(ctx, db, claimLimit)
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Error("Failed to claim due schedules")
 		}
-		_ = rows.Close()
-		if schedulesCount > 0 {
-			log.WithField("scheduleAdded", schedulesCount).Info("Fetched Schedules")
+		for i, id := range ids {
+			select {
+			case jobs <- id:
+				log.WithField("scheduleID", id).Info("Dispatched schedule")
+			case <-ctx.Done():
+				if err := models.ReleaseSchedules(db, ids[i:]); err != nil {
+					log.WithError(err).Error("Failed to release claimed schedules")
+				}
+				log.Info("Schedule producer stopped")
+				return
+			}
+		}
+		if !sleepContext(ctx, interval) {
+			log.Info("Schedule producer stopped")
+			return
 		}
-
-		// log.Info(fmt.Sprintf("Schedule producer going to sleep for: %v", config.AirQoIntegratorConf.Server.RequestProcessInterval))
-		time.Sleep(
-			time.Duration(config.AirQoIntegratorConf.Server.RequestProcessInterval) * time.Second)
 	}
-
 }
 
-func ConsumeSchedules(db *sqlx.DB, jobs <-chan int64, wg *sync.WaitGroup, workingOnMutex *sync.RWMutex, workingOn map[int64]bool) {
+// ConsumeSchedules runs the schedules received on jobs until jobs is closed
+func ConsumeSchedules(ctx, sendCtx context.Context, db *sqlx.DB, jobs <-chan int64, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for id := range jobs {
-		ProcessSchedule(db, id)
-		workingOnMutex.Lock()
-		delete(workingOn, id)
-		log.WithFields(log.Fields{
-			"scheduleID":    id,
-			"seenMapLength": len(workingOn),
-			// "senMap":        seenMap,
-		}).Info("Consumer done with schedule.")
-		workingOnMutex.Unlock()
+		ProcessSchedule(ctx, sendCtx, db, id)
+		log.WithField("scheduleID", id).Info("Consumer done with schedule.")
 		time.Sleep(1 * time.Second)
 	}
 }
 
-func ProcessSchedule(db *sqlx.DB, id int64) {
+// ProcessSchedule runs a due schedule. Command schedules get ctx and sendCtx to stop their tasks on shutdown
+func ProcessSchedule(ctx, sendCtx context.Context, db *sqlx.DB, id int64) {
 	log.WithField("ScheduleID", id).Info("Processing Schedule")
+	defer func() {
+		// a run that failed before recording a new status is retried
+		if err := models.ReleaseSchedules(db, []int64{id}); err != nil {
+			log.WithError(err).WithField("scheduleID", id).Error("Failed to release schedule")
+		}
+	}()
+	// a long run must not be reaped and dispatched again while it is still going
+	defer renewScheduleClaim(db, id, scheduleRunTimeout()/3)()
 	schedule, err := models.GetSchedule(db, id)
 	if err != nil {
 		log.WithError(err).Error("Failed to fetch schedule")
 		return
 	}
-	tx, err := db.Beginx()
+	run, err := models.StartScheduleRun(db, schedule.ID)
 	if err != nil {
-		log.Fatalln(err)
+		log.WithError(err).WithField("scheduleID", schedule.ID).Error("Failed to record schedule run")
+		return
 	}
-
+	// the task runs outside a transaction so a long run holds no locks. Its outcome is recorded in a short one
 	defer func() {
 		if p := recover(); p != nil {
-			_ = tx.Rollback()
+			run.SetOutcome(models.ScheduleRunError, fmt.Sprintf("Run panicked: %v", p))
+			_ = run.Finish(db)
 			panic(p)
-		} else if err != nil {
-			_ = tx.Rollback()
-		} else {
-			err = tx.Commit()
+		}
+		if err := run.Finish(db); err != nil {
+			log.WithError(err).WithField("scheduleID", schedule.ID).Error("Failed to record end of schedule run")
 		}
 	}()
 
 	switch schedule.ScheduleType {
 	case "dhis2_async_job_check":
-		completed, exists, _ := models.CheckDhis2AsyncJobStatus(schedule)
-		if completed {
-			taskSummary, err := models.CheckDhis2AsyncJobTaskSummary(tx, schedule)
-			if err != nil {
-				log.WithError(err).Errorf("Failed to check dhis2 async job: Schedule ID: %v", schedule.ID)
-			} else {
-				schedule.Status = "completed"
-				schedule.Updated = time.Now().In(models.Location)
-				err = models.UpdateScheduleTx(tx, schedule)
-				if err != nil {
-					log.WithError(err).Error("Failed to update schedule")
-				}
-				// log.Infof("Schedule updated successfully: %v", taskSummary)
-				reqObj, er := GetRequestObjectById(db, *schedule.RequestID)
-				log.Infof("REQUEST OBJECT: %v, !Nil? %v", reqObj, reqObj != nil)
-				if er == nil && reqObj != nil {
-					if *schedule.ServerInCC {
-						log.Infof("XXXXXX")
-						serverStatus := reqObj.CCServersStatus[fmt.Sprintf("%d", reqObj.Destination)].(map[string]interface{})
-						summary := fmt.Sprintf(
-							"Imported: %d, Updated: %d, Ignored: %d, Deleted: %d, Total: %d",
-							taskSummary.ImportCount.Imported,
-							taskSummary.ImportCount.Updated,
-							taskSummary.ImportCount.Ignored,
-							taskSummary.ImportCount.Deleted,
-							taskSummary.ImportCount.Total)
-						newServerStatus := make(map[string]interface{})
-						newServerStatus["errors"] = summary
-						newServerStatus["status"] = models.RequestStatusCompleted
-						// newServerStatus["statusCode"] = fmt.Sprintf("%d", resp.StatusCode)
-						switch serverStatus["retries"].(type) {
-						case float64:
-							newServerStatus["retries"] = int(serverStatus["retries"].(float64) + 1)
-						case int:
-							newServerStatus["retries"] = serverStatus["retries"].(int) + 1
-						}
-						reqObj.CCServersStatus[fmt.Sprintf("%d", reqObj.Destination)] = newServerStatus
-						// reqObj.updateCCServerStatus(tx)
-						_, _ = tx.NamedExec(`UPDATE requests SET cc_servers_status = :cc_servers_status WHERE id = :id`, reqObj)
-					} else {
-						reqObj.Retries += 1
-						if taskSummary.Status == "SUCCESS" {
-							reqObj.Status = models.RequestStatusCompleted
-							reqObj.Errors = fmt.Sprintf(
-								"Imported: %d, Updated: %d, Ignored: %d, Deleted: %d, Total: %d",
-								taskSummary.ImportCount.Imported,
-								taskSummary.ImportCount.Updated,
-								taskSummary.ImportCount.Ignored,
-								taskSummary.ImportCount.Deleted,
-								taskSummary.ImportCount.Total)
-						} else {
-							reqObj.Status = models.RequestStatusFailed
-							reqObj.Errors = fmt.Sprintf("%v", taskSummary.ImportConflicts)
-						}
-						reqObj.updateRequest(tx)
-					}
-				} else {
-					log.Infof("Request object not found while updating async request: %d", *schedule.RequestID)
-				}
-			}
-
-		} else {
-			if exists { // perhaps async request removed from server
-				schedule.Status = "ready"
-				nextRun := time.Now().Add(
-					time.Second * time.Duration(config.AirQoIntegratorConf.Server.Dhis2JobStatusCheckInterval))
-				_ = schedule.SetNextRun(tx, nextRun)
-			} else {
-				schedule.Status = "expired"
-			}
-
-			schedule.Updated = time.Now().In(models.Location)
-			err = models.UpdateScheduleTx(tx, schedule)
-			if err != nil {
-				log.WithError(err).Error("Failed to update schedule::")
-			}
+		if err := runAsyncJobCheck(db, schedule, run); err != nil {
+			run.SetOutcome(models.ScheduleRunError, err.Error())
+			log.WithError(err).WithField("scheduleID", schedule.ID).Error("Failed to check dhis2 async job")
 		}
-
 	case "url":
 		log.Info("Handling URL schedule")
+		runURLSchedule(db, schedule, run)
 	case "sms":
-		log.Info("Handling URL schedule")
-	case "contact_push":
-		log.Info("Handling contact push schedule")
+		log.Info("Handling SMS schedule")
+		runSMSSchedule(ctx, sendCtx, db, schedule, run)
 	case "command":
 		log.Info("Handling command schedule")
+		runCommandSchedule(models.WithScheduleRun(ctx, run), sendCtx, db, schedule, run)
 	default:
 		log.Info("Unknown schedule")
+		finishScheduleRun(db, schedule, run, models.ScheduleRunError, 0, "",
+			fmt.Sprintf("Unknown schedule type '%s'", schedule.ScheduleType))
+	}
+}
+
+// renewScheduleClaim renews the claim on a running schedule every interval until the returned func is called
+func renewScheduleClaim(db *sqlx.DB, id int64, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := models.RenewScheduleClaim(db, id); err != nil {
+					log.WithError(err).WithField("scheduleID", id).Error("Failed to renew schedule claim")
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
 
+// inTx runs fn in a transaction committed when fn returns no error
+func inTx(db *sqlx.DB, fn func(tx *sqlx.Tx) error) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
 	}
+	return tx.Commit()
 }
 
-func StartScheduleConsumers(scheduledJobs <-chan int64, wg *sync.WaitGroup, mutex *sync.RWMutex, workingOn map[int64]bool) {
+// finishScheduleRun records the result and outcome of the run and makes a repeating schedule ready for its
+// next run while a schedule that runs once keeps the status of its run and is deactivated
+func finishScheduleRun(
+	db *sqlx.DB, schedule models.Schedule, run *models.ScheduleRun, status string, statusCode int, response, message string) {
+	run.SetOutcome(status, message)
+	if err := inTx(db, func(tx *sqlx.Tx) error {
+		if err := schedule.RecordRunResult(tx, statusCode, response, message); err != nil {
+			return err
+		}
+		return schedule.FinishRun(tx, status)
+	}); err != nil {
+		run.SetOutcome(models.ScheduleRunError, err.Error())
+		log.WithError(err).WithField("scheduleID", schedule.ID).Error("Failed to update schedule run details")
+	}
+}
+
+func StartScheduleConsumers(ctx, sendCtx context.Context, scheduledJobs <-chan int64, wg *sync.WaitGroup) {
+	defer wg.Done()
 	dbURI := config.AirQoIntegratorConf.Database.URI
 	log.Info(fmt.Sprintf("Going to create %d Schedule Consumers. Timezone: %s!!!!!\n",
 		config.AirQoIntegratorConf.Server.MaxConcurrent, config.AirQoIntegratorConf.Server.TimeZone))
@@ -232,7 +196,7 @@ func StartScheduleConsumers(scheduledJobs <-chan int64, wg *sync.WaitGroup, mute
 		} else {
 			log.Info(fmt.Sprintf("Adding Schedule Consumer: %d\n", i))
 			wg.Add(1)
-			go ConsumeSchedules(newConn, scheduledJobs, wg, mutex, workingOn)
+			go ConsumeSchedules(ctx, sendCtx, newConn, scheduledJobs, wg)
 			numConsumers++
 		}
 	}
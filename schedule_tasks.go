@@ -0,0 +1,131 @@
+package main
+
+import (
+	"airqo-integrator/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// the internal tasks command schedules can run. Nothing is shelled out
+func init() {
+	models.RegisterScheduleTask("sync_measurements", syncMeasurementsTask)
+	models.RegisterScheduleTask("load_sites", func(_, _ context.Context, _ *sqlx.DB, _ json.RawMessage) (string, error) {
+		return "Sites loaded", models.LoadSites()
+	})
+	models.RegisterScheduleTask("load_grids", func(_, _ context.Context, _ *sqlx.DB, _ json.RawMessage) (string, error) {
+		return "Grids loaded", models.LoadGrids()
+	})
+	models.RegisterScheduleTask("retry_incomplete", func(ctx, sendCtx context.Context, _ *sqlx.DB, _ json.RawMessage) (string, error) {
+		RetryIncompleteRequests(ctx, sendCtx)
+		return "Incomplete requests retried", nil
+	})
+	models.RegisterScheduleTask("sync_orgunits", func(_, _ context.Context, _ *sqlx.DB, _ json.RawMessage) (string, error) {
+		LoadOuLevels()
+		LoadOuGroups()
+		LoadAttributes()
+		LoadLocations()
+		return "Organisation units synchronised", nil
+	})
+	models.RegisterScheduleTask(models.PurgeRequestsCommand, purgeRequestsTask)
+}
+
+// syncMeasurementsArgs are the args of sync_measurements. Without dates the last hours are synchronised
+type syncMeasurementsArgs struct {
+	StartDate string `json:"startDate,omitempty"` // YYYY-MM-DD
+	EndDate   string `json:"endDate,omitempty"`   // YYYY-MM-DD, today by default
+	Hours     int    `json:"hours,omitempty"`     // 24 by default
+}
+
+func syncMeasurementsTask(ctx, _ context.Context, db *sqlx.DB, args json.RawMessage) (string, error) {
+	params := syncMeasurementsArgs{Hours: 24}
+	if len(args) > 0 {
+		if err := json.Unmarshal(args, &params); err != nil {
+			return "", err
+		}
+	}
+	endDate := time.Now()
+	var err error
+	if params.EndDate != "" {
+		if endDate, err = time.Parse("2006-01-02", params.EndDate); err != nil {
+			return "", fmt.Errorf("invalid endDate: %w", err)
+		}
+	}
+	// without a startDate the hours before the end are synchronised
+	startDate := endDate.Add(-time.Duration(params.Hours) * time.Hour)
+	if params.StartDate != "" {
+		if startDate, err = time.Parse("2006-01-02", params.StartDate); err != nil {
+			return "", fmt.Errorf("invalid startDate: %w", err)
+		}
+	}
+	if startDate.After(endDate) {
+		return "", fmt.Errorf("startDate %s is after endDate %s",
+			startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	}
+	batch, syncErr := SendAirQoClimateData2(ctx, startDate, endDate)
+	// requests queued before a cancellation still belong to the run
+	if ids, err := models.GetRequestIDsByBatch(db, batch); err == nil {
+		models.ScheduleRunFromContext(ctx).AddRequests(ids...)
+	}
+	if syncErr != nil {
+		return "", fmt.Errorf("measurements sync stopped: %w", syncErr)
+	}
+	return fmt.Sprintf("Measurements from %s to %s synchronised",
+		startDate.Format(time.RFC3339), endDate.Format(time.RFC3339)), nil
+}
+
+// purgeRequestsTask archives the requests past retention. Values in args override the configured policy
+func purgeRequestsTask(_, _ context.Context, db *sqlx.DB, args json.RawMessage) (string, error) {
+	policy := models.RetentionPolicyFromConfig()
+	if len(args) > 0 {
+		if err := json.Unmarshal(args, &policy); err != nil {
+			return "", fmt.Errorf("invalid request purge arguments: %w", err)
+		}
+	}
+	archived, err := models.PurgeRequests(db, policy)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Archived %d requests", archived), nil
+}
+
+// runCommandSchedule runs the task named by the schedule's command and records its outcome
+func runCommandSchedule(
+	ctx, sendCtx context.Context, db *sqlx.DB, schedule models.Schedule, run *models.ScheduleRun) {
+	logger := log.WithFields(log.Fields{"scheduleID": schedule.ID, "command": schedule.Command})
+	task, ok := models.GetScheduleTask(schedule.Command)
+	if !ok {
+		logger.Error("Unknown schedule command")
+		finishScheduleRun(db, schedule, run, "error", 0, "", fmt.Sprintf("Unknown command '%s'", schedule.Command))
+		return
+	}
+	var args json.RawMessage
+	if schedule.CommandArgs != "" {
+		args = json.RawMessage(schedule.CommandArgs)
+	}
+
+	start := time.Now()
+	message, err := runScheduleTask(ctx, sendCtx, db, task, args)
+	logger = logger.WithField("duration", time.Since(start).String())
+	if err != nil {
+		logger.WithError(err).Error("Schedule command failed")
+		finishScheduleRun(db, schedule, run, "failed", 0, "", err.Error())
+		return
+	}
+	logger.Info("Schedule command completed: " + message)
+	finishScheduleRun(db, schedule, run, "completed", 0, "", message)
+}
+
+// runScheduleTask runs a task turning a panic into an error so a faulty task does not stop the consumer
+func runScheduleTask(
+	ctx, sendCtx context.Context, db *sqlx.DB, task models.ScheduleTask, args json.RawMessage) (message string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("task panicked: %v", r)
+		}
+	}()
+	return task(ctx, sendCtx, db, args)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"airqo-integrator/models"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// serverThrottle limits the in-flight requests and the request rate towards a single server
+type serverThrottle struct {
+	maxConcurrent     int
+	requestsPerSecond float64
+	slots             chan struct{} // nil when in-flight requests are not limited
+	interval          time.Duration // minimum gap between requests, 0 when rate is not limited
+	mutex             sync.Mutex
+	nextSend          time.Time
+}
+
+var (
+	serverThrottles      = make(map[models.ServerID]*serverThrottle)
+	serverThrottlesMutex = &sync.Mutex{}
+)
+
+func newServerThrottle(maxConcurrent int, requestsPerSecond float64) *serverThrottle {
+	t := &serverThrottle{maxConcurrent: maxConcurrent, requestsPerSecond: requestsPerSecond}
+	if maxConcurrent > 0 {
+		t.slots = make(chan struct{}, maxConcurrent)
+	}
+	if requestsPerSecond > 0 {
+		t.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+	return t
+}
+
+// getServerThrottle returns the throttle for a server. The throttle is recreated
+// whenever the server's limits change so that updated settings apply immediately
+func getServerThrottle(server models.Server) *serverThrottle {
+	serverThrottlesMutex.Lock()
+	defer serverThrottlesMutex.Unlock()
+	t, ok := serverThrottles[server.ID()]
+	if !ok || t.maxConcurrent != server.MaxConcurrent() || t.requestsPerSecond != server.RequestsPerSecond() {
+		t = newServerThrottle(server.MaxConcurrent(), server.RequestsPerSecond())
+		serverThrottles[server.ID()] = t
+		log.WithFields(log.Fields{
+			"server":            server.Name(),
+			"maxConcurrent":     server.MaxConcurrent(),
+			"requestsPerSecond": server.RequestsPerSecond(),
+		}).Info("Server throttle configured")
+	}
+	return t
+}
+
+// tryAcquire takes a slot without waiting. It returns false when the server has no free slot
+// or the request rate does not allow a send right now
+func (t *serverThrottle) tryAcquire() bool {
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	if t.interval == 0 {
+		return true
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	if t.nextSend.After(now) {
+		if t.slots != nil {
+			<-t.slots
+		}
+		return false
+	}
+	t.nextSend = now.Add(t.interval)
+	return true
+}
+
+// release frees the slot taken by tryAcquire
+func (t *serverThrottle) release() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"airqo-integrator/config"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errNotSent is returned by ProcessRequest when a shutdown stops it before the request is sent.
+// Nothing was recorded so the caller rolls back and the request is left for the next run
+var errNotSent = errors.New("shutting down, request not sent")
+
+// errServerBusy is returned by ProcessRequest when the destination is at its request limit. Nothing was
+// recorded so the caller rolls back and the request is produced again once the server has room
+var errServerBusy = errors.New("server at its request limit, request not sent")
+
+// shutdownTimeout returns how long in-flight work is given to drain once a shutdown is requested
+func shutdownTimeout() time.Duration {
+	if config.AirQoIntegratorConf.Server.ShutdownTimeout > 0 {
+		return time.Duration(config.AirQoIntegratorConf.Server.ShutdownTimeout) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// sleepContext sleeps for d or until ctx is cancelled. It returns false if ctx was cancelled
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// waitTimeout waits for wg to finish. It returns false if the timeout elapsed first
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
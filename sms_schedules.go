@@ -0,0 +1,257 @@
+package main
+
+import (
+	"airqo-integrator/clients"
+	"airqo-integrator/models"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+	"text/template"
+	"time"
+)
+
+// defaultSMSAlertTemplate is used when an sms schedule has no template
+const defaultSMSAlertTemplate = "Air quality alert for {{.SubCounty}}, {{.District}}: average PM2.5 on {{.Date}} " +
+	"was {{printf \"%.1f\" .PM25}} µg/m³, {{.Category}}. Limit time outdoors and keep windows closed."
+
+// smsScheduleParams are the params of an sms schedule. It alerts the subscribers of each sub-county whose
+// daily PM2.5 is in the category given or a worse one
+type smsScheduleParams struct {
+	Category  string   `json:"category"`            // the least category alerted, e.g. unhealthy
+	Template  string   `json:"template,omitempty"`  // text/template with the fields of smsAlertData
+	Day       string   `json:"day,omitempty"`       // today or yesterday, the default
+	Districts []string `json:"districts,omitempty"` // names of the districts alerted. The site districts by default
+}
+
+// smsAlertData is what an alert template is rendered with
+type smsAlertData struct {
+	SubCounty string
+	District  string
+	Date      string
+	PM25      float64
+	Category  string
+}
+
+func init() {
+	models.RegisterScheduleType(models.ScheduleType{
+		Name:        "sms",
+		Description: "Sends an SMS alert to the subscribers of each sub-county whose daily PM2.5 reaches a category",
+		Params: &models.ParamSchema{Type: "object", Required: []string{"category"}, Properties: map[string]*models.ParamSchema{
+			"category": {Type: "string", MinLength: 1,
+				Description: "The least PM2.5 category alerted, one of the names in sms_pm25_categories"},
+			"template": {Type: "string", MinLength: 1, Default: defaultSMSAlertTemplate,
+				Description: "Go template of the message with .SubCounty, .District, .Date, .PM25 and .Category"},
+			"day": {Type: "string", Enum: []any{"today", "yesterday"}, Default: "yesterday"},
+			"districts": {Type: "array", Items: &models.ParamSchema{Type: "string", MinLength: 1},
+				Description: "Names of the districts alerted. The districts with sites by default"},
+		}},
+	})
+}
+
+// dailyPM25 returns the average PM2.5 of the sites between the times and whether there were measurements
+func dailyPM25(sites []string, start, end time.Time) (float64, bool) {
+	minPm25, maxPm25, sumPm25, countPm25 := 0.0, 0.0, 0.0, 0
+	minPm10, maxPm10, sumPm10, countPm10 := 0.0, 0.0, 0.0, 0
+	for _, sid := range sites {
+		processSiteMeasurements(sid, start, end, &minPm25, &maxPm25, &sumPm25, &countPm25, &minPm10,
+			&maxPm10, &sumPm10, &countPm10)
+	}
+	if countPm25 == 0 {
+		return 0, false
+	}
+	return sumPm25 / float64(countPm25), true
+}
+
+// smsAlertRetryWindow is how long after an alert is first sent the numbers it was not delivered to are retried
+const smsAlertRetryWindow = 24 * time.Hour
+
+// deliverSMSAlert sends the alert to the recipients it was not yet delivered to and records the numbers that
+// got it. It returns how many messages were delivered and how many failed
+func deliverSMSAlert(sendCtx context.Context, db *sqlx.DB, provider clients.SMSProvider, alert *models.SMSAlert,
+	recipients []string) (int, int, error) {
+	var delivered []string
+	if alert.ID > 0 {
+		var err error
+		if delivered, err = models.SMSAlertDeliveries(db, alert.ID); err != nil {
+			return 0, 0, err
+		}
+	}
+	sent, undelivered := sendSMSAlert(sendCtx, provider, alert, recipients, delivered)
+	return len(sent), len(undelivered), models.RecordSMSAlert(db, alert, sent)
+}
+
+// sendSMSAlert sends the alert to the recipients not among those already delivered to. It returns the numbers
+// that got it and those it could not be delivered to, and sets the alert's recipient and failure counts
+func sendSMSAlert(sendCtx context.Context, provider clients.SMSProvider, alert *models.SMSAlert,
+	recipients, delivered []string) (sent, undelivered []string) {
+	pending := lo.Without(recipients, delivered...)
+	if len(pending) > 0 {
+		var err error
+		if undelivered, err = provider.Send(sendCtx, pending, alert.Message); err != nil {
+			log.WithError(err).WithField("orgUnitID", alert.OrgUnitID).Warn("Failed to send SMS alert to some recipients")
+		}
+	}
+	alert.Recipients, alert.Failed = len(recipients), len(undelivered)
+	return lo.Without(pending, undelivered...), undelivered
+}
+
+// runSMSSchedule alerts the subscribers of the sub-counties whose daily PM2.5 reaches the schedule's category.
+// Blacklisted numbers are left out and a sub-county is alerted of a category once a day. Numbers an alert
+// could not be delivered to are sent it again by the runs within smsAlertRetryWindow. No alert is started
+// once ctx is cancelled while sendCtx stops the messages being sent
+func runSMSSchedule(ctx, sendCtx context.Context, db *sqlx.DB, schedule models.Schedule, run *models.ScheduleRun) {
+	logger := log.WithField("scheduleID", schedule.ID)
+	fail := func(message string) {
+		logger.Warn("SMS schedule failed: " + message)
+		finishScheduleRun(db, schedule, run, models.ScheduleRunFailed, 0, "", message)
+	}
+
+	var params smsScheduleParams
+	if err := json.Unmarshal(schedule.Params, &params); err != nil {
+		fail(fmt.Sprintf("Invalid params: %v", err))
+		return
+	}
+	categories, err := models.PM25Categories()
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	threshold := lo.IndexOf(lo.Map(categories, func(c models.PM25Category, _ int) string { return c.Name }),
+		params.Category)
+	if threshold < 0 {
+		fail(fmt.Sprintf("Unknown PM2.5 category %s", params.Category))
+		return
+	}
+	text := lo.Ternary(params.Template != "", params.Template, defaultSMSAlertTemplate)
+	tmpl, err := template.New("sms").Parse(text)
+	if err != nil {
+		fail(fmt.Sprintf("Invalid template: %v", err))
+		return
+	}
+	provider, err := clients.NewSMSProvider()
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	now := time.Now().In(models.Location)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, models.Location)
+	if params.Day != "today" {
+		day = day.AddDate(0, 0, -1)
+	}
+	period := day.Format("2006-01-02")
+	districts := getSiteDistricts()
+	if len(params.Districts) > 0 {
+		if districts, err = models.GetOrganisationUnitsByNames(params.Districts); err != nil {
+			fail(fmt.Sprintf("Failed to find districts: %v", err))
+			return
+		}
+	}
+
+	alerts, messages, failed := 0, 0, 0
+	handled := make(map[int64]bool)
+	for _, districtID := range districts {
+		district, err := models.GetOrganisationUnitByID(districtID)
+		if err != nil {
+			logger.WithError(err).WithField("district", districtID).Warn("District not found")
+			continue
+		}
+		subCounties, _ := models.GetSubCountiesByDhis2District(districtID)
+		for subCountyUID, v := range getSubCountiesData(subCounties) {
+			if ctx.Err() != nil {
+				fail("Stopped before all alerts were sent")
+				return
+			}
+			data := v.(map[string]any)
+			subCountyID := data["id"].(int64)
+			scLogger := logger.WithFields(log.Fields{"subCounty": subCountyUID, "period": period})
+			recipients, err := models.SMSAlertRecipients(db, subCountyID)
+			if err != nil {
+				scLogger.WithError(err).Error("Failed to get SMS alert recipients")
+				continue
+			}
+			if len(recipients) == 0 {
+				continue
+			}
+			pm25, ok := dailyPM25(data["sites"].([]string), day, day.Add(24*time.Hour))
+			if !ok {
+				continue
+			}
+			index := models.PM25CategoryIndex(categories, pm25)
+			if index < threshold {
+				continue
+			}
+			category := categories[index]
+			alert, err := models.GetSMSAlert(db, subCountyID, period, category.Name)
+			if err != nil {
+				scLogger.WithError(err).Error("Failed to get SMS alert")
+				continue
+			}
+			if alert != nil && alert.Failed == 0 {
+				continue
+			}
+			if alert == nil {
+				var message bytes.Buffer
+				if err := tmpl.Execute(&message, smsAlertData{
+					SubCounty: data["name"].(string), District: district.Name, Date: period,
+					PM25: pm25, Category: category.Label(),
+				}); err != nil {
+					fail(fmt.Sprintf("Failed to render template: %v", err))
+					return
+				}
+				alert = &models.SMSAlert{ScheduleID: schedule.ID, OrgUnitID: subCountyID, Period: period,
+					Category: category.Name, PM25: pm25, Message: message.String()}
+			}
+			delivered, undelivered, err := deliverSMSAlert(sendCtx, db, provider, alert, recipients)
+			if err != nil {
+				scLogger.WithError(err).Error("Failed to record SMS alert")
+			}
+			handled[alert.ID] = true
+			messages += delivered
+			failed += undelivered
+			if delivered > 0 {
+				alerts++
+			}
+			scLogger.WithFields(log.Fields{"pm25": pm25, "category": category.Name, "recipients": len(recipients),
+				"delivered": delivered, "failed": undelivered}).Info("SMS alert sent")
+		}
+	}
+
+	// alerts of earlier periods still pending
+	pending, err := models.PendingSMSAlerts(db, schedule.ID, now.Add(-smsAlertRetryWindow))
+	if err != nil {
+		logger.WithError(err).Error("Failed to get pending SMS alerts")
+	}
+	for i := range pending {
+		alert := &pending[i]
+		if handled[alert.ID] || ctx.Err() != nil {
+			continue
+		}
+		recipients, err := models.SMSAlertRecipients(db, alert.OrgUnitID)
+		if err != nil {
+			logger.WithError(err).WithField("alertID", alert.ID).Error("Failed to get SMS alert recipients")
+			continue
+		}
+		delivered, undelivered, err := deliverSMSAlert(sendCtx, db, provider, alert, recipients)
+		if err != nil {
+			logger.WithError(err).WithField("alertID", alert.ID).Error("Failed to record SMS alert")
+		}
+		messages += delivered
+		failed += undelivered
+		if delivered > 0 {
+			alerts++
+		}
+	}
+
+	summary := fmt.Sprintf("Sent %d alerts for %s through the %s provider: %d messages delivered, %d failed",
+		alerts, period, provider.Name(), messages, failed)
+	if failed > 0 {
+		fail(summary)
+		return
+	}
+	finishScheduleRun(db, schedule, run, models.ScheduleRunCompleted, 0, "", summary)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"airqo-integrator/clients"
+	"airqo-integrator/models"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSendSMSAlertRetriesUndelivered(t *testing.T) {
+	provider := &clients.MockSMSProvider{Undeliverable: []string{"256772000002"}}
+	alert := &models.SMSAlert{OrgUnitID: 1, Message: "PM2.5 is unhealthy today"}
+	recipients := []string{"256772000001", "256772000002", "256772000003"}
+
+	sent, undelivered := sendSMSAlert(context.Background(), provider, alert, recipients, nil)
+	if want := []string{"256772000001", "256772000003"}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("first run sent to %v, want %v", sent, want)
+	}
+	if !reflect.DeepEqual(undelivered, []string{"256772000002"}) || alert.Recipients != 3 || alert.Failed != 1 {
+		t.Errorf("first run got undelivered %v, %d recipients and %d failed", undelivered, alert.Recipients, alert.Failed)
+	}
+
+	// a later run only sends to the number the alert did not reach
+	provider.Undeliverable = nil
+	sent, undelivered = sendSMSAlert(context.Background(), provider, alert, recipients,
+		[]string{"256772000001", "256772000003"})
+	if !reflect.DeepEqual(sent, []string{"256772000002"}) || len(undelivered) != 0 || alert.Failed != 0 {
+		t.Errorf("retry sent to %v with undelivered %v, want only 256772000002", sent, undelivered)
+	}
+
+	// nothing is sent once every recipient got the alert
+	sent, _ = sendSMSAlert(context.Background(), provider, alert, recipients, recipients)
+	if len(sent) != 0 {
+		t.Errorf("sent to %v after every recipient got the alert", sent)
+	}
+
+	messages := provider.Sent()
+	if len(messages) != 2 {
+		t.Fatalf("mock got %d messages, want 2", len(messages))
+	}
+	if !reflect.DeepEqual(messages[0].Recipients, recipients) || messages[0].Text != alert.Message ||
+		!reflect.DeepEqual(messages[1].Recipients, []string{"256772000002"}) {
+		t.Errorf("mock got %+v", messages)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"airqo-integrator/models"
+	"airqo-integrator/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// responseExcerptSize is how much of a url schedule's response is kept on the schedule
+const responseExcerptSize = 2048
+
+// urlScheduleParams are the params of a url schedule. The URL is the schedule's sched_url and the
+// body its sched_content. When a server is given, its credentials and transport are used and a
+// relative sched_url is resolved against the server's URL
+type urlScheduleParams struct {
+	Method      string            `json:"method,omitempty"` // GET, or POST when the schedule has content
+	Headers     map[string]string `json:"headers,omitempty"`
+	ContentType string            `json:"contentType,omitempty"` // application/json by default
+	Server      string            `json:"server,omitempty"`      // name of the server to call as
+	Auth        struct {
+		Method   string `json:"method,omitempty"` // Basic, Token or Bearer
+		Username string `json:"username,omitempty"`
+		Password string `json:"password,omitempty"` // may be encrypted with --encrypt-secret
+		Token    string `json:"token,omitempty"`    // may be encrypted with --encrypt-secret
+	} `json:"auth,omitempty"`
+	Timeout       int      `json:"timeout,omitempty"`       // seconds, 60 by default
+	SuccessCodes  []int    `json:"successCodes,omitempty"`  // status codes meaning success. Any 2xx by default
+	ResponsePath  string   `json:"responsePath,omitempty"`  // JSONPath or XPath of a value checked against the values below
+	SuccessValues []string `json:"successValues,omitempty"` // the value must be one of these when set
+	FailureValues []string `json:"failureValues,omitempty"`
+}
+
+func init() {
+	stringList := &models.ParamSchema{Type: "array", Items: &models.ParamSchema{Type: "string"}}
+	one := 1.0
+	models.RegisterScheduleType(models.ScheduleType{
+		Name:        "url",
+		Description: "Calls sched_url, sending sched_content as the body, and checks the response",
+		Params: &models.ParamSchema{Type: "object", Properties: map[string]*models.ParamSchema{
+			"method": {Type: "string", Enum: []any{"GET", "POST", "PUT", "PATCH", "DELETE"},
+				Description: "GET, or POST when the schedule has content"},
+			"headers":     {Type: "object", AdditionalProperties: &models.ParamSchema{Type: "string"}},
+			"contentType": {Type: "string", Default: "application/json"},
+			"server": {Type: "string", MinLength: 1,
+				Description: "Name of the server whose credentials and transport are used"},
+			"auth": {Type: "object", Properties: map[string]*models.ParamSchema{
+				"method":   {Type: "string", Enum: []any{"Basic", "Token", "Bearer"}},
+				"username": {Type: "string"},
+				"password": {Type: "string", Description: "May be encrypted with --encrypt-secret"},
+				"token":    {Type: "string", Description: "May be encrypted with --encrypt-secret"},
+			}},
+			"timeout": {Type: "integer", Minimum: &one, Default: 60, Description: "Seconds"},
+			"successCodes": {Type: "array", Items: &models.ParamSchema{Type: "integer"},
+				Description: "Status codes meaning success. Any 2xx by default"},
+			"responsePath": {Type: "string",
+				Description: "JSONPath or XPath of a value checked against the success and failure values"},
+			"successValues": stringList,
+			"failureValues": stringList,
+		}},
+	})
+}
+
+// urlScheduleRequest builds the HTTP request of a url schedule
+func urlScheduleRequest(ctx context.Context, schedule models.Schedule, params urlScheduleParams) (*http.Request, *http.Client, error) {
+	client := &http.Client{} // the run's timeout applies through ctx
+	target := schedule.ScheduleURL
+	auth := utils.AuthProvider(utils.NoAuth{})
+	if params.Server != "" {
+		server, ok := models.LookupServerByName(params.Server)
+		if !ok {
+			return nil, nil, fmt.Errorf("server %s not found", params.Server)
+		}
+		if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+			target = strings.TrimSuffix(server.URL(), "/") + "/" + strings.TrimPrefix(target, "/")
+		} else if !sameOrigin(target, server.URL()) {
+			// the server's credentials are only sent to the server
+			return nil, nil, fmt.Errorf("url %s is not on server %s", target, params.Server)
+		}
+		provider, err := server.AuthProvider()
+		if err != nil {
+			return nil, nil, err
+		}
+		auth = provider
+		serverClient, err := server.HTTPClient()
+		if err != nil {
+			return nil, nil, err
+		}
+		client = serverClient
+	} else if params.Auth.Method != "" {
+		provider, err := utils.NewAuthProvider(params.Auth.Method, params.Auth.Username,
+			utils.RevealSecret(params.Auth.Password), utils.RevealSecret(params.Auth.Token), utils.AuthConfig{})
+		if err != nil {
+			return nil, nil, err
+		}
+		auth = provider
+	}
+	if target == "" {
+		return nil, nil, errors.New("url schedule has no URL")
+	}
+
+	method := strings.ToUpper(params.Method)
+	if method == "" {
+		method = http.MethodGet
+		if schedule.ScheduleContent != "" {
+			method = http.MethodPost
+		}
+	}
+	var body io.Reader
+	if schedule.ScheduleContent != "" {
+		body = strings.NewReader(schedule.ScheduleContent)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", lo.Ternary(params.ContentType != "", params.ContentType, "application/json"))
+	}
+	for k, v := range params.Headers {
+		req.Header.Set(k, v)
+	}
+	// authenticate last since HMAC signs the request
+	if err := auth.Authenticate(req); err != nil {
+		return nil, nil, err
+	}
+	return req, client, nil
+}
+
+// evaluateURLScheduleResponse decides whether a url schedule run succeeded from the
+// status code and, when the params have a response path, the value found there
+func evaluateURLScheduleResponse(params urlScheduleParams, resp *http.Response, body []byte) (bool, string) {
+	ok := resp.StatusCode/100 == 2
+	if len(params.SuccessCodes) > 0 {
+		ok = lo.Contains(params.SuccessCodes, resp.StatusCode)
+	}
+	if !ok {
+		return false, fmt.Sprintf("Unexpected status %s", resp.Status)
+	}
+	if params.ResponsePath == "" {
+		return true, fmt.Sprintf("Completed with status %s", resp.Status)
+	}
+	value, found := responseValue(body, params.ResponsePath, isXMLResponse(resp.Header.Get("Content-Type"), body))
+	switch {
+	case found && containsValue(params.FailureValues, value):
+		return false, fmt.Sprintf("Failure on response value '%s'", value)
+	case len(params.SuccessValues) > 0 && !(found && containsValue(params.SuccessValues, value)):
+		return false, fmt.Sprintf("Unexpected response value '%s' at %s", value, params.ResponsePath)
+	}
+	return true, fmt.Sprintf("Completed with response value '%s'", value)
+}
+
+// runURLSchedule calls the schedule's URL and records the status code, an excerpt of the response and the outcome
+func runURLSchedule(db *sqlx.DB, schedule models.Schedule, run *models.ScheduleRun) {
+	logger := log.WithFields(log.Fields{"scheduleID": schedule.ID, "url": schedule.ScheduleURL})
+	fail := func(statusCode int, response, message string) {
+		logger.WithField("statusCode", statusCode).Warn("URL schedule failed: " + message)
+		finishScheduleRun(db, schedule, run, "failed", statusCode, response, message)
+	}
+
+	var params urlScheduleParams
+	if len(schedule.Params) > 0 {
+		if err := json.Unmarshal(schedule.Params, &params); err != nil {
+			fail(0, "", fmt.Sprintf("Invalid params: %v", err))
+			return
+		}
+	}
+	timeout := 60 * time.Second
+	if params.Timeout > 0 {
+		timeout = time.Duration(params.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, client, err := urlScheduleRequest(ctx, schedule, params)
+	if err != nil {
+		fail(0, "", err.Error())
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fail(0, "", err.Error())
+		return
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	excerpt := body
+	if len(excerpt) > responseExcerptSize {
+		excerpt = excerpt[:responseExcerptSize]
+	}
+	// the excerpt is stored as text so it must be valid UTF-8 without NUL bytes
+	excerptText := strings.ReplaceAll(strings.ToValidUTF8(string(excerpt), ""), "\x00", "")
+
+	ok, message := evaluateURLScheduleResponse(params, resp, body)
+	if !ok {
+		fail(resp.StatusCode, excerptText, message)
+		return
+	}
+	logger.WithField("statusCode", resp.StatusCode).Info("URL schedule completed")
+	finishScheduleRun(db, schedule, run, "completed", resp.StatusCode, excerptText, message)
+}
+
+// sameOrigin returns whether the URLs have the same scheme and host
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host)
+}
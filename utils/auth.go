@@ -0,0 +1,346 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthProvider adds authentication to an outgoing request
+type AuthProvider interface {
+	Authenticate(req *http.Request) error
+}
+
+// AuthConfig holds the settings of the auth methods that need more than username, password or token
+type AuthConfig struct {
+	TokenURL     string   `json:"tokenURL,omitempty"` // OAuth2 token endpoint
+	ClientID     string   `json:"clientId,omitempty"`
+	ClientSecret string   `json:"clientSecret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+	HeaderName   string   `json:"headerName,omitempty"` // header carrying the token for the Header method
+	HMACKeyID    string   `json:"hmacKeyId,omitempty"`
+	HMACSecret   string   `json:"hmacSecret,omitempty"`
+	HMACHeader   string   `json:"hmacHeader,omitempty"` // header carrying the signature, X-Signature by default
+	TokenFile    string   `json:"tokenFile,omitempty"`  // file holding the token, re-read so tokens can be rotated
+}
+
+// Value implements the driver.Valuer interface
+func (a AuthConfig) Value() (driver.Value, error) {
+	return json.Marshal(a)
+}
+
+// Scan implements the sql.Scanner interface
+func (a *AuthConfig) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+	return json.Unmarshal(b, a)
+}
+
+// NoAuth leaves the request unauthenticated
+type NoAuth struct{}
+
+// Authenticate ...
+func (a NoAuth) Authenticate(req *http.Request) error { return nil }
+
+// BasicAuth authenticates with a username and password
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// Authenticate ...
+func (a BasicAuth) Authenticate(req *http.Request) error {
+	auth := a.Username + ":" + a.Password
+	req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	return nil
+}
+
+// readToken returns the token, preferring the token file when set so a rotated token is picked up
+func readToken(token, tokenFile string) (string, error) {
+	if tokenFile == "" {
+		return token, nil
+	}
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file %s: %w", tokenFile, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// DHIS2TokenAuth authenticates with a DHIS2 personal access token
+type DHIS2TokenAuth struct {
+	Token     string
+	TokenFile string
+}
+
+// Authenticate ...
+func (a DHIS2TokenAuth) Authenticate(req *http.Request) error {
+	token, err := readToken(a.Token, a.TokenFile)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "ApiToken "+token)
+	return nil
+}
+
+// BearerAuth authenticates with a bearer token
+type BearerAuth struct {
+	Token     string
+	TokenFile string
+}
+
+// Authenticate ...
+func (a BearerAuth) Authenticate(req *http.Request) error {
+	token, err := readToken(a.Token, a.TokenFile)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// HeaderAuth sends the token in a custom header e.g X-API-Key
+type HeaderAuth struct {
+	Header    string
+	Token     string
+	TokenFile string
+}
+
+// Authenticate ...
+func (a HeaderAuth) Authenticate(req *http.Request) error {
+	if a.Header == "" {
+		return errors.New("no header name configured for header authentication")
+	}
+	token, err := readToken(a.Token, a.TokenFile)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(a.Header, token)
+	return nil
+}
+
+// HMACAuth signs requests with HMAC-SHA256. The signed string is the method, the request URI,
+// the unix timestamp sent in X-Timestamp and the hex SHA256 of the body, separated by new lines
+type HMACAuth struct {
+	KeyID  string
+	Secret string
+	Header string
+}
+
+// Authenticate ...
+func (a HMACAuth) Authenticate(req *http.Request) error {
+	if a.Secret == "" {
+		return errors.New("no secret configured for HMAC authentication")
+	}
+	var body []byte
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		body, err = io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	bodyHash := sha256.Sum256(body)
+	signed := strings.Join([]string{
+		req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(bodyHash[:])}, "\n")
+	mac := hmac.New(sha256.New, []byte(a.Secret))
+	mac.Write([]byte(signed))
+
+	header := a.Header
+	if header == "" {
+		header = "X-Signature"
+	}
+	req.Header.Set("X-Timestamp", timestamp)
+	if a.KeyID != "" {
+		req.Header.Set("X-Key-Id", a.KeyID)
+	}
+	req.Header.Set(header, hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// oauth2Token is a cached OAuth2 access token
+type oauth2Token struct {
+	accessToken string
+	expiry      time.Time
+}
+
+var (
+	oauth2Tokens      = make(map[string]oauth2Token)
+	oauth2FetchLocks  = make(map[string]*oauth2FetchLock) // one per cache key so a slow token endpoint only holds up its own sends
+	oauth2TokensMutex = &sync.Mutex{}
+	oauth2Client      = &http.Client{Timeout: 30 * time.Second}
+)
+
+// oauth2FetchLock serialises the token fetches of a cache key. It is dropped once no send waits on it
+type oauth2FetchLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockOAuth2Fetch takes the fetch lock of key and returns the function releasing it
+func lockOAuth2Fetch(key string) func() {
+	oauth2TokensMutex.Lock()
+	fetchLock, ok := oauth2FetchLocks[key]
+	if !ok {
+		fetchLock = &oauth2FetchLock{}
+		oauth2FetchLocks[key] = fetchLock
+	}
+	fetchLock.users++
+	oauth2TokensMutex.Unlock()
+	fetchLock.Lock()
+	return func() {
+		fetchLock.Unlock()
+		oauth2TokensMutex.Lock()
+		defer oauth2TokensMutex.Unlock()
+		if fetchLock.users--; fetchLock.users == 0 {
+			delete(oauth2FetchLocks, key)
+		}
+	}
+}
+
+// OAuth2ClientCredentials authenticates with a token obtained through the OAuth2 client credentials
+// grant. Tokens are cached until shortly before they expire and then fetched again
+type OAuth2ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+}
+
+func (a OAuth2ClientCredentials) cacheKey() string {
+	return a.TokenURL + "|" + a.ClientID + "|" + strings.Join(a.Scopes, " ")
+}
+
+// Authenticate ...
+func (a OAuth2ClientCredentials) Authenticate(req *http.Request) error {
+	token, err := a.token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Invalidate drops the cached token e.g. after the server rejected it
+func (a OAuth2ClientCredentials) Invalidate() {
+	oauth2TokensMutex.Lock()
+	delete(oauth2Tokens, a.cacheKey())
+	oauth2TokensMutex.Unlock()
+}
+
+// cachedOAuth2Token returns the cached token of the key while it is not about to expire
+func cachedOAuth2Token(key string) (string, bool) {
+	oauth2TokensMutex.Lock()
+	defer oauth2TokensMutex.Unlock()
+	if t, ok := oauth2Tokens[key]; ok && time.Now().Before(t.expiry) {
+		return t.accessToken, true
+	}
+	return "", false
+}
+
+func (a OAuth2ClientCredentials) token() (string, error) {
+	key := a.cacheKey()
+	if token, ok := cachedOAuth2Token(key); ok {
+		return token, nil
+	}
+	// concurrent sends with the same credentials wait for a single fetch
+	defer lockOAuth2Fetch(key)()
+	if token, ok := cachedOAuth2Token(key); ok {
+		return token, nil
+	}
+	if a.TokenURL == "" {
+		return "", errors.New("no token URL configured for OAuth2 authentication")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(a.Scopes) > 0 {
+		form.Set("scope", strings.Join(a.Scopes, " "))
+	}
+	req, err := http.NewRequest("POST", a.TokenURL, bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+
+	resp, err := oauth2Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return "", err
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", errors.New("token response has no access_token")
+	}
+	expiresIn := time.Duration(tokenResponse.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = 5 * time.Minute
+	}
+	// refresh a little before the token expires
+	oauth2TokensMutex.Lock()
+	oauth2Tokens[key] = oauth2Token{
+		accessToken: tokenResponse.AccessToken,
+		expiry:      time.Now().Add(expiresIn * 9 / 10),
+	}
+	oauth2TokensMutex.Unlock()
+	return tokenResponse.AccessToken, nil
+}
+
+// NewAuthProvider returns the provider for an auth method. Unknown methods are an error
+// rather than silently sending unauthenticated requests
+func NewAuthProvider(method, username, password, token string, conf AuthConfig) (AuthProvider, error) {
+	switch strings.ToLower(strings.TrimSpace(method)) {
+	case "", "none":
+		return NoAuth{}, nil
+	case "basic", "basic auth":
+		return BasicAuth{Username: username, Password: password}, nil
+	case "token", "apitoken", "pat":
+		return DHIS2TokenAuth{Token: token, TokenFile: conf.TokenFile}, nil
+	case "bearer":
+		return BearerAuth{Token: token, TokenFile: conf.TokenFile}, nil
+	case "header", "apikey":
+		return HeaderAuth{Header: conf.HeaderName, Token: token, TokenFile: conf.TokenFile}, nil
+	case "hmac":
+		return HMACAuth{KeyID: conf.HMACKeyID, Secret: conf.HMACSecret, Header: conf.HMACHeader}, nil
+	case "oauth2", "oauth2_client_credentials":
+		return OAuth2ClientCredentials{
+			TokenURL: conf.TokenURL, ClientID: conf.ClientID, ClientSecret: conf.ClientSecret, Scopes: conf.Scopes}, nil
+	}
+	return nil, fmt.Errorf("unsupported auth method '%s'", method)
+}
@@ -0,0 +1,285 @@
+package utils
+
+import (
+	"airqo-integrator/config"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Secrets are stored using envelope encryption. Each value is encrypted with its own random
+// data key which is in turn encrypted with the master key. Encrypted values have the form
+// enc:v1:<master key id>:<base64 encrypted data key>:<base64 encrypted value>
+const secretPrefix = "enc:v1:"
+
+// environment variables holding the master key and, during rotation, the previous master keys
+const (
+	MasterKeyEnv          = "AIRQOINTEGRATOR_MASTER_KEY"
+	PreviousMasterKeysEnv = "AIRQOINTEGRATOR_PREVIOUS_MASTER_KEYS" // comma separated
+)
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var (
+	masterKeys     []masterKey // the first key encrypts, all keys decrypt
+	masterKeysOnce sync.Once
+)
+
+// parseMasterKey accepts a 32 byte key encoded as base64 or hex
+func parseMasterKey(raw string) ([]byte, error) {
+	raw = strings.TrimSpace(raw)
+	if key, err := base64.StdEncoding.DecodeString(raw); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(raw); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("master key must be 32 bytes encoded as base64 or hex")
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func addMasterKey(raw, source string) {
+	if strings.TrimSpace(raw) == "" {
+		return
+	}
+	key, err := parseMasterKey(raw)
+	if err != nil {
+		log.WithError(err).WithField("source", source).Error("Invalid master key")
+		return
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		log.WithError(err).WithField("source", source).Error("Invalid master key")
+		return
+	}
+	sum := sha256.Sum256(key)
+	masterKeys = append(masterKeys, masterKey{id: hex.EncodeToString(sum[:4]), aead: aead})
+}
+
+func readKeyFile(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.WithError(err).WithField("file", path).Error("Failed to read master key file")
+		return ""
+	}
+	return string(b)
+}
+
+// loadMasterKeys reads the master key from the environment or the master key file,
+// followed by the previous keys still needed to decrypt values not yet rotated
+func loadMasterKeys() {
+	masterKeysOnce.Do(func() {
+		conf := config.AirQoIntegratorConf.Server
+		if key := os.Getenv(MasterKeyEnv); key != "" {
+			addMasterKey(key, MasterKeyEnv)
+		} else if conf.MasterKeyFile != "" {
+			addMasterKey(readKeyFile(conf.MasterKeyFile), conf.MasterKeyFile)
+		}
+		if len(masterKeys) == 0 {
+			log.Warn("No master key configured. Server secrets are stored in plaintext")
+		}
+		for _, key := range strings.Split(os.Getenv(PreviousMasterKeysEnv), ",") {
+			addMasterKey(key, PreviousMasterKeysEnv)
+		}
+		for _, file := range strings.Split(conf.PreviousMasterKeyFiles, ",") {
+			if file = strings.TrimSpace(file); file != "" {
+				addMasterKey(readKeyFile(file), file)
+			}
+		}
+	})
+}
+
+// EncryptionEnabled returns whether a master key is configured
+func EncryptionEnabled() bool {
+	loadMasterKeys()
+	return len(masterKeys) > 0
+}
+
+// IsEncryptedSecret returns whether value is an encrypted secret
+func IsEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, secretPrefix)
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+// EncryptSecret encrypts a secret with the master key. Empty and already encrypted values are
+// returned as they are, and so is everything when no master key is configured
+func EncryptSecret(plaintext string) (string, error) {
+	if plaintext == "" || IsEncryptedSecret(plaintext) || !EncryptionEnabled() {
+		return plaintext, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	encryptedValue, err := seal(dataAEAD, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	encryptedKey, err := seal(masterKeys[0].aead, dataKey)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s:%s:%s", secretPrefix, masterKeys[0].id,
+		base64.StdEncoding.EncodeToString(encryptedKey), base64.StdEncoding.EncodeToString(encryptedValue)), nil
+}
+
+// DecryptSecret decrypts an encrypted secret. Plaintext values are returned as they are
+func DecryptSecret(value string) (string, error) {
+	if !IsEncryptedSecret(value) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, secretPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted secret")
+	}
+	loadMasterKeys()
+	var key *masterKey
+	for i := range masterKeys {
+		if masterKeys[i].id == parts[0] {
+			key = &masterKeys[i]
+			break
+		}
+	}
+	if key == nil {
+		return "", fmt.Errorf("master key %s used to encrypt the secret is not configured", parts[0])
+	}
+	encryptedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	encryptedValue, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := open(key.aead, encryptedKey)
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataAEAD, encryptedValue)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// RevealSecret is DecryptSecret for accessors. Secrets that cannot be decrypted are logged and returned empty
+func RevealSecret(value string) string {
+	plaintext, err := DecryptSecret(value)
+	if err != nil {
+		log.WithError(err).Error("Failed to decrypt secret")
+		return ""
+	}
+	return plaintext
+}
+
+// RotateSecret re-encrypts a secret with the current master key. It returns false
+// when the value is empty or already encrypted with the current master key
+func RotateSecret(value string) (string, bool, error) {
+	if value == "" || !EncryptionEnabled() {
+		return value, false, nil
+	}
+	if strings.HasPrefix(value, secretPrefix+masterKeys[0].id+":") {
+		return value, false, nil
+	}
+	plaintext, err := DecryptSecret(value)
+	if err != nil {
+		return value, false, err
+	}
+	rotated, err := EncryptSecret(plaintext)
+	if err != nil {
+		return value, false, err
+	}
+	return rotated, true, nil
+}
+
+// RedactedSecret replaces secrets in logs and API responses
+const RedactedSecret = "********"
+
+// RedactSecret hides a secret for logs and API responses
+func RedactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return RedactedSecret
+}
+
+// Encrypted returns the config with its secrets encrypted
+func (a AuthConfig) Encrypted() (AuthConfig, error) {
+	var err error
+	if a.ClientSecret, err = EncryptSecret(a.ClientSecret); err != nil {
+		return a, err
+	}
+	if a.HMACSecret, err = EncryptSecret(a.HMACSecret); err != nil {
+		return a, err
+	}
+	return a, nil
+}
+
+// Revealed returns the config with its secrets decrypted
+func (a AuthConfig) Revealed() AuthConfig {
+	a.ClientSecret = RevealSecret(a.ClientSecret)
+	a.HMACSecret = RevealSecret(a.HMACSecret)
+	return a
+}
+
+// Rotated returns the config with its secrets re-encrypted with the current master key
+func (a AuthConfig) Rotated() (AuthConfig, bool, error) {
+	clientSecret, rotatedClientSecret, err := RotateSecret(a.ClientSecret)
+	if err != nil {
+		return a, false, err
+	}
+	hmacSecret, rotatedHMACSecret, err := RotateSecret(a.HMACSecret)
+	if err != nil {
+		return a, false, err
+	}
+	a.ClientSecret, a.HMACSecret = clientSecret, hmacSecret
+	return a, rotatedClientSecret || rotatedHMACSecret, nil
+}
+
+// Redacted returns the config with its secrets hidden
+func (a AuthConfig) Redacted() AuthConfig {
+	a.ClientSecret = RedactSecret(a.ClientSecret)
+	a.HMACSecret = RedactSecret(a.HMACSecret)
+	return a
+}
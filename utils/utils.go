@@ -3,8 +3,6 @@ package utils
 import (
 	"airqo-integrator/db"
 	"bytes"
-	"crypto/tls"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -89,28 +87,19 @@ func GetUID() string {
 	return s.String()
 }
 
-func GetWithToken(
-	baseUrl string, authToken string) ([]byte, error) {
-
-	req, err := http.NewRequest("GET", baseUrl, nil)
-	if err != nil {
-		return nil, err
-	}
+// helperClient is shared by the HTTP helpers below
+var helperClient = &http.Client{Timeout: 60 * time.Second}
 
+// doWithAuth authenticates the request with auth, sends it and returns the response body
+func doWithAuth(req *http.Request, auth AuthProvider) ([]byte, error) {
 	req.Header.Set("Content-Type", "application/json")
-
-	// Add token authentication
-	token := "ApiToken " + authToken
-	req.Header.Set("Authorization", token)
-
-	// Create custom transport with TLS settings
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	if auth != nil {
+		if err := auth.Authenticate(req); err != nil {
+			log.WithError(err).Error("Failed to authenticate request")
+			return nil, err
+		}
 	}
-
-	client := &http.Client{Transport: tr}
-
-	resp, err := client.Do(req)
+	resp, err := helperClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -120,122 +109,56 @@ func GetWithToken(
 		return nil, err
 	}
 	_ = resp.Body.Close()
-	return body, nil
-}
-
-func PostWithToken(
-	baseUrl string, data interface{}, authToken string) ([]byte, error) {
-
-	requestBody, err := json.Marshal(data)
-	if err != nil {
-
-		log.WithError(err).Info("XXXXX ERROR")
-		return nil, err
-	}
-	req, err := http.NewRequest("POST", baseUrl, bytes.NewReader(requestBody))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	// Add token authentication
-	token := "ApiToken " + authToken
-	req.Header.Set("Authorization", token)
-
-	// Create custom transport with TLS settings
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	client := &http.Client{Transport: tr}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		return nil, err
+	if resp.StatusCode == http.StatusUnauthorized {
+		// a cached token may have been revoked, make sure the next request gets a new one
+		if oauth, ok := auth.(OAuth2ClientCredentials); ok {
+			oauth.Invalidate()
+		}
 	}
-	_ = resp.Body.Close()
 	return body, nil
 }
 
-func GetWithBasicAuth(
-	baseUrl string, username, password string) ([]byte, error) {
-
+// GetWithAuth makes a GET request authenticated by auth
+func GetWithAuth(baseUrl string, auth AuthProvider) ([]byte, error) {
 	req, err := http.NewRequest("GET", baseUrl, nil)
 	if err != nil {
 		return nil, err
 	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	// Add basic authentication
-	auth := username + ":" + password
-	basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
-	req.Header.Set("Authorization", basicAuth)
-
-	// Create custom transport with TLS settings
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-
-	client := &http.Client{Transport: tr, Timeout: 60 * time.Second}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		return nil, err
-	}
-	_ = resp.Body.Close()
-	return body, nil
+	return doWithAuth(req, auth)
 }
 
-func PostWithBasicAuth(
-	baseUrl string, data interface{}, username, password string) ([]byte, error) {
-
+// PostWithAuth posts data as JSON in a request authenticated by auth
+func PostWithAuth(baseUrl string, data interface{}, auth AuthProvider) ([]byte, error) {
 	requestBody, err := json.Marshal(data)
 	if err != nil {
 		log.WithError(err).WithFields(log.Fields{"Data": fmt.Sprintf("%v", data)}).Info("XXXXX ERROR")
 		return nil, err
 	}
-	req, err := http.NewRequest("POST", baseUrl, bytes.NewBuffer(requestBody))
+	req, err := http.NewRequest("POST", baseUrl, bytes.NewReader(requestBody))
 	if err != nil {
 		return nil, err
 	}
+	return doWithAuth(req, auth)
+}
 
-	req.Header.Set("Content-Type", "application/json")
-
-	// Add basic authentication
-	auth := username + ":" + password
-	basicAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
-	req.Header.Set("Authorization", basicAuth)
+func GetWithToken(
+	baseUrl string, authToken string) ([]byte, error) {
+	return GetWithAuth(baseUrl, DHIS2TokenAuth{Token: authToken})
+}
 
-	// Create custom transport with TLS settings
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
+func PostWithToken(
+	baseUrl string, data interface{}, authToken string) ([]byte, error) {
+	return PostWithAuth(baseUrl, data, DHIS2TokenAuth{Token: authToken})
+}
 
-	client := &http.Client{Transport: tr, Timeout: 60 * time.Second}
+func GetWithBasicAuth(
+	baseUrl string, username, password string) ([]byte, error) {
+	return GetWithAuth(baseUrl, BasicAuth{Username: username, Password: password})
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		return nil, err
-	}
-	_ = resp.Body.Close()
-	return body, nil
+func PostWithBasicAuth(
+	baseUrl string, data interface{}, username, password string) ([]byte, error) {
+	return PostWithAuth(baseUrl, data, BasicAuth{Username: username, Password: password})
 }
 
 //func GetRequest(